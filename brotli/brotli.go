@@ -0,0 +1,32 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package brotli makes the Brotli content coding ("br") available
+// to cloud.CompressHandler and to file servers created by cloud.FileServer
+// with DirOptions.Compress set.
+//
+// The package is used only for its side effect of registering the coding:
+//
+//	import _ "rsc.io/cloud/brotli"
+//
+// It is separate from package cloud so that programs not using Brotli
+// do not depend on the Brotli implementation.
+package brotli
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"rsc.io/cloud"
+)
+
+// Level is the Brotli compression level used for responses.
+// Compressing on the fly favors speed over the best compression.
+const Level = 5
+
+func init() {
+	cloud.RegisterEncoder("br", func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, Level)
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package brotli
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"rsc.io/cloud"
+)
+
+const text = "<html><body>hello, brotli, hello, brotli, hello</body></html>\n"
+
+func TestCompressHandler(t *testing.T) {
+	h := cloud.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Etag", `"v1"`)
+		w.Write([]byte(text))
+	}))
+	get := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("gzip, deflate, br")
+	if ce := w.Header().Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", ce)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", v)
+	}
+	if etag := w.Header().Get("Etag"); etag != `W/"v1"` {
+		t.Errorf("Etag = %q, want %q", etag, `W/"v1"`)
+	}
+	data, err := ioutil.ReadAll(brotli.NewReader(w.Body))
+	if err != nil || string(data) != text {
+		t.Fatalf("decompressed body = %q, %v, want %q, nil", data, err, text)
+	}
+
+	// Falls back to gzip, then identity.
+	w = get("gzip")
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", ce)
+	}
+	z, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(z); err != nil || string(data) != text {
+		t.Fatalf("gunzipped body = %q, %v, want %q, nil", data, err, text)
+	}
+	w = get("")
+	if ce := w.Header().Get("Content-Encoding"); ce != "" || w.Body.String() != text {
+		t.Fatalf("identity response: Content-Encoding = %q, body = %q, want none, %q", ce, w.Body, text)
+	}
+}
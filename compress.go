@@ -0,0 +1,368 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression and byte ranges
+//
+// A Range request always applies to the uncompressed representation of a file.
+// For a file whose cached copy is stored gzip-compressed
+// (its loader metadata has ContentEncoding "gzip"),
+// a file server sends the stored bytes as is, with Content-Encoding: gzip,
+// to a client that accepts gzip and has not asked for a range.
+// Otherwise it decompresses the stored bytes, seeking within the
+// decompressed stream to serve a range.
+//
+// A response compressed on the fly, by GzipHandler, CompressHandler,
+// or a file server with DirOptions.Compress set, does not advertise byte ranges
+// (it has no Accept-Ranges header), and a request with a Range header
+// is always served uncompressed.
+
+// An encoder is a content coding available for compressing responses.
+type encoder struct {
+	name      string
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+var gzipEncoder = encoder{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }}
+
+var encoders struct {
+	sync.Mutex
+	list []encoder
+}
+
+// RegisterEncoder makes the content coding with the given name,
+// such as "br", available to CompressHandler. The newWriter function
+// returns a writer that compresses the data written to it,
+// writing the result to w; closing it must flush any buffered data.
+// Encoders are preferred in the order they are registered,
+// all before gzip, which is always available.
+//
+// RegisterEncoder is typically called from the init function of a package
+// implementing the coding, such as rsc.io/cloud/brotli,
+// so that importing that package for its side effect enables the coding.
+func RegisterEncoder(name string, newWriter func(w io.Writer) io.WriteCloser) {
+	encoders.Lock()
+	defer encoders.Unlock()
+	encoders.list = append(encoders.list, encoder{name, newWriter})
+}
+
+// A decoder is a content coding available for decoding cached copies.
+type decoder func(r io.Reader) (io.ReadCloser, error)
+
+var decoders struct {
+	sync.Mutex
+	m map[string]decoder
+}
+
+// RegisterDecoder makes the content coding with the given name,
+// such as "zstd", available for decoding cached copies stored with
+// that coding (see diskcache.LoadMeta.ContentEncoding). A file server
+// created by FileServer sends such a copy as is, with a Content-Encoding
+// header, to a client that accepts the coding and has not asked for
+// a range; otherwise it decodes the copy using a reader returned by
+// newReader, which reads the encoded bytes from r.
+// Gzip is always available and need not be registered.
+//
+// RegisterDecoder is typically called from the init function of a package
+// implementing the coding, such as rsc.io/cloud/zstd.
+func RegisterDecoder(name string, newReader func(r io.Reader) (io.ReadCloser, error)) {
+	decoders.Lock()
+	defer decoders.Unlock()
+	if decoders.m == nil {
+		decoders.m = make(map[string]decoder)
+	}
+	decoders.m[name] = newReader
+}
+
+// lookupDecoder returns the decoder for the named content coding,
+// or nil if there is none.
+func lookupDecoder(name string) decoder {
+	if name == "gzip" {
+		return func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	}
+	decoders.Lock()
+	defer decoders.Unlock()
+	return decoders.m[name]
+}
+
+// GzipHandler returns a handler that serves requests using h,
+// compressing responses with gzip on the fly for clients that accept it.
+// Only successful responses with a compressible content type,
+// such as text/html or application/json, are compressed.
+// Requests with a Range header are served uncompressed.
+// A compressed response's ETag, if any, is marked weak,
+// since the compressed bytes are not those the ETag describes.
+func GzipHandler(h http.Handler) http.Handler {
+	return compressHandler(h, func() []encoder { return []encoder{gzipEncoder} })
+}
+
+// CompressHandler is like GzipHandler but uses the most preferred
+// content coding the client accepts among those registered with
+// RegisterEncoder and gzip. For example, if rsc.io/cloud/brotli
+// has been imported, CompressHandler uses Brotli for clients sending
+// "Accept-Encoding: br, gzip", gzip for clients sending only
+// "Accept-Encoding: gzip", and no compression for other clients.
+func CompressHandler(h http.Handler) http.Handler {
+	return compressHandler(h, func() []encoder {
+		encoders.Lock()
+		defer encoders.Unlock()
+		return append(encoders.list[:len(encoders.list):len(encoders.list)], gzipEncoder)
+	})
+}
+
+func compressHandler(h http.Handler, list func() []encoder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Range") == "" {
+			for _, enc := range list() {
+				if acceptsEncoding(r, enc.name) {
+					ew := &encodingResponseWriter{ResponseWriter: w, enc: enc, head: r.Method == "HEAD"}
+					defer ew.close()
+					h.ServeHTTP(ew, r)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding header
+// accepts the content coding enc.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, f := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(f), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		if _, q, ok := strings.Cut(params, "q="); ok {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressible reports whether content of the given type is worth compressing.
+func compressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(t, "text/") || strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml") {
+		return true
+	}
+	switch t {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// An encodingResponseWriter compresses a response using enc
+// if it turns out to be compressible.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	enc         encoder
+	head        bool // responding to HEAD request
+	wroteHeader bool
+	z           io.WriteCloser
+}
+
+func (w *encodingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.enc.name)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("Etag", "W/"+etag)
+		}
+		if !w.head {
+			w.z = w.enc.newWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *encodingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.z != nil {
+		return w.z.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *encodingResponseWriter) close() {
+	if w.z != nil {
+		w.z.Close()
+	}
+}
+
+// A rawEncodingWriter removes the Accept-Ranges header from a response
+// sending stored compressed bytes as is, since ranges of the compressed bytes
+// are not offered.
+type rawEncodingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *rawEncodingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Content-Encoding") != "" {
+			w.Header().Del("Accept-Ranges")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *rawEncodingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// A decodedFile is an http.File presenting the decoded content
+// of a file stored with a content coding, such as gzip.
+// It seeks by decoding from the start of the file as needed.
+type decodedFile struct {
+	f         *os.File
+	newReader func(io.Reader) (io.ReadCloser, error)
+	z         io.ReadCloser
+	pos       int64 // position of z in decoded stream
+	off       int64 // offset of next Read
+	size      int64 // decoded size, or -1 if not yet known
+}
+
+func newDecodedFile(f *os.File, newReader func(io.Reader) (io.ReadCloser, error)) *decodedFile {
+	return &decodedFile{f: f, newReader: newReader, size: -1}
+}
+
+// reset restarts decoding at the beginning of the file.
+func (g *decodedFile) reset() error {
+	if g.z != nil {
+		g.z.Close()
+		g.z = nil
+	}
+	z, err := g.newReader(io.NewSectionReader(g.f, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	g.z = z
+	g.pos = 0
+	return nil
+}
+
+func (g *decodedFile) Read(p []byte) (int, error) {
+	if g.z == nil || g.off < g.pos {
+		if err := g.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if g.off > g.pos {
+		n, err := io.CopyN(io.Discard, g.z, g.off-g.pos)
+		g.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.z.Read(p)
+	g.pos += int64(n)
+	g.off = g.pos
+	return n, err
+}
+
+var errSeek = errors.New("cloud: invalid seek")
+
+func (g *decodedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.off
+	case io.SeekEnd:
+		size, err := g.decompressedSize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, errSeek
+	}
+	g.off = offset
+	return offset, nil
+}
+
+// decompressedSize returns the size of the decoded content.
+func (g *decodedFile) decompressedSize() (int64, error) {
+	if g.size >= 0 {
+		return g.size, nil
+	}
+	z, err := g.newReader(io.NewSectionReader(g.f, 0, 1<<62))
+	if err != nil {
+		return 0, err
+	}
+	defer z.Close()
+	n, err := io.Copy(io.Discard, z)
+	if err != nil {
+		return 0, err
+	}
+	g.size = n
+	return n, nil
+}
+
+func (g *decodedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: g.f.Name(), Err: errors.New("not a directory")}
+}
+
+func (g *decodedFile) Stat() (os.FileInfo, error) {
+	fi, err := g.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := g.decompressedSize()
+	if err != nil {
+		return nil, err
+	}
+	return &decodedInfo{fi, size}, nil
+}
+
+func (g *decodedFile) Close() error {
+	if g.z != nil {
+		g.z.Close()
+	}
+	return g.f.Close()
+}
+
+type decodedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *decodedInfo) Size() int64 { return fi.size }
@@ -0,0 +1,196 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"rsc.io/cloud/diskcache"
+)
+
+const compressText = "The quick brown fox jumps over the lazy dog.\n"
+
+// loadGzipped stores compressText gzip-compressed, recording the encoding.
+func loadGzipped(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	z := gzip.NewWriter(target)
+	z.Write([]byte(compressText))
+	if err := z.Close(); err != nil {
+		return false, nil, err
+	}
+	m := &diskcache.LoadMeta{ContentType: "text/plain; charset=utf-8", ContentEncoding: "gzip"}
+	return false, m.Marshal(), nil
+}
+
+func serve(h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	z, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestFileServerStoredGzip(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(loadGzipped))
+	defer cleanup()
+	h := FileServer(c, "/static", nil)
+
+	// A range applies to the uncompressed content, even if the client accepts gzip.
+	w := serve(h, "/fox.txt", "Range", "bytes=4-8", "Accept-Encoding", "gzip")
+	if w.Code != 206 || w.Body.String() != "quick" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("range request: %d %q Content-Encoding=%q, want 206 %q and no encoding",
+			w.Code, w.Body, w.Header().Get("Content-Encoding"), "quick")
+	}
+	if cr, want := w.Header().Get("Content-Range"), "bytes 4-8/45"; cr != want {
+		t.Errorf("range request: Content-Range = %q, want %q", cr, want)
+	}
+	w = serve(h, "/fox.txt", "Range", "bytes=-4")
+	if w.Code != 206 || w.Body.String() != "og.\n" {
+		t.Errorf("suffix range request: %d %q, want 206 %q", w.Code, w.Body, "og.\n")
+	}
+
+	// Without a range, a client accepting gzip gets the stored bytes.
+	w = serve(h, "/fox.txt", "Accept-Encoding", "gzip")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip request: %d Content-Encoding=%q, want 200 gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if ar := w.Header().Get("Accept-Ranges"); ar != "" {
+		t.Errorf("gzip request: Accept-Ranges = %q, want none", ar)
+	}
+	if body := gunzip(t, w.Body.Bytes()); body != compressText {
+		t.Errorf("gzip request: body = %q, want %q", body, compressText)
+	}
+
+	// Other clients get the decompressed content.
+	w = serve(h, "/fox.txt")
+	if w.Code != 200 || w.Body.String() != compressText || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("identity request: %d %q Content-Encoding=%q, want 200 %q and no encoding",
+			w.Code, w.Body, w.Header().Get("Content-Encoding"), compressText)
+	}
+	if ar := w.Header().Get("Accept-Ranges"); ar != "bytes" {
+		t.Errorf("identity request: Accept-Ranges = %q, want bytes", ar)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("identity request: Vary = %q, want Accept-Encoding", v)
+	}
+}
+
+func TestFileServerCompress(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if strings.HasSuffix(path, ".png") {
+			target.WriteString("\x89PNG\r\n\x1a\n")
+		}
+		target.WriteString(compressText)
+		return false, nil, nil
+	}))
+	defer cleanup()
+	h := FileServer(c, "/static", &DirOptions{Compress: true})
+
+	w := serve(h, "/fox.txt", "Accept-Encoding", "gzip")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip request: %d Content-Encoding=%q, want 200 gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if ar := w.Header().Get("Accept-Ranges"); ar != "" {
+		t.Errorf("gzip request: Accept-Ranges = %q, want none", ar)
+	}
+	if body := gunzip(t, w.Body.Bytes()); body != compressText {
+		t.Errorf("gzip request: body = %q, want %q", body, compressText)
+	}
+
+	w = serve(h, "/fox.txt", "Accept-Encoding", "gzip", "Range", "bytes=4-8")
+	if w.Code != 206 || w.Body.String() != "quick" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("range request: %d %q Content-Encoding=%q, want 206 %q and no encoding",
+			w.Code, w.Body, w.Header().Get("Content-Encoding"), "quick")
+	}
+
+	w = serve(h, "/fox.png", "Accept-Encoding", "gzip")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("incompressible request: %d Content-Encoding=%q, want 200 and no encoding",
+			w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	w = serve(h, "/fox.txt", "Accept-Encoding", "gzip;q=0, br")
+	if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), "The") {
+		t.Errorf("gzip;q=0 request: Content-Encoding=%q, want none", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestFileServerCacheCompressed(t *testing.T) {
+	loads := 0
+	text := compressText
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		target.WriteString(text)
+		return false, nil, nil
+	}))
+	defer cleanup()
+	h := FileServer(c, "/static", &DirOptions{CacheCompressed: true})
+
+	w := serve(h, "/fox.txt", "Accept-Encoding", "gzip")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip request: %d Content-Encoding=%q, want 200 gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if body := gunzip(t, w.Body.Bytes()); body != compressText {
+		t.Errorf("gzip request: body = %q, want %q", body, compressText)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("gzip request: Content-Type = %q, want text/plain", ct)
+	}
+	e, err := c.Stat("/static/fox.txt#gzip")
+	if err != nil {
+		t.Fatalf("Stat gzip copy: %v", err)
+	}
+	if m := diskcache.ParseLoadMeta(e.Meta); m.ContentEncoding != "gzip" {
+		t.Errorf("gzip copy: ContentEncoding = %q, want gzip", m.ContentEncoding)
+	}
+
+	// The compressed copy is reused, not recompressed.
+	w = serve(h, "/fox.txt", "Accept-Encoding", "gzip")
+	if body := gunzip(t, w.Body.Bytes()); body != compressText {
+		t.Errorf("second gzip request: body = %q, want %q", body, compressText)
+	}
+	if e2, err := c.Stat("/static/fox.txt#gzip"); err != nil || !e2.CreateTime.Equal(e.CreateTime) {
+		t.Errorf("second gzip request rebuilt the compressed copy")
+	}
+	if loads != 1 {
+		t.Errorf("loader called %d times, want 1", loads)
+	}
+
+	w = serve(h, "/fox.txt")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != compressText {
+		t.Errorf("identity request: Content-Encoding=%q body=%q, want none and %q",
+			w.Header().Get("Content-Encoding"), w.Body, compressText)
+	}
+
+	// A new download of the file replaces the compressed copy.
+	text = "jumped over the lazy dog\n"
+	if err := c.ForceReload("/static/fox.txt"); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, "/fox.txt", "Accept-Encoding", "gzip")
+	if body := gunzip(t, w.Body.Bytes()); body != text {
+		t.Errorf("after reload: body = %q, want %q", body, text)
+	}
+}
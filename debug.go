@@ -0,0 +1,198 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// DebugHandler returns an http.Handler exposing the internals of cache,
+// for use on an administrative port. It serves:
+//
+//	/                 an HTML page showing the cache's disk usage, statistics, and entries
+//	/?path=p          an HTML page showing the cache entry for path p
+//	/json             the same information as /, in JSON
+//	/json?path=p      the same information as /?path=p, in JSON
+//	/expire?path=p    expire the cache entry for path p (POST only)
+//	/delete?path=p    delete the cache entry for path p (POST only)
+//
+// The handler lists every cache entry, so it can be slow for large caches.
+// It performs no access control: install it only on a port
+// reachable by administrators, typically with http.StripPrefix:
+//
+//	http.Handle("/debug/cache/", http.StripPrefix("/debug/cache", cloud.DebugHandler(cache)))
+func DebugHandler(cache *diskcache.Cache) http.Handler {
+	return &debugHandler{cache}
+}
+
+type debugHandler struct {
+	c *diskcache.Cache
+}
+
+// debugInfo is the information shown by a debug handler.
+type debugInfo struct {
+	Bytes    int64 // disk usage of cached copies
+	Entries  int   // number of cached copies
+	InFlight int   // downloads in progress
+	Stats    diskcache.Stats
+	List     []*debugEntry `json:",omitempty"`
+	Entry    *debugEntry   `json:",omitempty"` // for ?path=
+}
+
+// A debugEntry is a cache entry with its loader metadata parsed.
+type debugEntry struct {
+	*diskcache.CacheEntry
+	Meta *diskcache.LoadMeta
+}
+
+func newDebugEntry(e *diskcache.CacheEntry) *debugEntry {
+	return &debugEntry{e, diskcache.ParseLoadMeta(e.Meta)}
+}
+
+func (h *debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "", "/":
+		h.serveInfo(w, r, false)
+	case "/json":
+		h.serveInfo(w, r, true)
+	case "/expire":
+		h.serveAction(w, r, h.c.Expire)
+	case "/delete":
+		h.serveAction(w, r, h.c.Delete)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *debugHandler) serveInfo(w http.ResponseWriter, r *http.Request, asJSON bool) {
+	info := &debugInfo{
+		InFlight: h.c.InFlight(),
+		Stats:    h.c.Stats(),
+	}
+	var err error
+	info.Bytes, info.Entries, err = h.c.DiskUsage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if path := r.FormValue("path"); path != "" {
+		e, err := h.c.Stat(path)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, os.ErrNotExist) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		info.Entry = newDebugEntry(e)
+	} else {
+		list, err := h.c.Entries()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, e := range list {
+			info.List = append(info.List, newDebugEntry(e))
+		}
+	}
+
+	if asJSON {
+		js, err := json.MarshalIndent(info, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(js, '\n'))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, info); err != nil {
+		log.Printf("cloud.DebugHandler: %v", err)
+	}
+}
+
+// serveAction applies the cache operation op to the path in the request
+// and redirects back to the main page.
+func (h *debugHandler) serveAction(w http.ResponseWriter, r *http.Request, op func(string) error) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.FormValue("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	if err := op(path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A relative redirect, so that the handler can be mounted anywhere.
+	w.Header().Set("Location", "./")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Cache</title></head>
+<body>
+<h1><a href="./">Cache</a></h1>
+<p>{{.Entries}} copies, {{.Bytes}} bytes; {{.InFlight}} downloads in progress (<a href="json">JSON</a>)</p>
+<table>
+<tr><th align="left">Hits</th><td>{{.Stats.Hits}}</td></tr>
+<tr><th align="left">Loads</th><td>{{.Stats.Loads}}</td></tr>
+<tr><th align="left">Load errors</th><td>{{.Stats.LoadErrors}}</td></tr>
+<tr><th align="left">Mean load time</th><td>{{.Stats.LoadTime.Mean}}</td></tr>
+<tr><th align="left">Mean time to first byte</th><td>{{.Stats.FirstByte.Mean}}</td></tr>
+</table>
+{{define "actions"}}
+<form method="POST" action="expire" style="display:inline"><input type="hidden" name="path" value="{{.}}"><input type="submit" value="expire"></form>
+<form method="POST" action="delete" style="display:inline"><input type="hidden" name="path" value="{{.}}"><input type="submit" value="delete"></form>
+{{end}}
+{{with .Entry}}
+<h2>{{.Path}}</h2>
+<table>
+<tr><th align="left">Size</th><td>{{.Size}}</td></tr>
+<tr><th align="left">Created</th><td>{{time .CreateTime}}</td></tr>
+<tr><th align="left">Refreshed</th><td>{{time .RefreshTime}}</td></tr>
+<tr><th align="left">Last used</th><td>{{time .LastUsed}}</td></tr>
+<tr><th align="left">Expires</th><td>{{time .Expires}}</td></tr>
+<tr><th align="left">Pinned</th><td>{{.Pinned}}</td></tr>
+<tr><th align="left">Overridden</th><td>{{.Overridden}}</td></tr>
+<tr><th align="left">ETag</th><td>{{.Meta.ETag}}</td></tr>
+<tr><th align="left">Last-Modified</th><td>{{time .Meta.LastModified}}</td></tr>
+<tr><th align="left">Content-Type</th><td>{{.Meta.ContentType}}</td></tr>
+<tr><th align="left">Content-Encoding</th><td>{{.Meta.ContentEncoding}}</td></tr>
+</table>
+{{template "actions" .Path}}
+{{else}}
+<table>
+<tr><th align="left">Path</th><th align="right">Size</th><th align="left">Refreshed</th><th align="left">Expires</th><th align="left">Last used</th><th></th></tr>
+{{range .List}}
+<tr><td><a href="?path={{.Path}}">{{.Path}}</a>{{if .Pinned}} (pinned){{end}}</td><td align="right">{{.Size}}</td><td>{{time .RefreshTime}}</td><td>{{time .Expires}}</td><td>{{time .LastUsed}}</td><td>{{template "actions" .Path}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,80 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func post(h http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestDebugHandler(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(loadHello))
+	defer cleanup()
+	h := DebugHandler(c)
+
+	c.ReadFile("/a")
+	c.ReadFile("/<b>")
+	c.ReadFile("/a")
+
+	w := get(h, "/json")
+	var info debugInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != 200 || err != nil {
+		t.Fatalf("GET /json: %d %v\n%s", w.Code, err, w.Body)
+	}
+	if info.Entries != 2 || len(info.List) != 2 || info.List[0].Path != "/<b>" || info.List[1].Path != "/a" {
+		t.Fatalf("GET /json: entries %d %+v, want /<b> and /a", info.Entries, info.List)
+	}
+	if info.Stats.Hits != 1 || info.Stats.Loads != 2 {
+		t.Errorf("GET /json: stats %+v, want 1 hit, 2 loads", info.Stats)
+	}
+
+	w = get(h, "/json?path=/a")
+	info = debugInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != 200 || err != nil || info.Entry == nil || info.Entry.Size != 10 {
+		t.Fatalf("GET /json?path=/a: %d %v\n%s", w.Code, err, w.Body)
+	}
+	if w := get(h, "/json?path=/missing"); w.Code != 404 {
+		t.Errorf("GET /json?path=/missing: %d, want 404", w.Code)
+	}
+
+	w = get(h, "/")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/&lt;b&gt;") || strings.Contains(w.Body.String(), "<b>") {
+		t.Errorf("GET /: %d, want escaped paths:\n%s", w.Code, w.Body)
+	}
+
+	if w := get(h, "/expire?path=/a"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /expire: %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	w = post(h, "/expire", url.Values{"path": {"/a"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "./" {
+		t.Fatalf("POST /expire: %d %q, want redirect to ./", w.Code, w.Header().Get("Location"))
+	}
+	if _, ok, err := c.ExpiresAt("/a"); !ok || err != nil {
+		t.Errorf("after POST /expire, ExpiresAt(/a) = _, %v, %v, want true, nil", ok, err)
+	}
+
+	w = post(h, "/delete", url.Values{"path": {"/a"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /delete: %d", w.Code)
+	}
+	if _, err := c.Stat("/a"); !os.IsNotExist(err) {
+		t.Errorf("after POST /delete, Stat(/a) = %v, want not-exist error", err)
+	}
+}
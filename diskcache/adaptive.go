@@ -0,0 +1,106 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import "time"
+
+// SetAdaptiveExpiration sets a policy under which each cached copy
+// has its own expiration period, between min and max,
+// adjusted according to how often the remote file has changed.
+// A new copy starts with the period min. Each time a revalidation
+// finds that the remote file has changed, the period doubles, up to max,
+// so that a file that changes constantly is not downloaded constantly.
+// Each time a revalidation finds the file unchanged, the period halves,
+// down to min.
+//
+// The per-copy periods replace the period set by SetExpiration.
+// If max is zero (the default), the policy is disabled.
+// If min is not positive, it is taken to be one second.
+func (c *Cache) SetAdaptiveExpiration(min, max time.Duration) {
+	if min <= 0 {
+		min = 1 * time.Second
+	}
+	if max < min && max > 0 {
+		max = min
+	}
+	c.mu.Lock()
+	c.adaptiveMin, c.adaptiveMax = min, max
+	c.mu.Unlock()
+}
+
+func (c *Cache) adaptiveExpiration() (min, max time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.adaptiveMin, c.adaptiveMax
+}
+
+// entryExpiration returns the expiration period for the copy described
+// by meta, given the cache-wide expiration period d.
+// A lifetime recorded by the loader (see LoadMeta.MaxAge) takes precedence
+// over both d and the adaptive policy, and the result is raised to
+// the minimum set by SetMinExpiration, except for no-store copies.
+func (c *Cache) entryExpiration(meta *metaDisk, d time.Duration) time.Duration {
+	d = c.adaptivePeriod(meta, d)
+	if len(meta.Load) > 0 && meta.Load[0] == '{' {
+		m := ParseLoadMeta(meta.Load)
+		if m.NoStore {
+			return time.Nanosecond
+		}
+		switch {
+		case m.MaxAge > 0:
+			d = m.MaxAge
+		case m.MaxAge < 0:
+			d = time.Nanosecond
+		}
+	}
+	if min := c.minExpiration(); min > 0 && d != 0 && d < min {
+		d = min
+	}
+	return d
+}
+
+// adaptivePeriod returns the expiration period for the copy described
+// by meta under the adaptive policy, or d if the policy is disabled.
+func (c *Cache) adaptivePeriod(meta *metaDisk, d time.Duration) time.Duration {
+	min, max := c.adaptiveExpiration()
+	if max <= 0 {
+		return d
+	}
+	if meta.Expiration < min {
+		return min
+	}
+	if meta.Expiration > max {
+		return max
+	}
+	return meta.Expiration
+}
+
+// adapt updates the expiration period recorded in meta
+// after the copy has been loaded or revalidated.
+// If the cache already had a copy, changed reports whether
+// the loader replaced it.
+func (c *Cache) adapt(meta *metaDisk, hadCopy, changed bool) {
+	min, max := c.adaptiveExpiration()
+	if max <= 0 {
+		meta.Expiration = 0
+		return
+	}
+	d := c.adaptivePeriod(meta, 0)
+	switch {
+	case !hadCopy:
+		d = min
+	case changed:
+		d *= 2
+	default:
+		d /= 2
+	}
+	if d < min {
+		d = min
+	}
+	if d > max {
+		d = max
+	}
+	meta.Expiration = d
+}
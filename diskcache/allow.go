@@ -0,0 +1,126 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// AllowList returns a Loader that loads only the paths for which
+// allowed reports true, using l, and reports all other paths as not found
+// (an error wrapping ErrNotFound) without invoking l.
+// The paths passed to allowed are cleaned and begin with a slash,
+// so that requests cannot evade the check using dot-dot elements.
+// AllowList is meant as a security control for public servers,
+// ensuring the cache fetches nothing outside a known set of files
+// however clients construct their requests.
+//
+// The returned loader implements StreamLoader and RangeLoader
+// if l does. It implements Lister, returning ErrNoList if l does not.
+// A listing of a directory dir is allowed if allowed(dir+"/") is true,
+// and it includes a file only if allowed reports true for the file's path,
+// and a subdirectory only if allowed reports true for its path
+// followed by a slash.
+func AllowList(l Loader, allowed func(path string) bool) Loader {
+	a := &allowLoader{l: l, allowed: allowed}
+	_, stream := l.(StreamLoader)
+	_, ranges := l.(RangeLoader)
+	switch {
+	case stream && ranges:
+		return allowStreamRangeLoader{a}
+	case stream:
+		return allowStreamLoader{a}
+	case ranges:
+		return allowRangeLoader{a}
+	}
+	return a
+}
+
+type allowLoader struct {
+	l       Loader
+	allowed func(string) bool
+}
+
+// check returns the error for path if it is not allowed.
+func (a *allowLoader) check(path string) error {
+	if !a.allowed(CleanPath(path)) {
+		return &os.PathError{Path: path, Op: "load", Err: ErrNotFound}
+	}
+	return nil
+}
+
+func (a *allowLoader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	if err := a.check(path); err != nil {
+		return false, nil, err
+	}
+	return a.l.Load(path, target, meta)
+}
+
+func (a *allowLoader) List(dir string) ([]ListEntry, error) {
+	ll, ok := a.l.(Lister)
+	if !ok {
+		return nil, ErrNoList
+	}
+	dir = CleanPath(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	if !a.allowed(prefix) {
+		return nil, &os.PathError{Path: dir, Op: "list", Err: ErrNotFound}
+	}
+	list, err := ll.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []ListEntry
+	for _, e := range list {
+		name := prefix + e.Name
+		if e.IsDir {
+			name += "/"
+		}
+		if a.allowed(name) {
+			allowed = append(allowed, e)
+		}
+	}
+	return allowed, nil
+}
+
+func (a *allowLoader) loadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	if err := a.check(path); err != nil {
+		return false, nil, err
+	}
+	return a.l.(StreamLoader).LoadStream(path, target, meta)
+}
+
+func (a *allowLoader) loadRange(path string, target io.Writer, off, n int64, meta []byte) (size int64, newMeta []byte, err error) {
+	if err := a.check(path); err != nil {
+		return 0, nil, err
+	}
+	return a.l.(RangeLoader).LoadRange(path, target, off, n, meta)
+}
+
+// Wrappers exposing the optional interfaces implemented by the allowed loader.
+
+type allowStreamLoader struct{ *allowLoader }
+
+func (a allowStreamLoader) LoadStream(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+	return a.loadStream(path, target, meta)
+}
+
+type allowRangeLoader struct{ *allowLoader }
+
+func (a allowRangeLoader) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (int64, []byte, error) {
+	return a.loadRange(path, target, off, n, meta)
+}
+
+type allowStreamRangeLoader struct{ *allowLoader }
+
+func (a allowStreamRangeLoader) LoadStream(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+	return a.loadStream(path, target, meta)
+}
+
+func (a allowStreamRangeLoader) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (int64, []byte, error) {
+	return a.loadRange(path, target, off, n, meta)
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import "sync"
+
+// defaultBackgroundWorkers is the default maximum number
+// of goroutines running background work.
+const defaultBackgroundWorkers = 4
+
+// A backgroundPool runs background tasks, such as prefetches,
+// on a bounded number of worker goroutines.
+// Workers exit when the queue is empty, so an idle pool has no goroutines.
+type backgroundPool struct {
+	mu      sync.Mutex
+	queue   []func()
+	workers int // running workers
+	max     int // maximum workers; 0 means defaultBackgroundWorkers
+}
+
+// SetBackgroundWorkers sets the maximum number of goroutines the cache
+// uses for background work, such as prefetching (see Prefetch).
+// Background tasks beyond that number wait in a queue,
+// whose length Stats reports as BackgroundQueue.
+// If n ≤ 0, the cache uses a default of 4 workers.
+// Lowering the limit does not stop running workers,
+// but they exit as they finish their tasks, until the new limit is met.
+func (c *Cache) SetBackgroundWorkers(n int) {
+	p := &c.background
+	p.mu.Lock()
+	p.max = n
+	p.mu.Unlock()
+	p.start()
+}
+
+// goBackground queues f to run in the background.
+func (c *Cache) goBackground(f func()) {
+	p := &c.background
+	p.mu.Lock()
+	p.queue = append(p.queue, f)
+	p.mu.Unlock()
+	p.start()
+}
+
+// limit returns the maximum number of workers.
+// The caller must hold p.mu.
+func (p *backgroundPool) limit() int {
+	if p.max <= 0 {
+		return defaultBackgroundWorkers
+	}
+	return p.max
+}
+
+// start starts workers for the queued tasks, up to the limit.
+func (p *backgroundPool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.workers < p.limit() && p.workers < len(p.queue) {
+		p.workers++
+		go p.work()
+	}
+}
+
+// work runs queued tasks until the queue is empty
+// or there are more workers than the limit allows.
+func (p *backgroundPool) work() {
+	p.mu.Lock()
+	for len(p.queue) > 0 && p.workers <= p.limit() {
+		f := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		f()
+		p.mu.Lock()
+	}
+	p.workers--
+	p.mu.Unlock()
+}
+
+// counts returns the number of queued tasks and running workers.
+func (p *backgroundPool) counts() (queued, workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), p.workers
+}
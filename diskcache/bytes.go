@@ -0,0 +1,145 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// maxMemBytes is the size of the largest file Bytes keeps in memory.
+const maxMemBytes = 1 << 20
+
+// maxMemTotal is the total size of the files Bytes keeps in memory.
+const maxMemTotal = 16 << 20
+
+// A memCopy is an in-memory copy of a cached file, kept by Bytes.
+type memCopy struct {
+	prefix string
+	fi     os.FileInfo // .data file the copy was read from
+	data   []byte
+}
+
+// A memCache holds the in-memory copies kept by Bytes,
+// discarding the least recently used copies to stay within maxMemTotal.
+// Its methods must be called with c.mu held.
+type memCache struct {
+	m     map[string]*list.Element // by prefix; values are *memCopy
+	lru   list.List                // most recently used first
+	bytes int64                    // total size of copies
+}
+
+// get returns the copy for prefix, or nil if there is none.
+func (mc *memCache) get(prefix string) *memCopy {
+	e := mc.m[prefix]
+	if e == nil {
+		return nil
+	}
+	mc.lru.MoveToFront(e)
+	return e.Value.(*memCopy)
+}
+
+// add adds m, replacing any copy for the same prefix.
+func (mc *memCache) add(m *memCopy) {
+	mc.remove(m.prefix)
+	if mc.m == nil {
+		mc.m = make(map[string]*list.Element)
+	}
+	mc.m[m.prefix] = mc.lru.PushFront(m)
+	mc.bytes += int64(len(m.data))
+	for mc.bytes > maxMemTotal {
+		mc.remove(mc.lru.Back().Value.(*memCopy).prefix)
+	}
+}
+
+// remove removes the copy for prefix, if any.
+func (mc *memCache) remove(prefix string) {
+	e := mc.m[prefix]
+	if e == nil {
+		return
+	}
+	mc.lru.Remove(e)
+	delete(mc.m, prefix)
+	mc.bytes -= int64(len(e.Value.(*memCopy).data))
+}
+
+// clear removes all copies.
+func (mc *memCache) clear() {
+	mc.m = nil
+	mc.lru.Init()
+	mc.bytes = 0
+}
+
+// Bytes returns the content of the file with the given path, like ReadFile,
+// but for small files it keeps the content in memory and returns
+// the same slice from each call, as long as the cached copy on disk
+// is unchanged and fresh. When the copy expires or is replaced,
+// Bytes loads or revalidates the file as Open does and reads it again.
+// Bytes is meant for small files read on a hot path, such as
+// configuration files; files larger than 1 MB are read from disk each time,
+// and once the files kept in memory total 16 MB, Bytes discards
+// the least recently used ones.
+//
+// The returned slice is shared by all callers and must not be modified.
+func (c *Cache) Bytes(path string) ([]byte, error) {
+	path, prefix := c.locate(path)
+	c.mu.Lock()
+	m := c.mem.get(prefix)
+	c.mu.Unlock()
+	if m != nil {
+		if c.memValid(m, prefix) {
+			if !c.readOnly {
+				c.touch(prefix)
+			}
+			c.recordHit()
+			return m.data, nil
+		}
+		c.mu.Lock()
+		c.mem.remove(prefix)
+		c.mu.Unlock()
+	}
+
+	f, err := c.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(data) <= maxMemBytes {
+		c.mem.add(&memCopy{prefix, fi, data})
+	} else {
+		c.mem.remove(prefix)
+	}
+	c.mu.Unlock()
+	return data, nil
+}
+
+// memValid reports whether the in-memory copy m of the entry for prefix
+// can be used: the .data file it was read from is still the cached copy,
+// and that copy is fresh.
+func (c *Cache) memValid(m *memCopy, prefix string) bool {
+	fi, err := os.Stat(prefix + ".data")
+	if err != nil || !os.SameFile(fi, m.fi) || !fi.ModTime().Equal(m.fi.ModTime()) || fi.Size() != m.fi.Size() {
+		return false
+	}
+	if c.readOnly {
+		return true
+	}
+	meta, mfi, err := peekMeta(prefix)
+	if err != nil {
+		return false
+	}
+	return meta.Override || fresh(mfi.ModTime(), c.entryExpiration(meta, c.expiration()), time.Now())
+}
@@ -29,7 +29,7 @@
 //
 // There is no cache for file load errors.
 //
-// On-Disk Format
+// # On-Disk Format
 //
 // Each cached file stored on disk using a name derived from the
 // SHA1 hash of the file name. The first three hex digits name a
@@ -46,7 +46,8 @@
 // never a partial one.
 //
 // The .meta file is the metadata associated with the .data file.
-// It contains the JSON encoding of a metadata struct.
+// It contains the JSON encoding of a metadata struct,
+// or another encoding selected by SetMetaCodec.
 // The modification time of the .meta file is the time that the .data file
 // was last downloaded or revalidated. The .data file is considered to
 // be valid until that time plus the expiration period.
@@ -57,7 +58,10 @@
 // The .used file holds a single \n byte. It is rewritten each time
 // the .data file is opened to satisfy a file open operation.
 // The modification time of the .used file is therefore the time of the
-// last use of the file.
+// last use of the file. If uses are written in batches
+// (see SetUsedFlushInterval), the cache instead sets the modification time
+// to the time of the last use when it writes the batch.
+// If usage tracking is disabled (see SetTrackUsage), there is no .used file.
 //
 // The .next file holds the next version of the cached file, while it is
 // being downloaded. Once the download has completed, the cache
@@ -65,10 +69,34 @@
 // overwriting the content of the .data file, which other clients
 // might still be reading.
 //
+// The .next file may also hold a partial copy of the file, assembled from
+// byte ranges loaded by OpenRange. In that case the .meta file records which
+// ranges are present. Once the ranges cover the entire file, the cache
+// renames the .next file onto the .data file, as for a complete download.
+// Opening a file with a partial copy, for example after a restart
+// interrupted the copy, loads only the missing ranges.
+// If the loader implements ResumeLoader, the .meta file also records
+// the version of the file being downloaded into the .next file,
+// so that a download interrupted by an error or a crash can resume
+// where it left off.
+//
+// If an inspector is set (see SetInspector), the .scan file holds the
+// inspected version of a completed download, which the cache then
+// renames onto the .next file.
+//
+// If enabled by SetManifest, the cache root directory also holds a file named
+// manifest, recording the path held by each group of files (see SetManifest).
+//
 // To allow multiple instances of a cache to manage a shared directory,
 // if a cache is doing the initial download of a file or revalidating
 // an expired copy or redownloading a new copy, it must hold an
 // exclusive BSD file lock on the .meta file (using flock(2)).
+// On file systems that do not support flock, the cache instead creates
+// a .lock file exclusively and removes it when done. Such locks are not
+// released if the client holding one crashes, so the cache assumes
+// a .lock file older than ten minutes is abandoned and removes it;
+// clients sharing a directory this way are therefore not fully
+// protected from each other.
 //
 // After downloading a new file and installing it as a .data file, the
 // cache must check that it has not exceeded the on-disk size limit.
@@ -76,23 +104,31 @@
 // tree and the modification times of the .used files.
 // It then removes the oldest cached files (.data, .meta, and .used)
 // until the data files again fit within the limit. To remove a file,
-// the cache must hold the .meta file lock.
-//
-// Warning Warning Warning
+// the cache must hold the .meta file lock. Files pinned by Pin or installed
+// by Override are never removed. Depending on the oversize policy
+// (see SetOversizePolicy), the cache may instead remove files to make room
+// before installing the new one, or not install a file too large to fit.
 //
-// This package is unfinished. In particular, DeleteAll and ExpireAll are unimplemented,
-// as is the code to delete files to stay within the maximum data size limit.
+// # Warning Warning Warning
 //
+// This package is unfinished.
 package diskcache
 
 import (
+	"context"
 	"crypto/sha1"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	pathpkg "path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -101,11 +137,47 @@ import (
 // A Cache provides read-only access to a remote file tree,
 // caching opened files on local disk.
 type Cache struct {
-	dir    string
-	loader Loader
+	dir      string
+	readOnly bool
+
+	usage    usage
+	inflight inflight
+	stats    stats
+	used     usedFlusher
+
+	background backgroundPool
+
+	mu        sync.Mutex
+	loader    Loader
+	related   func(string) []string
+	keyFunc   func(string) string
+	metaCodec MetaCodec
+	held      map[string]int // prefixes held by OpenReaderAt, with counts
+	mem       memCache       // in-memory copies kept by Bytes
 
-	atomicExpiration int64
-	atomicMaxData    int64
+	revalidating map[string]bool // prefixes with background revalidations pending
+
+	adaptiveMin, adaptiveMax time.Duration         // guarded by mu; see SetAdaptiveExpiration
+	manifest                 bool                  // guarded by mu; see SetManifest
+	evictionPolicy           EvictionPolicy        // guarded by mu; see SetEvictionPolicy
+	inspector                Inspector             // guarded by mu; see SetInspector
+	negativeTTLs             map[int]time.Duration // guarded by mu; see SetNegativeCaching
+
+	atomicExpiration     int64
+	atomicMinExpiration  int64
+	atomicMaxData        int64
+	atomicMaxEntries     int64
+	atomicMinFree        int64
+	atomicStaleIfError   int64
+	atomicStaleGrace     int64
+	atomicMetaExpiration int64
+	atomicRangeChunkSize int64
+	atomicStrict         int32
+	atomicNextRetries    int32
+	atomicPruneDirs      int32
+	atomicLockTimeout    int64
+	atomicNoTrackUsage   int32
+	atomicOversize       int32
 }
 
 // Loader is the interface Cache uses to load remote file content.
@@ -113,10 +185,15 @@ type Cache struct {
 // The Load method fetches path from the remote location, writing it to target.
 // If the cache already has a (possibly expired) copy of the file, meta will be
 // the metadata returned by a previous call to Load. Otherwise meta is nil.
+// If the previous call returned nil metadata, meta is empty but non-nil,
+// so that Load can always distinguish revalidating a copy from fetching
+// the file for the first time.
 // If the cached copy is still valid, Load should return cacheValid==true,
 // newMeta==meta (or an updated version), and err==nil.
 // Otherwise, Load should fetch the data, write it to target, and return
 // cacheValid==true, a new metadata block in newMeta, and err==nil.
+// The metadata is opaque to the cache; loaders that record several
+// validators or attributes of the remote file can use LoadMeta to encode them.
 //
 // The elements in a file path are separated by slash ('/', U+002F)
 // characters, regardless of host operating system convention.
@@ -124,17 +201,59 @@ type Loader interface {
 	Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error)
 }
 
+// The LoaderFunc type is an adapter to allow the use of ordinary functions
+// as loaders. If f is a function with the appropriate signature,
+// LoaderFunc(f) is a Loader that calls f.
+type LoaderFunc func(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error)
+
+// Load calls f(path, target, meta).
+func (f LoaderFunc) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	return f(path, target, meta)
+}
+
+// A StreamLoader is a Loader that can write file content to any io.Writer.
+// The LoadStream method behaves like Load but writes to target,
+// which it must write sequentially, without seeking.
+// The cache uses LoadStream in preference to Load,
+// which lets it observe the content as it arrives,
+// for example to measure the time to the first byte (see Stats).
+type StreamLoader interface {
+	Loader
+	LoadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error)
+}
+
 // metaDisk is the on-disk metadata storage format
 type metaDisk struct {
 	Path        string
 	CreateTime  time.Time
 	RefreshTime time.Time
 	Load        []byte
+	Pinned      bool              `json:",omitempty"`
+	Annotations map[string]string `json:",omitempty"`
+	Expiration  time.Duration     `json:",omitempty"` // adaptive expiration period
+	Override    bool              `json:",omitempty"` // copy installed by Override
+	Sum         []byte            `json:",omitempty"` // SHA-256 of copy, if computed while loading
+
+	// Most recent load error, cleared by a successful load.
+	LastError     string    `json:",omitempty"`
+	LastErrorTime time.Time `json:",omitempty"`
+	LastStatus    int       `json:",omitempty"` // status of LastError; see SetNegativeCaching
+
+	// Partial copy in .next, loaded by OpenRange.
+	NextRanges []byteRange `json:",omitempty"` // byte ranges present
+	NextSize   int64       `json:",omitempty"` // size of complete file
+	NextLoad   []byte      `json:",omitempty"` // loader metadata for partial copy
 }
 
+// ErrNotWritable is the error returned by New when the cache directory
+// cannot be written, for example because it is on a read-only file system
+// or owned by another user. To serve from such a directory, use NewReadOnly.
+var ErrNotWritable = errors.New("diskcache: cache directory is not writable")
+
 // New returns a new Cache that reads files from loader,
 // caching at most max bytes in the directory dir.
 // If dir does not exist, New will attempt to create it.
+// If dir cannot be written, New returns an error wrapping ErrNotWritable.
 func New(dir string, loader Loader) (*Cache, error) {
 	// Create dir if necessary.
 	fi, err := os.Stat(dir)
@@ -143,6 +262,9 @@ func New(dir string, loader Loader) (*Cache, error) {
 			return nil, err
 		}
 	}
+	if err := probeWritable(dir); err != nil {
+		return nil, err
+	}
 
 	c := &Cache{
 		dir:    dir,
@@ -151,6 +273,65 @@ func New(dir string, loader Loader) (*Cache, error) {
 	return c, nil
 }
 
+// probeWritable checks that dir is writable by creating
+// and removing a temporary file.
+func probeWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".probe-")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotWritable, err)
+	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotWritable, err)
+	}
+	return nil
+}
+
+// ErrReadOnly is the error returned when attempting to modify a read-only cache.
+var ErrReadOnly = errors.New("diskcache: cache is read-only")
+
+// NewReadOnly returns a new Cache that serves files from the directory dir,
+// which must already exist and is expected to be populated by a separate,
+// writable cache, typically running in another process.
+//
+// A read-only cache never invokes a loader, never takes file locks,
+// and never records uses of cached files. Its Open method serves
+// the cached copy of a file as is, even if expired, leaving revalidation
+// to the writer, and returns an error satisfying os.IsNotExist if there is no
+// cached copy. Methods that would modify the cache return ErrReadOnly.
+func NewReadOnly(dir string) (*Cache, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Path: dir, Op: "open", Err: syscall.ENOTDIR}
+	}
+	c := &Cache{
+		dir:      dir,
+		readOnly: true,
+	}
+	return c, nil
+}
+
+// SetLoader sets the loader used by future calls to Open.
+// Loads already in progress complete using the previous loader.
+// Cached copies and their metadata are kept, so the new loader
+// must interpret the metadata returned by the old loader,
+// typically because both load from equivalent sources.
+func (c *Cache) SetLoader(l Loader) {
+	c.mu.Lock()
+	c.loader = l
+	c.mu.Unlock()
+}
+
+func (c *Cache) getLoader() Loader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loader
+}
+
 // SetExpiration sets the duration after which a cached copy is
 // considered to have expired.
 // If the duration d is zero (the default), cached copies never expire.
@@ -162,11 +343,121 @@ func (c *Cache) expiration() time.Duration {
 	return time.Duration(atomic.LoadInt64(&c.atomicExpiration))
 }
 
+// SetMinExpiration sets a minimum expiration period for cached copies.
+// Expiration periods shorter than d, whether set by SetExpiration,
+// chosen by the adaptive policy, or advertised by the origin
+// (see LoadMeta.MaxAge), are raised to d, so that an origin advertising
+// no caching, as with Cache-Control: max-age=0, is not consulted
+// on every use. The minimum does not apply to copies the loader marks
+// as no-store (see LoadMeta.NoStore), which are revalidated on every use,
+// nor to copies that never expire.
+// If d is zero (the default), there is no minimum.
+func (c *Cache) SetMinExpiration(d time.Duration) {
+	atomic.StoreInt64(&c.atomicMinExpiration, int64(d))
+}
+
+func (c *Cache) minExpiration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.atomicMinExpiration))
+}
+
+// SetStaleIfError sets the duration for which an expired copy may still be
+// served if the loader fails to revalidate it. If the loader returns an error
+// when revalidating a copy that was last refreshed less than the expiration
+// period plus d ago, Open returns the expired copy instead of the error.
+// If the duration d is zero (the default), Open always returns loader errors.
+//
+// A loader can exempt a file from this behavior by setting MustRevalidate
+// in the LoadMeta it returns for that file.
+func (c *Cache) SetStaleIfError(d time.Duration) {
+	atomic.StoreInt64(&c.atomicStaleIfError, int64(d))
+}
+
+func (c *Cache) staleIfError() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.atomicStaleIfError))
+}
+
+// defaultNextRetries is the default number of attempts to create a .next file.
+const defaultNextRetries = 5
+
+// SetNextRetries sets the number of attempts Open makes to create
+// the temporary file for a download when a leftover temporary file,
+// such as one from a crashed process, is in the way.
+// Attempts after the first wait briefly, with exponential backoff.
+// If n is zero or negative, the cache uses a default of 5 attempts.
+func (c *Cache) SetNextRetries(n int) {
+	atomic.StoreInt32(&c.atomicNextRetries, int32(n))
+}
+
+func (c *Cache) nextRetries() int {
+	n := int(atomic.LoadInt32(&c.atomicNextRetries))
+	if n <= 0 {
+		n = defaultNextRetries
+	}
+	return n
+}
+
+// Errors classifying loader failures. A loader should return an error
+// wrapping one of these, for example as the Err field of an *os.PathError,
+// whenever it can classify a failure, so that callers of Open can use
+// errors.Is to distinguish the cases. The cache returns loader errors
+// to its callers unchanged or wrapped, never hiding the classification.
+var (
+	// ErrNotFound reports that the file does not exist.
+	// It is os.ErrNotExist, so that os.IsNotExist recognizes
+	// an *os.PathError wrapping it.
+	ErrNotFound = os.ErrNotExist
+
+	// ErrPermission reports that the loader was denied access to the file.
+	// It is os.ErrPermission, so that os.IsPermission recognizes
+	// an *os.PathError wrapping it.
+	ErrPermission = os.ErrPermission
+
+	// ErrTransient reports a failure that may be temporary,
+	// such as a network error or an overloaded server,
+	// so that a later attempt to load the file might succeed.
+	ErrTransient = errors.New("transient failure")
+)
+
+// ErrStale is the error returned by Open in strict freshness mode
+// when a cached copy has expired and cannot be revalidated.
+var ErrStale = errors.New("diskcache: cached copy is stale")
+
+// SetStrictFreshness sets whether the cache requires cached copies to be fresh.
+// In strict freshness mode, if the loader fails to revalidate an expired copy
+// because of a transient error, such as a network failure, Open never serves
+// the expired copy, even under the stale-if-error policy set by SetStaleIfError.
+// Instead it returns an error wrapping both ErrStale and the loader's error,
+// so that a caller can distinguish a stale copy from a missing file.
+// Errors reporting that the file does not exist or cannot be accessed
+// are returned as is. The default is not to use strict freshness mode.
+func (c *Cache) SetStrictFreshness(strict bool) {
+	var v int32
+	if strict {
+		v = 1
+	}
+	atomic.StoreInt32(&c.atomicStrict, v)
+}
+
+func (c *Cache) strictFreshness() bool {
+	return atomic.LoadInt32(&c.atomicStrict) != 0
+}
+
+// transient reports whether the loader error err may be temporary,
+// so that a later attempt to load the file might succeed.
+// Errors not classified by the loader are assumed to be transient.
+func transient(err error) bool {
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
+	return !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrPermission)
+}
+
 // SetMaxData sets the maximum bytes of data to hold in cached copies.
 // The limit is imposed in a best effort fashion.
 // In particular, it does not apply to old copies that have not yet been closed,
-// nor to new copies that have not finished downloading,
-// nor to cache metadata.
+// nor to new versions of cached copies that have not finished downloading,
+// nor to cache metadata. It does apply to partial copies (see OpenRange),
+// including those left by interrupted downloads.
 func (c *Cache) SetMaxData(max int64) {
 	atomic.StoreInt64(&c.atomicMaxData, max)
 }
@@ -175,26 +466,413 @@ func (c *Cache) maxData() int64 {
 	return atomic.LoadInt64(&c.atomicMaxData)
 }
 
+// SetMaxEntries sets the maximum number of cached copies to hold.
+// Like the maximum data size limit, it is imposed in a best effort fashion,
+// by removing the least recently used copies until both limits are satisfied.
+// A limit of zero or less means no limit.
+func (c *Cache) SetMaxEntries(max int) {
+	atomic.StoreInt64(&c.atomicMaxEntries, int64(max))
+}
+
+func (c *Cache) maxEntries() int {
+	return int(atomic.LoadInt64(&c.atomicMaxEntries))
+}
+
+// expiresAt returns the time at which a copy last refreshed at modTime expires,
+// given the expiration period d, or the zero time if the copy never expires.
+// A modTime of Unix time 0 marks a copy as expired even if d is zero.
+func expiresAt(modTime time.Time, d time.Duration) time.Time {
+	if modTime.Unix() == 0 {
+		return modTime
+	}
+	if d == 0 {
+		return time.Time{}
+	}
+	return modTime.Add(d)
+}
+
+// fresh reports whether a copy last refreshed at modTime is still valid at now,
+// given the expiration period d.
+func fresh(modTime time.Time, d time.Duration, now time.Time) bool {
+	t := expiresAt(modTime, d)
+	return t.IsZero() || now.Before(t)
+}
+
+// ExpiresAt returns the time at which the cached copy of the file
+// with the given path expires, without invoking the loader.
+// If there is no cached copy, ExpiresAt returns ok == false.
+// If the copy never expires, ExpiresAt returns the zero time and ok == true.
+func (c *Cache) ExpiresAt(path string) (t time.Time, ok bool, err error) {
+	_, prefix := c.locate(path)
+	meta, fi, err := peekMeta(prefix)
+	if err == nil {
+		_, err = os.Stat(prefix + ".data")
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	return expiresAt(fi.ModTime(), c.entryExpiration(meta, c.expiration())), true, nil
+}
+
+// SetKeyFunc sets a function that rewrites each cleaned path,
+// beginning with a slash, into the key identifying its cache entry.
+// Paths with the same key share a single entry, so a key function
+// can map aliases of a file, such as paths with and without
+// a locale prefix, to one cached copy. The loader is invoked with the key,
+// and the entry's metadata records the key as its path.
+// If f is nil (the default), each cleaned path is its own key.
+func (c *Cache) SetKeyFunc(f func(path string) string) {
+	c.mu.Lock()
+	c.keyFunc = f
+	c.mu.Unlock()
+}
+
+func (c *Cache) getKeyFunc() func(string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keyFunc
+}
+
+// CleanPath returns the canonical form of path used by the cache:
+// the shortest path equivalent to "/"+path, as computed by path.Clean.
+// The result begins with a slash and has no trailing slash,
+// except for the root "/", and no "." or ".." elements.
+// All paths with the same canonical form name the same cached file,
+// and it is the form passed to loaders and to the functions set by
+// SetKeyFunc and SetPrefetch.
+func CleanPath(path string) string {
+	return pathpkg.Clean("/" + path)
+}
+
+// locate returns the cleaned key for path and the file name prefix
+// of its cache entry.
 func (c *Cache) locate(path string) (cleaned, prefix string) {
-	cleaned = pathpkg.Clean("/" + path)
+	cleaned = CleanPath(path)
+	if key := c.getKeyFunc(); key != nil {
+		cleaned = CleanPath(key(cleaned))
+	}
 	sum := sha1.Sum([]byte(cleaned))
 	h := fmt.Sprintf("%x", sum[:])
 	parent := filepath.Join(c.dir, h[0:3])
-	os.Mkdir(parent, 0777)
+	if !c.readOnly {
+		os.Mkdir(parent, 0777)
+	}
 	return cleaned, filepath.Join(c.dir, h[0:3], h[3:])
 }
 
-func (c *Cache) metaLock(prefix string) (*os.File, error) {
+func (c *Cache) metaLock(prefix string) (*lockedFile, error) {
+	if d := c.lockTimeout(); d > 0 {
+		return lockMetaTimeout(prefix, d)
+	}
+	return lockMeta(prefix, syscall.LOCK_EX)
+}
+
+// ErrLockTimeout is the error returned when the cache gives up waiting
+// for another client to release an entry's lock (see SetLockTimeout).
+var ErrLockTimeout = errors.New("diskcache: timed out waiting for entry lock")
+
+// SetLockTimeout sets the maximum time to wait for another client
+// to release the lock on a cache entry, such as while that client
+// downloads the file. After waiting that long, the operation fails
+// with an error satisfying errors.Is(err, ErrLockTimeout),
+// so that a wedged client cannot block others forever.
+// If d is zero (the default), the cache waits indefinitely.
+func (c *Cache) SetLockTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.atomicLockTimeout, int64(d))
+}
+
+func (c *Cache) lockTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.atomicLockTimeout))
+}
+
+// lockMetaTimeout is like lockMeta with LOCK_EX but gives up after d,
+// polling the lock at jittered, growing intervals.
+func lockMetaTimeout(prefix string, d time.Duration) (*lockedFile, error) {
 	name := prefix + ".meta"
 	f, err := os.OpenFile(name, os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+	deadline := time.Now().Add(d)
+	wait := 1 * time.Millisecond
+	for {
+		lf, err := lockFile(f, prefix, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			ok, err := lockedCurrent(lf, name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return lf, nil
+			}
+			if f, err = os.OpenFile(name, os.O_RDWR, 0666); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		left := time.Until(deadline)
+		if err != syscall.EWOULDBLOCK || left <= 0 {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				err = fmt.Errorf("%w: %s", ErrLockTimeout, name)
+			}
+			return nil, err
+		}
+		// Sleep between wait/2 and wait, so that waiting clients
+		// do not retry in lockstep.
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if sleep > left {
+			sleep = left
+		}
+		time.Sleep(sleep)
+		if wait < 100*time.Millisecond {
+			wait *= 2
+		}
+	}
+}
+
+// tryMetaLock is like metaLock but fails instead of waiting
+// when another client holds the lock.
+func (c *Cache) tryMetaLock(prefix string) (*lockedFile, error) {
+	return lockMeta(prefix, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func lockMeta(prefix string, how int) (*lockedFile, error) {
+	name := prefix + ".meta"
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		lf, err := lockFile(f, prefix, how)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		ok, err := lockedCurrent(lf, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return lf, nil
+		}
+	}
+}
+
+// lockedCurrent reports whether the locked file f is still the file
+// named name. While a client waits for the lock, the client holding it
+// may delete the entry (see Delete and eviction) and another client may
+// create a fresh .meta file in its place; a lock on the unlinked file
+// protects nothing, so the caller must open and lock name again.
+// If lockedCurrent returns false or an error, it has closed f.
+func lockedCurrent(f *lockedFile, name string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
 		f.Close()
+		return false, err
+	}
+	cur, err := os.Stat(name)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	if !os.SameFile(fi, cur) {
+		f.Close()
+		return false, nil
+	}
+	return true, nil
+}
+
+// metaLockCreate is like metaLock but creates the .meta file if necessary.
+func (c *Cache) metaLockCreate(prefix string) (*lockedFile, error) {
+	metaFile, err := c.metaLock(prefix)
+	if errors.Is(err, ErrLockTimeout) {
 		return nil, err
 	}
-	return f, nil
+	if err != nil {
+		f, errCreate := os.OpenFile(prefix+".meta", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsNotExist(errCreate) {
+			// The subdirectory was removed as empty (see Compact)
+			// after locate created it. Create it again.
+			os.Mkdir(filepath.Dir(prefix), 0777)
+			f, errCreate = os.OpenFile(prefix+".meta", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		}
+		if errCreate == nil {
+			f.Close()
+		}
+		metaFile, err = c.metaLock(prefix)
+		if err != nil {
+			if errCreate != nil && !errors.Is(err, ErrLockTimeout) {
+				return nil, fmt.Errorf("creating metadata file: %v", errCreate)
+			}
+			return nil, err
+		}
+	}
+	return metaFile, nil
+}
+
+// createNext creates the .next file for prefix, whose .meta file
+// the caller has locked as metaFile.
+// Holding the lock means no other client is writing a .next file,
+// so an existing one is stale, left by a client that crashed or was
+// interrupted, or by a partial copy from OpenRange being discarded.
+// createNext removes it and tries again, but only while metaFile
+// is still the .meta file: if another client deleted the entry after
+// metaFile was opened, a new .meta file may be locked by a client
+// writing a new .next file.
+func (c *Cache) createNext(prefix string, metaFile *lockedFile) (*os.File, error) {
+	var err error
+	for i := 0; i < c.nextRetries(); i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<uint(i-1)) * time.Millisecond)
+		}
+		var next *os.File
+		next, err = os.OpenFile(prefix+".next", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return next, nil
+		}
+		if !os.IsExist(err) {
+			break
+		}
+		fi1, err1 := metaFile.Stat()
+		fi2, err2 := os.Stat(prefix + ".meta")
+		if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+			return nil, fmt.Errorf("creating cached file: lost lock on %s.meta", prefix)
+		}
+		os.Remove(prefix + ".next")
+	}
+	return nil, fmt.Errorf("creating cached file: %v", err)
+}
+
+// rename is os.Rename, replaced in tests.
+var rename = os.Rename
+
+// installNext renames the .next file for prefix, whose lock the caller
+// holds, over the .data file. If the two are on different file systems,
+// so that the rename fails with EXDEV, installNext instead copies the
+// .next file to a temporary file beside the .data file, syncs it,
+// and renames that over the .data file, so that readers still see
+// either the old copy or the new one, never a mix.
+func installNext(prefix string) error {
+	err := rename(prefix+".next", prefix+".data")
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	src, err := os.Open(prefix + ".next")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := prefix + ".data.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, prefix+".data")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(prefix + ".next")
+	return nil
+}
+
+// readMeta reads the metadata from the locked .meta file f.
+func readMeta(f io.Reader) (*metaDisk, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata file: %v", err)
+	}
+	meta, err := decodeMeta(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata file: %v", err)
+	}
+	return meta, nil
+}
+
+// writeMeta writes meta to the .meta file for prefix,
+// whose lock the caller must hold.
+// It uses the encoding selected by SetMetaCodec.
+func (c *Cache) writeMeta(prefix string, meta *metaDisk) error {
+	data, err := c.getMetaCodec().encode(meta)
+	if err != nil {
+		return fmt.Errorf("preparing meta file: %v", err)
+	}
+	// Use WriteFile instead of writing to the locked file in order to force
+	// truncation of the meta file when the new encoding is shorter than the old.
+	// WriteFile rewrites the file in place, so the lock remains valid.
+	return ioutil.WriteFile(prefix+".meta", data, 0666)
+}
+
+// updateMeta calls f to modify the metadata for path, creating the
+// .meta file if necessary. Because the modification time of the .meta file
+// records the last refresh, updateMeta preserves it.
+func (c *Cache) updateMeta(path string, f func(*metaDisk)) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	path, prefix := c.locate(path)
+	metaFile, err := c.metaLockCreate(prefix)
+	if err != nil {
+		return err
+	}
+	defer metaFile.Close()
+	fi, err := metaFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat'ing metadata file: %v", err)
+	}
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return err
+	}
+	mtime := fi.ModTime()
+	if fi.Size() == 0 {
+		// Newly created: there is no copy to refresh.
+		mtime = time.Unix(0, 0)
+	}
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+	}
+	meta.Path = path
+	f(meta)
+	if err := c.writeMeta(prefix, meta); err != nil {
+		return err
+	}
+	return os.Chtimes(prefix+".meta", mtime, mtime)
+}
+
+// touch records a use of the cached copy for prefix,
+// unless SetTrackUsage has disabled usage tracking.
+func (c *Cache) touch(prefix string) {
+	if atomic.LoadInt32(&c.atomicNoTrackUsage) != 0 || c.deferTouch(prefix) {
+		return
+	}
+	ioutil.WriteFile(prefix+".used", []byte("\n"), 0666)
+}
+
+// SetTrackUsage sets whether the cache records each use of a cached copy
+// in its .used file. Tracking is enabled by default.
+// Disabling it saves a file write on every Open, at the cost of
+// least recently used eviction: when usage is not tracked,
+// eviction removes the least recently refreshed copies first instead.
+func (c *Cache) SetTrackUsage(track bool) {
+	var v int32
+	if !track {
+		v = 1
+	}
+	atomic.StoreInt32(&c.atomicNoTrackUsage, v)
 }
 
 // Open opens the file with the given path.
@@ -202,31 +880,111 @@ func (c *Cache) metaLock(prefix string) (*os.File, error) {
 // The elements in a file path are separated by slash ('/', U+002F)
 // characters, regardless of host operating system convention.
 func (c *Cache) Open(path string) (*os.File, error) {
+	f := c.openGrace(path)
+	var err error
+	if f == nil {
+		f, err = c.open(path, false, nil)
+	}
+	if err == nil {
+		if related := c.getRelated(); related != nil {
+			if list := related(CleanPath(path)); len(list) > 0 {
+				c.Prefetch(list...)
+			}
+		}
+	}
+	return f, err
+}
+
+// OpenLoader is like Open but loads the file, if needed, using l instead
+// of the cache's loader. It lets a client cache files that only it knows
+// how to fetch, such as the variants of an HTTP response selected by
+// request headers. The cache otherwise treats the file like any other,
+// but it must always be opened with OpenLoader, because the cache's own
+// loader cannot fetch it.
+func (c *Cache) OpenLoader(path string, l Loader) (*os.File, error) {
+	return c.open(path, false, l)
+}
+
+// OpenContext is like Open but gives up waiting when ctx is done,
+// returning ctx.Err(). The deadline covers all the work of Open,
+// including the file system operations on its fast path,
+// which matters only when the cache directory is not on local disk:
+// a hung network file system cannot block the caller past the deadline.
+// Work abandoned by OpenContext continues in the background, so a download
+// in progress still completes and installs its copy in the cache.
+func (c *Cache) OpenContext(ctx context.Context, path string) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	done, abandon := c.openAsync(path)
+	select {
+	case r := <-done:
+		return r.f, r.err
+	case <-ctx.Done():
+		abandon()
+		return nil, ctx.Err()
+	}
+}
+
+// An openResult is the result of an Open run by openAsync.
+type openResult struct {
+	f   *os.File
+	err error
+}
+
+// openAsync runs Open(path) in a new goroutine,
+// returning a channel on which to receive its result.
+// If the caller instead calls abandon, the result is discarded,
+// and the file, if any, is closed.
+func (c *Cache) openAsync(path string) (done <-chan openResult, abandon func()) {
+	ch := make(chan openResult)
+	stop := make(chan bool)
+	go func() {
+		f, err := c.Open(path)
+		select {
+		case ch <- openResult{f, err}:
+		case <-stop:
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	return ch, func() { close(stop) }
+}
+
+// open implements Open. If force is true, open loads the file
+// unconditionally, as described in ForceReload.
+// If l is non-nil, open loads the file using l instead of the cache's loader.
+func (c *Cache) open(path string, force bool, l Loader) (_ *os.File, err error) {
 	path, prefix := c.locate(path)
+	if c.readOnly {
+		if force {
+			return nil, ErrReadOnly
+		}
+		return openReadOnly(path, prefix)
+	}
 
-	// Fast path: if not expired and data file exists, done.
-	fi, err := os.Stat(prefix + ".meta")
+	// Read the expiration once, so that a concurrent SetExpiration
+	// cannot make the fast path and the double-check below disagree.
 	d := c.expiration()
-	if err == nil && (d == 0 || time.Now().Before(fi.ModTime().Add(d))) {
+
+	// Fast path: if not expired and data file exists, done.
+	// The copy's metadata may give it its own expiration period.
+	meta, fi, err := peekMeta(prefix)
+	if err == nil && !force && fresh(fi.ModTime(), c.entryExpiration(meta, d), time.Now()) {
 		if data, err := os.Open(prefix + ".data"); err == nil {
+			c.touch(prefix)
+			c.recordHit()
 			return data, nil
 		}
 	}
+	c.startOpen(prefix)
+	defer func() { c.endOpen(prefix, err) }()
 
 	// Otherwise lock .meta file, creating it if necessary.
-	metaFile, err := c.metaLock(prefix)
+	metaFile, err := c.metaLockCreate(prefix)
 	if err != nil {
-		f, errCreate := os.OpenFile(prefix+".meta", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-		if errCreate == nil {
-			f.Close()
-		}
-		metaFile, err = c.metaLock(prefix)
-		if err != nil {
-			if errCreate != nil {
-				return nil, fmt.Errorf("creating metadata file: %v", errCreate)
-			}
-			return nil, err
-		}
+		return nil, err
 	}
 	defer metaFile.Close()
 
@@ -237,49 +995,141 @@ func (c *Cache) Open(path string) (*os.File, error) {
 		metaFile.Close()
 		return nil, fmt.Errorf("stat'ing metadata file: %v", err)
 	}
+	// Read metadata.
+	// TODO(rsc): Delete on error?
+	meta, err = readMeta(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	d = c.entryExpiration(meta, d)
+
 	data, errData := os.Open(prefix + ".data")
-	if (d == 0 || time.Now().Before(fi.ModTime().Add(d))) && errData == nil {
+	if !force && (meta.Override || fresh(fi.ModTime(), d, time.Now())) && errData == nil {
+		c.touch(prefix)
+		c.recordHit()
 		return data, nil
 	}
-	if errData == nil {
-		data.Close()
-	}
-	defer metaFile.Close()
-
-	// Read metadata.
-	js, err := ioutil.ReadAll(metaFile)
-	if err != nil {
-		// TODO(rsc): Delete?
-		return nil, fmt.Errorf("reading metadata file: %v", err)
+	if errData != nil && !force {
+		if err := c.negativeHit(path, meta); err != nil {
+			return nil, err
+		}
+		// Finish a partial copy rather than starting over.
+		data, err := c.resumeNext(l, path, prefix, meta)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			c.touch(prefix)
+			metaFile.Close()
+			c.checkDataLimit()
+			return data, nil
+		}
 	}
-	var meta metaDisk
-	if len(js) > 0 {
-		if err := json.Unmarshal(js, &meta); err != nil {
-			// TODO(rsc): Delete?
-			return nil, fmt.Errorf("reading metadata file: %v", err)
+	oldSize := int64(-1)
+	if errData == nil {
+		if fi, err := data.Stat(); err == nil {
+			oldSize = fi.Size()
 		}
+		data.Close()
 	}
 
+	loadMeta := meta.Load // to restore if the load fails
 	if errData != nil {
 		os.Remove(prefix + ".data")
 		meta.Load = nil
+	} else if force {
+		// Withhold the validators, so that the loader cannot
+		// declare the copy valid.
+		meta.Load = nil
+	} else if meta.Load == nil {
+		// There is a copy, but the loader recorded no metadata for it.
+		meta.Load = []byte{}
 	}
 
-	next, err := os.OpenFile(prefix+".next", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		// Shouldn't happen, but maybe there is a stale .next file. Remove and try again.
-		os.Remove(prefix + ".next")
-		next, err = os.OpenFile(prefix+".next", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	// A full download replaces any partial copy in .next,
+	// unless the loader can resume it.
+	if l == nil {
+		l = c.getLoader()
+	}
+	rl, resumable := l.(ResumeLoader)
+	var next *os.File
+	var off int64
+	partial := meta.NextLoad
+	if resumable {
+		next, off = resumableNext(prefix, meta)
+	}
+	meta.NextRanges = nil
+	meta.NextSize = 0
+	meta.NextLoad = nil
+	if next == nil {
+		next, err = c.createNext(prefix, metaFile)
 		if err != nil {
-			return nil, fmt.Errorf("creating cached file: %v", err)
+			return nil, err
 		}
+		partial = nil
 	}
 
-	cacheValid, metaLoad, err := c.loader.Load(path, next, meta.Load)
+	var cacheValid bool
+	var metaLoad, sum, started []byte
+	if resumable {
+		// Record the version being loaded, so that the download
+		// can be resumed if it is interrupted, even by a crash.
+		begin := func(m []byte) error {
+			started = m
+			saved := *meta
+			if errData == nil {
+				saved.Load = loadMeta
+			}
+			saved.NextLoad = m
+			saved.Path = path
+			if err := c.writeMeta(prefix, &saved); err != nil {
+				return err
+			}
+			return os.Chtimes(prefix+".meta", fi.ModTime(), fi.ModTime())
+		}
+		cacheValid, metaLoad, sum, err = c.loadResume(rl, path, next, meta.Load, off, partial, begin)
+	} else {
+		cacheValid, metaLoad, sum, err = c.load(l, path, next, meta.Load)
+	}
 	if err != nil {
 		next.Close()
+		if started != nil {
+			// Keep the partial copy for a later load to resume.
+			meta.NextLoad = started
+		} else {
+			os.Remove(prefix + ".next")
+		}
+		if errData == nil {
+			meta.Load = loadMeta
+		}
+		c.recordError(prefix, path, meta, fi.ModTime(), err)
+		if force {
+			return nil, err
+		}
+		if errData == nil && c.strictFreshness() {
+			if transient(err) {
+				return nil, fmt.Errorf("diskcache: %s: %w: %w", path, ErrStale, err)
+			}
+			return nil, err
+		}
+		if errData == nil && c.canServeStale(meta, d, time.Now()) {
+			if data, err := os.Open(prefix + ".data"); err == nil {
+				c.touch(prefix)
+				return data, nil
+			}
+		}
 		return nil, err
 	}
+	if insp := c.getInspector(); insp != nil && !cacheValid {
+		if next, sum, err = c.inspectNext(insp, path, prefix, next); err != nil {
+			os.Remove(prefix + ".next")
+			if errData == nil {
+				meta.Load = loadMeta
+			}
+			c.recordError(prefix, path, meta, fi.ModTime(), err)
+			return nil, err
+		}
+	}
 
 	meta.RefreshTime = time.Now()
 	var nextSize int64
@@ -288,30 +1138,50 @@ func (c *Cache) Open(path string) (*os.File, error) {
 		os.Remove(prefix + ".next")
 	} else {
 		meta.CreateTime = meta.RefreshTime
+		meta.Override = false
+		meta.Sum = sum
 		fi, err := next.Stat()
 		if err != nil {
 			return nil, fmt.Errorf("writing cached file: %v", err)
 		}
 		nextSize = fi.Size()
+		if keep, err := c.admitNext(path, prefix, nextSize, oldSize); !keep {
+			if err != nil {
+				next.Close()
+				return nil, err
+			}
+			// Serve the copy without keeping it.
+			if _, err := next.Seek(0, io.SeekStart); err != nil {
+				next.Close()
+				return nil, err
+			}
+			return next, nil
+		}
 		if err := next.Close(); err != nil {
 			return nil, fmt.Errorf("writing cached file: %v", err)
 		}
-		if err := os.Rename(prefix+".next", prefix+".data"); err != nil {
+		if err := installNext(prefix); err != nil {
 			// Shouldn't happen, but we did get the file. Use it.
 			return nil, fmt.Errorf("installing cached file: %v", err)
 		}
+		c.notifyInstalled()
+		if oldSize >= 0 {
+			c.addUsage(nextSize-oldSize, 0)
+		} else {
+			c.addUsage(nextSize, 1)
+		}
 	}
 
+	c.adapt(meta, errData == nil, !cacheValid)
 	meta.Load = metaLoad
-	meta.Path = path
-	js, err = json.Marshal(&meta)
-	if err != nil {
-		return nil, fmt.Errorf("preparing meta file: %v", err)
+	meta.LastError = ""
+	meta.LastErrorTime = time.Time{}
+	meta.LastStatus = 0
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
 	}
-
-	// Use WriteFile instead of metaFile.Write in order to force
-	// truncation of the meta file when the new JSON is less than the old JSON.
-	if err := ioutil.WriteFile(prefix+".meta", []byte(js), 0666); err != nil {
+	meta.Path = path
+	if err := c.writeMeta(prefix, meta); err != nil {
 		// Unclear what state we are in now.
 		// The write succeeded but close failed.
 		// Cache is supposed to be on local disk,
@@ -325,15 +1195,192 @@ func (c *Cache) Open(path string) (*os.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.touch(prefix)
 	metaFile.Close()
 
-	if nextSize > 0 {
-		c.checkDataLimit(nextSize)
+	if !cacheValid {
+		c.checkDataLimit()
 	}
 
 	return data, nil
 }
 
+// ForceReload loads the file with the given path from the loader
+// unconditionally, replacing the cached copy with whatever the loader returns.
+// It withholds the copy's validators, so the loader fetches the file
+// as if there were no cached copy, even if it would otherwise report
+// the copy valid. ForceReload is the escape hatch for an origin whose
+// validators are wrong, so that revalidation keeps a stale copy.
+// It also replaces a copy installed by Override.
+// If the load fails, the existing copy, if any, is kept.
+func (c *Cache) ForceReload(path string) error {
+	f, err := c.open(path, true, nil)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openReadOnly opens the cached copy of path for a read-only cache.
+func openReadOnly(path, prefix string) (*os.File, error) {
+	data, err := os.Open(prefix + ".data")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &os.PathError{Path: path, Op: "open", Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// canServeStale reports whether Open may serve the expired copy described
+// by meta after a failed revalidation, given the expiration period d.
+func (c *Cache) canServeStale(meta *metaDisk, d time.Duration, now time.Time) bool {
+	grace := c.staleIfError()
+	if grace <= 0 || ParseLoadMeta(meta.Load).MustRevalidate {
+		return false
+	}
+	return now.Before(meta.RefreshTime.Add(d + grace))
+}
+
+// peekMeta reads the metadata for prefix without taking the lock,
+// returning the metadata and the .meta file information.
+func peekMeta(prefix string) (*metaDisk, os.FileInfo, error) {
+	metaFile, err := os.Open(prefix + ".meta")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer metaFile.Close()
+	fi, err := metaFile.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Without the lock, we may observe a metadata file
+	// in the middle of being rewritten. Try again if so.
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		metaFile.Seek(0, 0)
+		if meta, err = readMeta(metaFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return meta, fi, nil
+}
+
+// SetAnnotation sets the annotation key to value for the cache entry
+// for the file with the given path. Annotations are small strings
+// stored alongside the cached copy for use by callers; the cache itself
+// ignores them. They persist when the copy is revalidated or reloaded
+// and are removed only when the entry is deleted.
+// Setting an annotation to the empty string removes it.
+func (c *Cache) SetAnnotation(path, key, value string) error {
+	return c.updateMeta(path, func(meta *metaDisk) {
+		if value == "" {
+			delete(meta.Annotations, key)
+			return
+		}
+		if meta.Annotations == nil {
+			meta.Annotations = make(map[string]string)
+		}
+		meta.Annotations[key] = value
+	})
+}
+
+// Annotation returns the annotation key for the cache entry
+// for the file with the given path, as set by SetAnnotation.
+func (c *Cache) Annotation(path, key string) (value string, ok bool) {
+	_, prefix := c.locate(path)
+	meta, _, err := peekMeta(prefix)
+	if err != nil {
+		return "", false
+	}
+	value, ok = meta.Annotations[key]
+	return value, ok
+}
+
+// A CacheEntry describes the cached copy of a file.
+type CacheEntry struct {
+	Path        string    // file path
+	Size        int64     // size of cached copy
+	CreateTime  time.Time // time copy was downloaded
+	RefreshTime time.Time // time copy was last downloaded or revalidated
+	LastUsed    time.Time // time copy was last opened
+	Expires     time.Time // time copy expires; zero if never
+	Pinned      bool      // copy is pinned (see Pin)
+	Overridden  bool      // copy was installed by Override
+	Meta        []byte    // loader metadata; see LoadMeta
+	SHA256      []byte    // SHA-256 checksum of copy, if known; see Verify
+	Partial     bool      // copy is partial; see OpenRange
+}
+
+// Stat returns a description of the cached copy of the file with the given path,
+// without invoking the loader. If there is no cached copy, Stat returns
+// an error satisfying os.IsNotExist.
+func (c *Cache) Stat(path string) (*CacheEntry, error) {
+	path, prefix := c.locate(path)
+	return c.stat(path, prefix)
+}
+
+// stat implements Stat for the entry with the given path and prefix.
+func (c *Cache) stat(path, prefix string) (*CacheEntry, error) {
+	fi, err := os.Stat(prefix + ".data")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &os.PathError{Path: path, Op: "stat", Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	meta, mfi, err := peekMeta(prefix)
+	if err != nil {
+		return nil, err
+	}
+	e := &CacheEntry{
+		Path:        path,
+		Size:        fi.Size(),
+		CreateTime:  meta.CreateTime,
+		RefreshTime: meta.RefreshTime,
+		LastUsed:    fi.ModTime(),
+		Expires:     expiresAt(mfi.ModTime(), c.entryExpiration(meta, c.expiration())),
+		Pinned:      meta.Pinned,
+		Overridden:  meta.Override,
+		Meta:        meta.Load,
+		SHA256:      meta.Sum,
+	}
+	if meta.Override {
+		e.Expires = time.Time{}
+	}
+	if ufi, err := os.Stat(prefix + ".used"); err == nil {
+		e.LastUsed = ufi.ModTime()
+	}
+	if t, ok := c.pendingUse(prefix); ok {
+		e.LastUsed = t
+	}
+	return e, nil
+}
+
+// Entries returns descriptions of all the cached copies in the cache
+// directory, sorted by path, without invoking the loader.
+// Unlike DiskUsage, it does not include partial copies or downloads in progress.
+// Entries scans the entire cache directory, so it is expensive for large caches.
+func (c *Cache) Entries() ([]*CacheEntry, error) {
+	var list []*CacheEntry
+	err := c.walk(func(prefix string) error {
+		meta, _, err := peekMeta(prefix)
+		if err != nil || meta.Path == "" {
+			return nil
+		}
+		if e, err := c.stat(meta.Path, prefix); err == nil {
+			list = append(list, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
+}
+
 func (c *Cache) ReadFile(path string) ([]byte, error) {
 	f, err := c.Open(path)
 	if err != nil {
@@ -343,11 +1390,11 @@ func (c *Cache) ReadFile(path string) ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
-func (c *Cache) checkDataLimit(newSize int64) {
-}
-
 // Delete deletes the cache entry for the file with the given path.
 func (c *Cache) Delete(path string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
 	path, prefix := c.locate(path)
 	metaFile, err := c.metaLock(prefix)
 	if err != nil {
@@ -356,25 +1403,141 @@ func (c *Cache) Delete(path string) error {
 		}
 		return err
 	}
-	os.Remove(prefix + ".data")
+	err = c.removeEntry(prefix)
+	metaFile.Close()
+	if err != nil {
+		return err
+	}
+	c.pruneDir(prefix)
+	return nil
+}
+
+// removeEntry removes the files for the entry with the given prefix,
+// whose lock the caller holds.
+func (c *Cache) removeEntry(prefix string) error {
+	if fi, err := os.Stat(prefix + ".data"); err == nil {
+		c.addUsage(-fi.Size(), -1)
+	}
+	c.mu.Lock()
+	c.mem.remove(prefix)
+	c.mu.Unlock()
+	removeData(prefix)
 	os.Remove(prefix + ".next")
+	os.Remove(prefix + ".scan")
 	os.Remove(prefix + ".used")
-	err = os.Remove(prefix + ".meta")
-	metaFile.Close()
+	err := os.Remove(prefix + ".meta")
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
-// DeleteAll deletes all the cache entries.
+// renameBeforeRemove reports whether removeData must move a data file
+// out of the way before removing it. On Windows, removing a file that
+// another handle has open can fail, but renaming it first succeeds and
+// leaves the open handle reading the old content.
+var renameBeforeRemove = runtime.GOOS == "windows"
+
+// removeData removes the data file for prefix, leaving any readers
+// that already have it open able to finish reading it.
+// The caller must hold the entry lock.
+func removeData(prefix string) {
+	name := prefix + ".data"
+	if renameBeforeRemove {
+		dead := prefix + ".dead"
+		if os.Rename(name, dead) == nil {
+			name = dead
+		}
+	}
+	os.Remove(name)
+}
+
+// entryExts lists the file name extensions of the files making up
+// a cache entry, longest first, so that trimming the first match
+// from a file name yields the entry's prefix.
+var entryExts = []string{".data.tmp", ".data", ".meta", ".used", ".next", ".scan", ".lock", ".dead"}
+
+// DeleteAll deletes all the cache entries, along with the subdirectories
+// holding them. It locks each entry before removing its files, as Delete
+// does, but it skips entries that another client holds locked, such as
+// while downloading, rather than waiting for them. Files left behind by
+// a crashed client, such as a .next file with no .meta file, are removed.
+// DeleteAll keeps going after an error, returning the first one.
 func (c *Cache) DeleteAll() error {
-	panic("not implemented")
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	root, err := os.Open(c.dir)
+	if err != nil {
+		return err
+	}
+	dirs, err := root.Readdirnames(-1)
+	root.Close()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, dir := range dirs {
+		if !isHexDir(dir) {
+			continue
+		}
+		dir = filepath.Join(c.dir, dir)
+		d, err := os.Open(dir)
+		if err != nil {
+			continue // removed or not a directory
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			keep(err)
+			continue
+		}
+		prefixes := make(map[string]bool)
+		for _, name := range names {
+			for _, ext := range entryExts {
+				if strings.HasSuffix(name, ext) {
+					prefixes[filepath.Join(dir, strings.TrimSuffix(name, ext))] = true
+					break
+				}
+			}
+		}
+		for prefix := range prefixes {
+			metaFile, err := c.tryMetaLock(prefix)
+			switch {
+			case err == nil:
+				err = c.removeEntry(prefix)
+				metaFile.Close()
+				if err != nil {
+					keep(err)
+				}
+			case os.IsNotExist(err):
+				// No .meta file, so no client can be using the rest.
+				for _, ext := range entryExts {
+					os.Remove(prefix + ext)
+				}
+			case err == syscall.EWOULDBLOCK:
+				// In use by another client; leave it.
+			default:
+				keep(err)
+			}
+		}
+		// Fails harmlessly if entries were skipped or added meanwhile.
+		os.Remove(dir)
+	}
+	return firstErr
 }
 
 // Expire marks the cache entry for the file with the given path as expired.
 // The cache will have to revalidate the local copy, if any, before using it again.
 func (c *Cache) Expire(path string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
 	path, prefix := c.locate(path)
 	t := time.Unix(0, 0)
 	err := os.Chtimes(prefix+".meta", t, t)
@@ -384,7 +1547,31 @@ func (c *Cache) Expire(path string) error {
 	return nil
 }
 
-// ExpireAll marks all cache entries as expired.
+// ExpireAll marks all cache entries as expired, as Expire does for one.
+// It only changes the modification times of the .meta files, without
+// reading or locking them, so it is cheap even for a large cache, and
+// it is safe to call while the cache is in use. A download in progress
+// is unaffected, since installing its copy sets the modification time
+// of the .meta file again.
+// ExpireAll keeps going after an error, returning the first one.
 func (c *Cache) ExpireAll() error {
-	panic("not implemented")
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	t := time.Unix(0, 0)
+	var firstErr error
+	err := c.walk(func(prefix string) error {
+		err := os.Chtimes(prefix+".meta", t, t)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		return nil
+	})
+	c.mu.Lock()
+	c.mem.clear()
+	c.mu.Unlock()
+	if firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
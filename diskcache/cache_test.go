@@ -5,11 +5,25 @@
 package diskcache
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -39,12 +53,6 @@ func readFile(t *testing.T, c *Cache, name string) []byte {
 	return data
 }
 
-type loaderFunc func(string, *os.File, []byte) (bool, []byte, error)
-
-func (f loaderFunc) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
-	return f(path, target, meta)
-}
-
 func loadHello(path string, target *os.File, meta []byte) (bool, []byte, error) {
 	n, _ := strconv.Atoi(string(meta))
 	n++
@@ -54,7 +62,7 @@ func loadHello(path string, target *os.File, meta []byte) (bool, []byte, error)
 }
 
 func TestBasic(t *testing.T) {
-	c, cleanup := newCache(t, loaderFunc(loadHello))
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
 	defer cleanup()
 
 	const first = "hello, /file #1\n"
@@ -79,3 +87,2747 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("recached read file = %q, want %q", data5, third)
 	}
 }
+
+func TestExpire(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	const first = "hello, /file #1\n"
+	if data := readFile(t, c, "file"); string(data) != first {
+		t.Fatalf("original read file = %q, want %q", data, first)
+	}
+	if err := c.Expire("file"); err != nil {
+		t.Fatal(err)
+	}
+	const second = "hello, /file #2\n"
+	if data := readFile(t, c, "file"); string(data) != second {
+		t.Fatalf("expired read file = %q, want %q", data, second)
+	}
+	if data := readFile(t, c, "file"); string(data) != second {
+		t.Fatalf("recached read file = %q, want %q", data, second)
+	}
+}
+
+func TestExpirationRace(t *testing.T) {
+	var loads int32
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		atomic.AddInt32(&loads, 1)
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				c.SetExpiration(0)
+			} else {
+				c.SetExpiration(1 * time.Nanosecond)
+			}
+		}
+	}()
+
+	// open opens the file and returns its load number,
+	// checking that the content is exactly what that load wrote.
+	open := func() (int, bool) {
+		f, err := c.Open("file")
+		if err != nil {
+			t.Error(err)
+			return 0, false
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Error(err)
+			return 0, false
+		}
+		var n int
+		if _, err := fmt.Sscanf(string(data), "hello, /file #%d\n", &n); err != nil || string(data) != fmt.Sprintf("hello, /file #%d\n", n) {
+			t.Errorf("read file = %q, want hello, /file #N", data)
+			return 0, false
+		}
+		if max := int(atomic.LoadInt32(&loads)); n < 1 || n > max {
+			t.Errorf("read #%d after %d loads", n, max)
+			return 0, false
+		}
+		return n, true
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for i := 0; i < 100; i++ {
+				n, ok := open()
+				if !ok {
+					return
+				}
+				if n < last {
+					t.Errorf("read #%d after #%d", n, last)
+					return
+				}
+				last = n
+				mu.Lock()
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	if t.Failed() {
+		return
+	}
+
+	// Every load was made by an Open, which returned its result,
+	// so each load number was read exactly as written.
+	total := int(atomic.LoadInt32(&loads))
+	for n := 1; n <= total; n++ {
+		if !seen[n] {
+			t.Fatalf("after %d loads, never read #%d", total, n)
+		}
+	}
+
+	// With the expiration settled, Open loads exactly when it must.
+	c.SetExpiration(0)
+	for i := 0; i < 3; i++ {
+		if n, ok := open(); !ok || n != total || int(atomic.LoadInt32(&loads)) != total {
+			t.Fatalf("Open without expiration: read #%d after %d loads, want #%d after %d", n, atomic.LoadInt32(&loads), total, total)
+		}
+	}
+	c.SetExpiration(1 * time.Nanosecond)
+	time.Sleep(1 * time.Millisecond)
+	if n, ok := open(); !ok || n != total+1 || int(atomic.LoadInt32(&loads)) != total+1 {
+		t.Fatalf("Open after expiration: read #%d after %d loads, want #%d after %d", n, atomic.LoadInt32(&loads), total+1, total+1)
+	}
+}
+
+func TestLoadMetaMigration(t *testing.T) {
+	// The loader starts out storing a bare ETag, as old loaders did.
+	// Once upgraded, it must understand the old form on revalidation
+	// and replace it with the structured form.
+	upgraded := false
+	var seen [][]byte
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		seen = append(seen, meta)
+		if !upgraded {
+			fmt.Fprintf(target, "hello\n")
+			return false, []byte(`"etag1"`), nil
+		}
+		m := ParseLoadMeta(meta)
+		if m.ETag == `"etag1"` {
+			return true, m.Marshal(), nil
+		}
+		fmt.Fprintf(target, "changed\n")
+		return false, (&LoadMeta{ETag: `"etag2"`}).Marshal(), nil
+	}))
+	defer cleanup()
+
+	readFile(t, c, "file")
+	upgraded = true
+	c.Expire("file")
+	if data := readFile(t, c, "file"); string(data) != "hello\n" {
+		t.Fatalf("revalidated read file = %q, want %q", data, "hello\n")
+	}
+	c.Expire("file")
+	if data := readFile(t, c, "file"); string(data) != "hello\n" {
+		t.Fatalf("revalidated read file = %q, want %q", data, "hello\n")
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("loader called %d times, want 3", len(seen))
+	}
+	if seen[0] != nil {
+		t.Errorf("first load meta = %q, want nil", seen[0])
+	}
+	if string(seen[1]) != `"etag1"` {
+		t.Errorf("second load meta = %q, want bare ETag", seen[1])
+	}
+	m := ParseLoadMeta(seen[2])
+	if m.Version != loadMetaVersion || m.ETag != `"etag1"` {
+		t.Errorf("third load meta = %q, want version %d with ETag %q", seen[2], loadMetaVersion, `"etag1"`)
+	}
+}
+
+// cached reports whether c holds a copy of the file with the given path.
+func cached(c *Cache, path string) bool {
+	_, prefix := c.locate(path)
+	_, err := os.Stat(prefix + ".data")
+	return err == nil
+}
+
+// setUsed sets the last use time of the cached copy of path.
+func setUsed(t *testing.T, c *Cache, path string, used time.Time) {
+	_, prefix := c.locate(path)
+	if err := os.Chtimes(prefix+".used", used, used); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	// Each file is 16 bytes. Allow room for three.
+	c.SetMaxData(50)
+	if err := c.Pin("a"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-1 * time.Hour)
+	for i, name := range []string{"a", "b", "c"} {
+		readFile(t, c, name)
+		setUsed(t, c, name, start.Add(time.Duration(i)*time.Minute))
+	}
+	readFile(t, c, "d")
+	readFile(t, c, "e")
+
+	for _, name := range []string{"a", "d", "e"} {
+		if !cached(c, name) {
+			t.Errorf("%s was evicted, want cached", name)
+		}
+	}
+	for _, name := range []string{"b", "c"} {
+		if cached(c, name) {
+			t.Errorf("%s is cached, want evicted", name)
+		}
+	}
+
+	// Once unpinned, a is the least recently used and goes first.
+	if err := c.Unpin("a"); err != nil {
+		t.Fatal(err)
+	}
+	setUsed(t, c, "a", start)
+	readFile(t, c, "f")
+	if cached(c, "a") {
+		t.Errorf("unpinned a is cached, want evicted")
+	}
+	if data := readFile(t, c, "d"); string(data) != "hello, /d #1\n" {
+		t.Errorf("read d = %q after pinning changes", data)
+	}
+}
+
+func TestOversizePolicy(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	load := LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if path == "/big" {
+			io.WriteString(target, big)
+			return false, nil, nil
+		}
+		return loadHello(path, target, meta)
+	})
+	for _, tt := range []struct {
+		policy OversizePolicy
+		err    error
+		kept   []string // cached after opening d and big
+	}{
+		{policy: OversizeEvictAfter, kept: nil},
+		{policy: OversizeEvictFirst, kept: []string{"b", "c", "d"}},
+		{policy: OversizeStreamThrough, kept: []string{"b", "c", "d"}},
+		{policy: OversizeReject, err: ErrTooLarge, kept: []string{"b", "c", "d"}},
+	} {
+		c, cleanup := newCache(t, load)
+		defer cleanup()
+
+		// Each small file is 16 bytes. Allow room for three.
+		c.SetMaxData(50)
+		c.SetOversizePolicy(tt.policy)
+		start := time.Now().Add(-1 * time.Hour)
+		for i, name := range []string{"a", "b", "c"} {
+			readFile(t, c, name)
+			setUsed(t, c, name, start.Add(time.Duration(i)*time.Minute))
+		}
+		readFile(t, c, "d")
+		if u, _, _ := c.DiskUsage(); u > 50 {
+			t.Errorf("policy %d: %d bytes cached after opening d, want at most 50", tt.policy, u)
+		}
+
+		f, err := c.Open("big")
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("policy %d: Open(big): %v, want %v", tt.policy, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("policy %d: Open(big): %v", tt.policy, err)
+		} else {
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if string(data) != big || err != nil {
+				t.Errorf("policy %d: read big = %d bytes, %v, want %d bytes", tt.policy, len(data), err, len(big))
+			}
+		}
+
+		var kept []string
+		for _, name := range []string{"a", "b", "c", "d", "big"} {
+			if cached(c, name) {
+				kept = append(kept, name)
+			}
+		}
+		if !reflect.DeepEqual(kept, tt.kept) {
+			t.Errorf("policy %d: cached %v, want %v", tt.policy, kept, tt.kept)
+		}
+	}
+}
+
+func TestNewNotWritable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permission checks do not apply to root")
+	}
+	dir, err := ioutil.TempDir("", "diskcache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0777)
+
+	_, err = New(dir, LoaderFunc(loadHello))
+	if !errors.Is(err, ErrNotWritable) || !strings.Contains(err.Error(), dir) {
+		t.Fatalf("New(read-only dir): %v, want ErrNotWritable naming %s", err, dir)
+	}
+	if _, err := NewReadOnly(dir); err != nil {
+		t.Fatalf("NewReadOnly(read-only dir): %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	const first = "hello, /file #1\n"
+	readFile(t, c, "file")
+	old := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	setUsed(t, c, "file", old)
+
+	ro, err := NewReadOnly(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.SetExpiration(1 * time.Nanosecond)
+	if data := readFile(t, ro, "file"); string(data) != first {
+		t.Fatalf("read-only read file = %q, want %q", data, first)
+	}
+	if _, err := ro.Open("missing"); !os.IsNotExist(err) {
+		t.Fatalf("read-only open missing: %v, want not exist", err)
+	}
+	if cached(c, "missing") {
+		t.Fatalf("read-only open created missing")
+	}
+	_, prefix := c.locate("file")
+	if fi, err := os.Stat(prefix + ".used"); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("read-only open updated .used file")
+	}
+	if err := ro.Delete("file"); err != ErrReadOnly {
+		t.Errorf("read-only Delete: %v, want ErrReadOnly", err)
+	}
+	if err := ro.Expire("file"); err != ErrReadOnly {
+		t.Errorf("read-only Expire: %v, want ErrReadOnly", err)
+	}
+	if !cached(c, "file") {
+		t.Errorf("read-only cache removed file")
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	if _, ok, err := c.ExpiresAt("file"); ok || err != nil {
+		t.Fatalf("ExpiresAt(uncached) = _, %v, %v, want false, nil", ok, err)
+	}
+
+	readFile(t, c, "file")
+	if exp, ok, err := c.ExpiresAt("file"); !exp.IsZero() || !ok || err != nil {
+		t.Fatalf("ExpiresAt with no expiration = %v, %v, %v, want zero time, true, nil", exp, ok, err)
+	}
+
+	_, prefix := c.locate("file")
+	refresh := time.Now().Add(-1 * time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(prefix+".meta", refresh, refresh); err != nil {
+		t.Fatal(err)
+	}
+	c.SetExpiration(1 * time.Hour)
+	if exp, ok, err := c.ExpiresAt("file"); !exp.Equal(refresh.Add(1*time.Hour)) || !ok || err != nil {
+		t.Fatalf("ExpiresAt with expiration = %v, %v, %v, want %v, true, nil", exp, ok, err, refresh.Add(1*time.Hour))
+	}
+
+	c.SetExpiration(0)
+	c.Expire("file")
+	if exp, ok, err := c.ExpiresAt("file"); !exp.Equal(time.Unix(0, 0)) || !ok || err != nil {
+		t.Fatalf("ExpiresAt after Expire = %v, %v, %v, want %v, true, nil", exp, ok, err, time.Unix(0, 0))
+	}
+}
+
+func TestMustRevalidate(t *testing.T) {
+	fail := false
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if fail {
+			return false, nil, fmt.Errorf("origin unavailable")
+		}
+		fmt.Fprintf(target, "hello, %s\n", path)
+		m := &LoadMeta{MustRevalidate: path == "/strict"}
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+
+	c.SetExpiration(1 * time.Hour)
+	c.SetStaleIfError(1 * time.Hour)
+	readFile(t, c, "lax")
+	readFile(t, c, "strict")
+	c.Expire("lax")
+	c.Expire("strict")
+
+	fail = true
+	if data := readFile(t, c, "lax"); string(data) != "hello, /lax\n" {
+		t.Fatalf("stale read lax = %q, want %q", data, "hello, /lax\n")
+	}
+	if f, err := c.Open("strict"); err == nil {
+		f.Close()
+		t.Fatalf("stale open strict succeeded, want error")
+	}
+
+	// With stale-if-error disabled, lax fails too.
+	c.SetStaleIfError(0)
+	if f, err := c.Open("lax"); err == nil {
+		f.Close()
+		t.Fatalf("stale open lax without stale-if-error succeeded, want error")
+	}
+}
+
+func TestStat(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	if _, err := c.Stat("file"); !os.IsNotExist(err) {
+		t.Fatalf("Stat(uncached): %v, want not exist", err)
+	}
+	start := time.Now()
+	data := readFile(t, c, "file")
+	e, err := c.Stat("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != "/file" || e.Size != int64(len(data)) || string(e.Meta) != "1" {
+		t.Errorf("Stat = %+v, want Path=/file Size=%d Meta=1", e, len(data))
+	}
+	if e.CreateTime.Before(start) || !e.RefreshTime.Equal(e.CreateTime) || !e.Expires.IsZero() {
+		t.Errorf("Stat = %+v, want CreateTime after %v, RefreshTime=CreateTime, no expiration", e, start)
+	}
+}
+
+func TestSetLoader(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	const first = "hello, /file #1\n"
+	if data := readFile(t, c, "file"); string(data) != first {
+		t.Fatalf("original read file = %q, want %q", data, first)
+	}
+	c.SetLoader(LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		fmt.Fprintf(target, "goodbye, %s\n", path)
+		return false, meta, nil
+	}))
+	if data := readFile(t, c, "file"); string(data) != first {
+		t.Fatalf("cached read file = %q, want %q", data, first)
+	}
+	c.Expire("file")
+	const second = "goodbye, /file\n"
+	if data := readFile(t, c, "file"); string(data) != second {
+		t.Fatalf("reloaded read file = %q, want %q", data, second)
+	}
+}
+
+func TestAnnotation(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	readFile(t, c, "file")
+	if err := c.SetAnnotation("file", "request-id", "r123"); err != nil {
+		t.Fatal(err)
+	}
+	if exp, _, _ := c.ExpiresAt("file"); !exp.IsZero() {
+		t.Fatalf("SetAnnotation changed expiration to %v", exp)
+	}
+
+	c.Expire("file")
+	const second = "hello, /file #2\n"
+	if data := readFile(t, c, "file"); string(data) != second {
+		t.Fatalf("reloaded read file = %q, want %q", data, second)
+	}
+	if v, ok := c.Annotation("file", "request-id"); v != "r123" || !ok {
+		t.Errorf("Annotation after reload = %q, %v, want %q, true", v, ok, "r123")
+	}
+
+	if err := c.SetAnnotation("file", "request-id", ""); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.Annotation("file", "request-id"); ok {
+		t.Errorf("Annotation after removal = %q, %v, want \"\", false", v, ok)
+	}
+	if _, ok := c.Annotation("other", "request-id"); ok {
+		t.Errorf("Annotation for uncached file found")
+	}
+}
+
+// waitCached waits for c to hold a copy of the file with the given path.
+func waitCached(t *testing.T, c *Cache, path string) {
+	for start := time.Now(); !cached(c, path); time.Sleep(1 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %s to be cached", path)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	c.SetPrefetch(func(path string) []string {
+		if strings.HasSuffix(path, ".html") {
+			return []string{strings.TrimSuffix(path, ".html") + ".css"}
+		}
+		return nil
+	})
+	readFile(t, c, "a.html")
+	waitCached(t, c, "a.css")
+	if data := readFile(t, c, "a.css"); string(data) != "hello, /a.css #1\n" {
+		t.Errorf("read prefetched a.css = %q, want %q", data, "hello, /a.css #1\n")
+	}
+}
+
+func TestBackgroundWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+	)
+	release := make(chan bool)
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	const workers, tasks = 3, 50
+	c.SetBackgroundWorkers(workers)
+	for i := 0; i < tasks; i++ {
+		c.Prefetch(fmt.Sprintf("file%d", i))
+	}
+	for start := time.Now(); ; time.Sleep(1 * time.Millisecond) {
+		mu.Lock()
+		n := running
+		mu.Unlock()
+		if n == workers {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %d background loads, have %d", workers, n)
+		}
+	}
+	if s := c.Stats(); s.BackgroundWorkers != workers || s.BackgroundQueue != tasks-workers {
+		t.Fatalf("after flood: %d workers, %d queued, want %d, %d", s.BackgroundWorkers, s.BackgroundQueue, workers, tasks-workers)
+	}
+	if n := runtime.NumGoroutine(); n > before+workers {
+		t.Errorf("%d goroutines after queueing %d tasks, want at most %d", n, tasks, before+workers)
+	}
+	close(release)
+
+	// Once the queue drains, the workers exit.
+	for start := time.Now(); ; time.Sleep(1 * time.Millisecond) {
+		s := c.Stats()
+		if s.BackgroundQueue == 0 && s.BackgroundWorkers == 0 && runtime.NumGoroutine() <= before {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for workers to exit: %+v, %d goroutines, want %d", s, runtime.NumGoroutine(), before)
+		}
+	}
+	if peak > workers {
+		t.Errorf("%d concurrent background loads, want at most %d", peak, workers)
+	}
+	for i := 0; i < tasks; i++ {
+		if name := fmt.Sprintf("file%d", i); !cached(c, name) {
+			t.Errorf("%s not prefetched", name)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	check := func(wantBytes int64, wantEntries int) {
+		t.Helper()
+		bytes, entries, err := c.DiskUsage()
+		if bytes != wantBytes || entries != wantEntries || err != nil {
+			t.Fatalf("DiskUsage() = %d, %d, %v, want %d, %d, nil", bytes, entries, err, wantBytes, wantEntries)
+		}
+	}
+
+	check(0, 0)
+	var total int64
+	for i, name := range []string{"a", "bb", "ccc"} {
+		total += int64(len(readFile(t, c, name)))
+		check(total, i+1)
+	}
+
+	// Reloading replaces a copy rather than adding one.
+	c.Expire("bb")
+	data := readFile(t, c, "bb")
+	check(total, 3)
+	if string(data) != "hello, /bb #2\n" {
+		t.Fatalf("reloaded read bb = %q", data)
+	}
+
+	c.Delete("a")
+	total -= int64(len("hello, /a #1\n"))
+	check(total, 2)
+
+	// Force a rescan; it must agree with the running total.
+	c.usage.valid = false
+	check(total, 2)
+}
+
+func TestDeleteExpired(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	readFile(t, c, "a")
+	readFile(t, c, "b")
+	if n, err := c.DeleteExpired(); n != 0 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 0, nil", n, err)
+	}
+	if err := c.Expire("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.DeleteExpired(); n != 1 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 1, nil", n, err)
+	}
+	if cached(c, "a") || !cached(c, "b") {
+		t.Fatalf("after DeleteExpired, cached a=%v b=%v, want false, true", cached(c, "a"), cached(c, "b"))
+	}
+
+	// With an expiration period, old copies expire too.
+	c.SetExpiration(1 * time.Hour)
+	_, prefix := c.locate("b")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(prefix+".meta", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.DeleteExpired(); n != 1 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 1, nil", n, err)
+	}
+	if cached(c, "b") {
+		t.Fatalf("after DeleteExpired, b is cached")
+	}
+	if u, n, err := c.DiskUsage(); u != 0 || n != 0 || err != nil {
+		t.Fatalf("DiskUsage() = %d, %d, %v, want 0, 0, nil", u, n, err)
+	}
+}
+
+func TestAdaptiveExpiration(t *testing.T) {
+	changing := true
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if meta != nil && !changing {
+			return true, meta, nil
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	const min, max = 1 * time.Minute, 10 * time.Minute
+	c.SetAdaptiveExpiration(min, max)
+	interval := func() time.Duration {
+		e, err := c.Stat("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.Expires.Sub(e.RefreshTime).Round(time.Second)
+	}
+
+	readFile(t, c, "file")
+	if d := interval(); d != min {
+		t.Fatalf("new copy expiration = %v, want %v", d, min)
+	}
+
+	// An object that changes on every revalidation backs off toward max.
+	var intervals []time.Duration
+	for i := 0; i < 5; i++ {
+		c.Expire("file")
+		readFile(t, c, "file")
+		intervals = append(intervals, interval())
+	}
+	want := []time.Duration{2 * time.Minute, 4 * time.Minute, 8 * time.Minute, max, max}
+	if fmt.Sprint(intervals) != fmt.Sprint(want) {
+		t.Fatalf("changing object expirations = %v, want %v", intervals, want)
+	}
+
+	// A stable object comes back toward min.
+	changing = false
+	c.Expire("file")
+	readFile(t, c, "file")
+	if d := interval(); d != max/2 {
+		t.Fatalf("stable object expiration = %v, want %v", d, max/2)
+	}
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #6\n" {
+		t.Fatalf("read file = %q, want fresh copy #6", data)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	c.SetManifest(true)
+
+	readFile(t, c, "a")
+	readFile(t, c, "b")
+	c.Expire("a")
+	readFile(t, c, "a") // revalidation does not add a line
+
+	manifest := func() string {
+		data, err := ioutil.ReadFile(c.dir + "/manifest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	line := func(path string) string {
+		_, prefix := c.locate(path)
+		return prefix[len(c.dir)+1:] + "\t" + strconv.Quote("/"+path) + "\n"
+	}
+	if m := manifest(); m != line("a")+line("b") {
+		t.Fatalf("manifest:\n%s\nwant:\n%s", m, line("a")+line("b"))
+	}
+
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if m := manifest(); m != line("b") {
+		t.Fatalf("manifest after Delete and Sweep:\n%s\nwant:\n%s", m, line("b"))
+	}
+
+	// A recreated entry is recorded again.
+	readFile(t, c, "a")
+	if m := manifest(); m != line("b")+line("a") {
+		t.Fatalf("manifest after recreating a:\n%s\nwant:\n%s", m, line("b")+line("a"))
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	for _, name := range []string{"a", "b", "c"} {
+		readFile(t, c, name)
+	}
+	// Another client is reloading c.
+	_, prefixC := c.locate("c")
+	held, err := c.metaLock(prefixC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	// A crashed client left a .next file with no .meta file.
+	stray := filepath.Join(c.dir, "abc", "0123456789")
+	os.Mkdir(filepath.Dir(stray), 0777)
+	if err := ioutil.WriteFile(stray+".next", []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if cached(c, "a") || cached(c, "b") || !cached(c, "c") {
+		t.Fatalf("after DeleteAll, cached a=%v b=%v c=%v, want false, false, true", cached(c, "a"), cached(c, "b"), cached(c, "c"))
+	}
+	if _, err := os.Stat(filepath.Dir(stray)); !os.IsNotExist(err) {
+		t.Fatalf("after DeleteAll, directory with stray .next remains: %v", err)
+	}
+
+	// Once released, the skipped entry can be deleted too.
+	held.Close()
+	if err := c.DeleteAll(); err != nil {
+		t.Fatalf("second DeleteAll: %v", err)
+	}
+	if cached(c, "c") {
+		t.Fatalf("after second DeleteAll, c is cached")
+	}
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #1\n" {
+		t.Fatalf("read after DeleteAll = %q", data)
+	}
+}
+
+func TestDeleteOpenReader(t *testing.T) {
+	defer func(old bool) { renameBeforeRemove = old }(renameBeforeRemove)
+	for _, rename := range []bool{false, true} {
+		renameBeforeRemove = rename
+		c, cleanup := newCache(t, LoaderFunc(loadHello))
+
+		f, err := c.Open("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete("a"); err != nil {
+			t.Fatalf("rename=%v: Delete with open reader: %v", rename, err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "hello, /a #1\n" {
+			t.Fatalf("rename=%v: read after Delete = %q, %v, want %q", rename, data, err, "hello, /a #1\n")
+		}
+		_, prefix := c.locate("a")
+		for _, ext := range []string{".data", ".dead", ".meta"} {
+			if _, err := os.Stat(prefix + ext); !os.IsNotExist(err) {
+				t.Errorf("rename=%v: after Delete, %s exists", rename, ext)
+			}
+		}
+		if data := readFile(t, c, "a"); string(data) != "hello, /a #1\n" {
+			t.Fatalf("rename=%v: reload after Delete = %q", rename, data)
+		}
+		cleanup()
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tt := range []struct{ in, out string }{
+		{"", "/"},
+		{"/", "/"},
+		{"a/b", "/a/b"},
+		{"/a/b/", "/a/b"},
+		{"a//b///c", "/a/b/c"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"../../a", "/a"},
+		{"/a/b/..", "/a"},
+	} {
+		if out := CleanPath(tt.in); out != tt.out {
+			t.Errorf("CleanPath(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+
+	// Paths with the same canonical form share a cached copy.
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	readFile(t, c, "dir/file")
+	if data := readFile(t, c, "/dir//x/../file/"); string(data) != "hello, /dir/file #1\n" {
+		t.Errorf("read equivalent path = %q, want cached copy", data)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	var loads []string
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads = append(loads, path)
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	// Strip a locale prefix.
+	c.SetKeyFunc(func(path string) string {
+		if strings.HasPrefix(path, "/en/") || strings.HasPrefix(path, "/fr/") {
+			return path[3:]
+		}
+		return path
+	})
+	const want = "hello, /page #1\n"
+	for _, path := range []string{"en/page", "/fr/page", "page"} {
+		if data := readFile(t, c, path); string(data) != want {
+			t.Errorf("read %s = %q, want %q", path, data, want)
+		}
+	}
+	if fmt.Sprint(loads) != "[/page]" {
+		t.Errorf("loads = %v, want [/page]", loads)
+	}
+	e, err := c.Stat("/en/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != "/page" {
+		t.Errorf("Stat(/en/page).Path = %q, want /page", e.Path)
+	}
+}
+
+func TestStrictFreshness(t *testing.T) {
+	errNetwork := errors.New("network unreachable")
+	var loadErr error
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if loadErr != nil {
+			return false, nil, loadErr
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+	c.SetStaleIfError(1 * time.Hour)
+	c.SetStrictFreshness(true)
+
+	readFile(t, c, "file")
+	c.Expire("file")
+	loadErr = errNetwork
+	_, err := c.Open("file")
+	if !errors.Is(err, ErrStale) || !errors.Is(err, errNetwork) {
+		t.Fatalf("Open expired file with transient error: %v, want ErrStale wrapping %v", err, errNetwork)
+	}
+	if !strings.Contains(err.Error(), "/file") {
+		t.Errorf("Open error %q does not mention path", err)
+	}
+
+	// A missing file is not stale.
+	loadErr = os.ErrNotExist
+	if _, err := c.Open("file"); errors.Is(err, ErrStale) || !os.IsNotExist(err) {
+		t.Fatalf("Open deleted file: %v, want not-exist error", err)
+	}
+
+	// Without strict freshness, the stale copy is served.
+	c.SetStrictFreshness(false)
+	loadErr = errNetwork
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #1\n" {
+		t.Fatalf("read stale file = %q", data)
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		started <- true
+		<-release
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	if n := c.InFlight(); n != 0 {
+		t.Fatalf("InFlight() = %d before any download, want 0", n)
+	}
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("WaitIdle with no downloads: %v", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		readFile(t, c, "file")
+		done <- true
+	}()
+	<-started
+	if n := c.InFlight(); n != 1 {
+		t.Fatalf("InFlight() = %d during download, want 1", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.WaitIdle(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitIdle during download = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	idle := make(chan error)
+	go func() { idle <- c.WaitIdle(context.Background()) }()
+	close(release)
+	if err := <-idle; err != nil {
+		t.Fatalf("WaitIdle = %v", err)
+	}
+	if n := c.InFlight(); n != 0 {
+		t.Fatalf("InFlight() = %d after download, want 0", n)
+	}
+	<-done
+}
+
+func TestWaitFor(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		switch path {
+		case "/slow":
+			started <- true
+			<-release
+		case "/missing":
+			started <- true
+			<-release
+			return false, nil, ErrNotFound
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	readFile(t, c, "fast")
+	if err := c.WaitFor(context.Background(), "fast"); err != nil {
+		t.Fatalf("WaitFor cached file: %v", err)
+	}
+
+	c.Prefetch("slow")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.WaitFor(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Fatalf("WaitFor during download = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	waited := make(chan error)
+	go func() { waited <- c.WaitFor(context.Background(), "slow") }()
+	// Installing other files does not satisfy the wait.
+	readFile(t, c, "other")
+	select {
+	case err := <-waited:
+		t.Fatalf("WaitFor returned %v before download finished", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-waited; err != nil {
+		t.Fatalf("WaitFor = %v", err)
+	}
+	if !cached(c, "slow") {
+		t.Fatalf("slow not cached after WaitFor")
+	}
+
+	// A failed download ends the wait with its error,
+	// both for waiters during the download and for later ones.
+	release = make(chan bool)
+	c.Prefetch("missing")
+	<-started
+	go func() { waited <- c.WaitFor(context.Background(), "missing") }()
+	close(release)
+	select {
+	case err := <-waited:
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("WaitFor failed download = %v, want ErrNotFound", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("WaitFor did not return after failed download")
+	}
+	if err := c.WaitFor(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("WaitFor after failed download = %v, want ErrNotFound", err)
+	}
+}
+
+func TestNilMeta(t *testing.T) {
+	var metas [][]byte
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		metas = append(metas, meta)
+		if meta != nil {
+			return true, nil, nil
+		}
+		fmt.Fprintf(target, "hello\n")
+		return false, nil, nil
+	}))
+	defer cleanup()
+
+	readFile(t, c, "file")
+	c.Expire("file")
+	readFile(t, c, "file")
+	c.Expire("file")
+	if data := readFile(t, c, "file"); string(data) != "hello\n" {
+		t.Fatalf("read file = %q, want %q", data, "hello\n")
+	}
+	if len(metas) != 3 || metas[0] != nil || metas[1] == nil || len(metas[1]) != 0 || metas[2] == nil {
+		t.Fatalf("loader called with metadata %#v, want nil then empty non-nil", metas)
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	var mu sync.Mutex
+	loads := 0
+	loader := LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		time.Sleep(1 * time.Millisecond)
+		return loadHello(path, target, meta)
+	})
+	c, cleanup := newCache(t, loader)
+	defer cleanup()
+
+	// Leave a stale .next file behind, as a crashed process would.
+	_, prefix := c.locate("file")
+	if err := ioutil.WriteFile(prefix+".next", []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Separate caches sharing the directory stand in for separate processes.
+	const N = 20
+	var wg sync.WaitGroup
+	errc := make(chan error, N)
+	for i := 0; i < N; i++ {
+		c1, err := New(c.dir, loader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := c1.Open("file")
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer f.Close()
+			data, err := ioutil.ReadAll(f)
+			if err == nil && string(data) != "hello, /file #1\n" {
+				err = fmt.Errorf("read %q", data)
+			}
+			if err != nil {
+				errc <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+	if _, err := os.Stat(prefix + ".next"); !os.IsNotExist(err) {
+		t.Errorf("stale .next file left behind: %v", err)
+	}
+}
+
+// A streamLoaderFunc is a StreamLoader calling a function.
+type streamLoaderFunc func(string, io.Writer, []byte) (bool, []byte, error)
+
+func (f streamLoaderFunc) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	return f(path, target, meta)
+}
+
+func (f streamLoaderFunc) LoadStream(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+	return f(path, target, meta)
+}
+
+func TestStats(t *testing.T) {
+	const firstDelay, restDelay = 20 * time.Millisecond, 10 * time.Millisecond
+	c, cleanup := newCache(t, streamLoaderFunc(func(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+		if meta != nil {
+			return true, meta, nil
+		}
+		time.Sleep(firstDelay)
+		fmt.Fprintf(target, "hello, ")
+		time.Sleep(restDelay)
+		fmt.Fprintf(target, "world\n")
+		return false, []byte("v1"), nil
+	}))
+	defer cleanup()
+
+	if data := readFile(t, c, "file"); string(data) != "hello, world\n" {
+		t.Fatalf("read file = %q", data)
+	}
+	c.Expire("file")
+	readFile(t, c, "file")
+	readFile(t, c, "file")
+
+	s := c.Stats()
+	if s.Loads != 2 || s.LoadErrors != 0 || s.LoadTime.Count != 2 || s.Hits != 1 {
+		t.Fatalf("Stats() = %+v, want 2 loads, no errors, 1 hit", s)
+	}
+	if s.LoadTime.Max < firstDelay+restDelay {
+		t.Errorf("LoadTime.Max = %v, want at least %v", s.LoadTime.Max, firstDelay+restDelay)
+	}
+	if s.FirstByte.Count != 1 || s.FirstByte.Max < firstDelay || s.FirstByte.Max >= s.LoadTime.Max {
+		t.Errorf("FirstByte = %+v, want one time at least %v and less than LoadTime.Max %v", s.FirstByte, firstDelay, s.LoadTime.Max)
+	}
+	if m := s.LoadTime.Mean(); m != s.LoadTime.Total/2 {
+		t.Errorf("LoadTime.Mean() = %v, want %v", m, s.LoadTime.Total/2)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	loads := 0
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	readFile(t, c, "file")
+	const override = "overridden\n"
+	if err := c.Override("file", []byte(override)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetExpiration(1 * time.Nanosecond)
+	if err := c.Expire("file"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if data := readFile(t, c, "file"); string(data) != override {
+			t.Fatalf("read overridden file = %q, want %q", data, override)
+		}
+	}
+	if n, err := c.DeleteExpired(); n != 0 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 0, nil", n, err)
+	}
+	if e, err := c.Stat("file"); err != nil || !e.Overridden || !e.Expires.IsZero() {
+		t.Fatalf("Stat = %+v, %v, want overridden copy that never expires", e, err)
+	}
+	if loads != 1 {
+		t.Fatalf("loader called %d times, want 1", loads)
+	}
+
+	if err := c.ClearOverride("file"); err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #1\n" {
+		t.Fatalf("read file after ClearOverride = %q, want loaded copy", data)
+	}
+	if loads != 2 {
+		t.Fatalf("loader called %d times, want 2", loads)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	c.SetMaxEntries(2)
+	start := time.Now().Add(-1 * time.Hour)
+	for i, name := range []string{"a", "b"} {
+		readFile(t, c, name)
+		setUsed(t, c, name, start.Add(time.Duration(i)*time.Minute))
+	}
+	readFile(t, c, "c")
+	if cached(c, "a") || !cached(c, "b") || !cached(c, "c") {
+		t.Fatalf("after third file, cached a=%v b=%v c=%v, want false, true, true", cached(c, "a"), cached(c, "b"), cached(c, "c"))
+	}
+	if _, n, err := c.DiskUsage(); n != 2 || err != nil {
+		t.Fatalf("DiskUsage() = _, %d, %v, want 2 entries", n, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		f, meta, err := c.Fetch("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "hello, /file #1\n" || string(meta) != "1" || err != nil {
+			t.Fatalf("Fetch = %q, %q, %v, want %q, %q, nil", data, meta, err, "hello, /file #1\n", "1")
+		}
+	}
+	if cached(c, "file") {
+		t.Fatalf("Fetch cached the file")
+	}
+	if u, n, err := c.DiskUsage(); u != 0 || n != 0 || err != nil {
+		t.Fatalf("DiskUsage() = %d, %d, %v, want 0, 0, nil", u, n, err)
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	unblock := make(chan bool)
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		<-unblock
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if f, err := c.OpenContext(ctx, "file"); f != nil || err != context.Canceled {
+		t.Fatalf("OpenContext with canceled context = %v, %v, want nil, %v", f, err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if f, err := c.OpenContext(ctx, "file"); f != nil || err != context.DeadlineExceeded {
+		t.Fatalf("OpenContext with blocked loader = %v, %v, want nil, %v", f, err, context.DeadlineExceeded)
+	}
+
+	// The abandoned download still completes.
+	close(unblock)
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.OpenContext(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := ioutil.ReadAll(f); string(data) != "hello, /file #1\n" {
+		t.Fatalf("read %q, want %q", data, "hello, /file #1\n")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	readFile(t, c, "b")
+	readFile(t, c, "a")
+	c.Pin("c") // metadata but no copy
+	list, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Path != "/a" || list[1].Path != "/b" || list[0].Size != 13 {
+		t.Fatalf("Entries() = %+v, want /a and /b", list)
+	}
+}
+
+func TestMinFreeDisk(t *testing.T) {
+	if free, err := freeDisk(os.TempDir()); free <= 0 || err != nil {
+		t.Errorf("freeDisk(%s) = %d, %v, want positive free space", os.TempDir(), free, err)
+	}
+
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	defer func(f func(string) (int64, error)) { freeDisk = f }(freeDisk)
+	free := int64(1000)
+	freeDisk = func(string) (int64, error) { return free, nil }
+
+	// Each file is 13 bytes.
+	c.SetMinFreeDisk(990)
+	start := time.Now().Add(-1 * time.Hour)
+	for i, name := range []string{"a", "b", "c"} {
+		readFile(t, c, name)
+		setUsed(t, c, name, start.Add(time.Duration(i)*time.Minute))
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if !cached(c, name) {
+			t.Fatalf("%s evicted with enough free space", name)
+		}
+	}
+
+	// Short 20 bytes: the two oldest copies must go.
+	free = 970
+	readFile(t, c, "d")
+	if cached(c, "a") || cached(c, "b") || !cached(c, "c") || !cached(c, "d") {
+		t.Fatalf("after running short, cached a=%v b=%v c=%v d=%v, want false, false, true, true",
+			cached(c, "a"), cached(c, "b"), cached(c, "c"), cached(c, "d"))
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "content of %s\n", name)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.Write(buf.Bytes())
+		return false, nil, nil
+	}))
+	defer cleanup()
+
+	r, closer, err := c.OpenReaderAt("archive.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(r, r.(interface{ Size() int64 }).Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(f); string(data) != "content of b.txt\n" || err != nil {
+		t.Fatalf("read b.txt = %q, %v", data, err)
+	}
+
+	// While held, the copy is not evicted.
+	c.SetMaxEntries(1)
+	readFile(t, c, "other")
+	if !cached(c, "archive.zip") {
+		t.Fatalf("held archive.zip was evicted")
+	}
+	if err := closer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer(); err == nil {
+		t.Fatalf("second close succeeded")
+	}
+	readFile(t, c, "another")
+	if cached(c, "archive.zip") {
+		t.Fatalf("released archive.zip was not evicted")
+	}
+}
+
+func TestLoaderErrorClass(t *testing.T) {
+	var loadErr error
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if loadErr != nil {
+			return false, nil, loadErr
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	for _, class := range []error{ErrNotFound, ErrPermission, ErrTransient} {
+		loadErr = &os.PathError{Path: "/file", Op: "read", Err: fmt.Errorf("remote said no (%w)", class)}
+		if _, err := c.Open("file"); !errors.Is(err, class) {
+			t.Errorf("Open with loader error %v: %v, want error wrapping %v", loadErr, err, class)
+		}
+	}
+
+	// In strict freshness mode, the classification survives wrapping with ErrStale.
+	c.SetStrictFreshness(true)
+	loadErr = nil
+	readFile(t, c, "file")
+	c.Expire("file")
+	loadErr = &os.PathError{Path: "/file", Op: "read", Err: ErrTransient}
+	if _, err := c.Open("file"); !errors.Is(err, ErrStale) || !errors.Is(err, ErrTransient) {
+		t.Errorf("Open expired file in strict mode: %v, want ErrStale wrapping ErrTransient", err)
+	}
+	loadErr = &os.PathError{Path: "/file", Op: "read", Err: ErrPermission}
+	if _, err := c.Open("file"); errors.Is(err, ErrStale) || !os.IsPermission(err) {
+		t.Errorf("Open expired file in strict mode: %v, want permission error", err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	modTime := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		fmt.Fprintf(target, "hello\n")
+		if path == "/plain" {
+			return false, nil, nil
+		}
+		return false, (&LoadMeta{ETag: `"v1"`, LastModified: modTime}).Marshal(), nil
+	}))
+	defer cleanup()
+
+	if _, _, ok, err := c.Validator("file"); ok || err != nil {
+		t.Fatalf("Validator before caching = ok %v, %v, want false, nil", ok, err)
+	}
+	readFile(t, c, "file")
+	etag, lastModified, ok, err := c.Validator("file")
+	if etag != `"v1"` || !lastModified.Equal(modTime) || !ok || err != nil {
+		t.Fatalf("Validator = %q, %v, %v, %v, want %q, %v, true, nil", etag, lastModified, ok, err, `"v1"`, modTime)
+	}
+	readFile(t, c, "plain")
+	if _, _, ok, err := c.Validator("plain"); ok || err != nil {
+		t.Fatalf("Validator without validators = ok %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestExpireAll(t *testing.T) {
+	var loads int32
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		atomic.AddInt32(&loads, 1)
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	const n = 20
+	name := func(i int) string { return fmt.Sprintf("file%d", i) }
+	for i := 0; i < n; i++ {
+		readFile(t, c, name(i))
+	}
+
+	// ExpireAll is safe to call while files are being opened.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < n; i++ {
+			if f, err := c.Open(name(i)); err == nil {
+				f.Close()
+			}
+		}
+		close(done)
+	}()
+	if err := c.ExpireAll(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// A stale .next file left by a crashed client does not keep
+	// its entry from expiring.
+	_, prefix := c.locate(name(0))
+	if err := ioutil.WriteFile(prefix+".next", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ExpireAll(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&loads, 0)
+	for i := 0; i < n; i++ {
+		readFile(t, c, name(i))
+	}
+	if loads != n {
+		t.Errorf("%d loads after ExpireAll, want %d", loads, n)
+	}
+}
+
+func TestForceReload(t *testing.T) {
+	// The origin's validator is wrong: it never changes,
+	// so revalidation keeps the outdated copy.
+	version := 1
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if meta != nil {
+			return true, meta, nil
+		}
+		fmt.Fprintf(target, "version %d\n", version)
+		return false, []byte(`"etag"`), nil
+	}))
+	defer cleanup()
+
+	readFile(t, c, "file")
+	version = 2
+	c.ExpireAll()
+	if data := readFile(t, c, "file"); string(data) != "version 1\n" {
+		t.Fatalf("read revalidated file = %q, want %q", data, "version 1\n")
+	}
+	if err := c.ForceReload("file"); err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "file"); string(data) != "version 2\n" {
+		t.Fatalf("read file after ForceReload = %q, want %q", data, "version 2\n")
+	}
+	if e, err := c.Stat("file"); err != nil || string(e.Meta) != `"etag"` {
+		t.Fatalf("Stat after ForceReload = %+v, %v, want recorded ETag", e, err)
+	}
+}
+
+func TestOpenFast(t *testing.T) {
+	// The loader's state is shared with the opens that OpenFast
+	// abandons to finish in the background.
+	var (
+		mu      sync.Mutex
+		delay   time.Duration
+		loadErr error
+		version = 1
+	)
+	set := func(d time.Duration, err error, v int) {
+		mu.Lock()
+		delay, loadErr, version = d, err, v
+		mu.Unlock()
+	}
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		mu.Lock()
+		delay, loadErr, version := delay, loadErr, version
+		mu.Unlock()
+		time.Sleep(delay)
+		if loadErr != nil {
+			return false, nil, loadErr
+		}
+		fmt.Fprintf(target, "version %d\n", version)
+		return false, nil, nil
+	}))
+	defer cleanup()
+
+	const budget = 50 * time.Millisecond
+	read := func(name string) (string, time.Duration) {
+		start := time.Now()
+		f, err := c.OpenFast(name, budget)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("OpenFast(%s): %v", name, err)
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		return string(data), elapsed
+	}
+	// wait waits for opens abandoned by OpenFast to finish.
+	wait := func() {
+		if err := c.WaitIdle(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With no copy, OpenFast waits for the loader.
+	set(2*budget, nil, 1)
+	if data, elapsed := read("file"); data != "version 1\n" || elapsed < 2*budget {
+		t.Fatalf("OpenFast with no copy = %q after %v, want %q after at least %v", data, elapsed, "version 1\n", 2*budget)
+	}
+
+	// With a stale copy and a slow loader, OpenFast serves the stale copy
+	// within the budget and reloads in the background.
+	c.Expire("file")
+	set(10*budget, nil, 2)
+	if data, elapsed := read("file"); data != "version 1\n" || elapsed >= 10*budget {
+		t.Fatalf("OpenFast with slow loader = %q after %v, want stale %q within about %v", data, elapsed, "version 1\n", budget)
+	}
+	wait()
+	set(0, nil, 2)
+	if data, _ := read("file"); data != "version 2\n" {
+		t.Fatalf("OpenFast after background reload = %q, want %q", data, "version 2\n")
+	}
+
+	// With a stale copy and a failing loader, OpenFast serves the stale copy.
+	c.Expire("file")
+	set(0, errors.New("network unreachable"), 2)
+	if data, _ := read("file"); data != "version 2\n" {
+		t.Fatalf("OpenFast with failing loader = %q, want stale %q", data, "version 2\n")
+	}
+	wait()
+	set(0, os.ErrNotExist, 2)
+	if _, err := c.OpenFast("file", budget); !os.IsNotExist(err) {
+		t.Fatalf("OpenFast of deleted file: %v, want not-exist error", err)
+	}
+}
+
+func TestEvictionPlan(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	start := time.Now().Add(-1 * time.Hour)
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		readFile(t, c, name)
+		setUsed(t, c, name, start.Add(time.Duration(i)*time.Minute))
+	}
+	if err := c.Pin("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file is 13 bytes. Allow room for two.
+	c.SetMaxData(30)
+	plan, bytes, err := c.EvictionPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned []string
+	for _, e := range plan {
+		planned = append(planned, e.Path)
+	}
+	if fmt.Sprint(planned) != "[/a /c /d]" || bytes != 39 {
+		t.Fatalf("EvictionPlan() = %v, %d, want [/a /c /d], 39", planned, bytes)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if !cached(c, name) {
+			t.Fatalf("EvictionPlan removed %s", name)
+		}
+	}
+
+	c.checkDataLimit()
+	var evicted []string
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if !cached(c, name) {
+			evicted = append(evicted, "/"+name)
+		}
+	}
+	if fmt.Sprint(evicted) != fmt.Sprint(planned) {
+		t.Fatalf("eviction removed %v, but plan was %v", evicted, planned)
+	}
+	if plan, bytes, err := c.EvictionPlan(); len(plan) != 0 || bytes != 0 || err != nil {
+		t.Fatalf("EvictionPlan after eviction = %v, %d, %v, want empty", plan, bytes, err)
+	}
+}
+
+func TestOpenDerived(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	derives := 0
+	upper := func(dst io.Writer, src *os.File, meta []byte) ([]byte, error) {
+		derives++
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		dst.Write(bytes.ToUpper(data))
+		return []byte("upper " + string(meta)), nil
+	}
+	read := func() string {
+		f, err := c.OpenDerived("a", "upper", upper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if s := read(); s != "HELLO, /A #1\n" {
+		t.Fatalf("OpenDerived = %q, want %q", s, "HELLO, /A #1\n")
+	}
+	if s := read(); s != "HELLO, /A #1\n" || derives != 1 {
+		t.Fatalf("second OpenDerived = %q after %d derives, want %q after 1", s, derives, "HELLO, /A #1\n")
+	}
+	e, err := c.Stat("a#upper")
+	if err != nil || string(e.Meta) != "upper 1" {
+		t.Fatalf("Stat(a#upper) = %v, %v, want meta %q", e, err, "upper 1")
+	}
+
+	// Expiring the derived copy does not rebuild it.
+	if err := c.Expire("a#upper"); err != nil {
+		t.Fatal(err)
+	}
+	if s := read(); s != "HELLO, /A #1\n" || derives != 1 {
+		t.Fatalf("OpenDerived after Expire = %q after %d derives, want %q after 1", s, derives, "HELLO, /A #1\n")
+	}
+
+	// A new download of the file does.
+	if err := c.ForceReload("a"); err != nil {
+		t.Fatal(err)
+	}
+	if s := read(); s != "HELLO, /A #1\n" || derives != 2 {
+		t.Fatalf("OpenDerived after reload = %q after %d derives, want %q after 2", s, derives, "HELLO, /A #1\n")
+	}
+
+	if _, err := c.OpenDerived("a", "x/y", upper); err == nil {
+		t.Fatalf("OpenDerived with slash in name succeeded")
+	}
+}
+
+func TestRename(t *testing.T) {
+	loads := 0
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	if s := string(readFile(t, c, "old")); s != "hello, /old #1\n" {
+		t.Fatalf("read old = %q", s)
+	}
+	readFile(t, c, "new")
+	if err := c.Pin("old"); err != nil {
+		t.Fatal(err)
+	}
+	_, n0, err := c.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if cached(c, "old") {
+		t.Errorf("old path still cached after Rename")
+	}
+	if s := string(readFile(t, c, "new")); s != "hello, /old #1\n" {
+		t.Errorf("read new = %q, want %q", s, "hello, /old #1\n")
+	}
+	if loads != 2 {
+		t.Errorf("loader called %d times, want 2", loads)
+	}
+	e, err := c.Stat("new")
+	if err != nil || e.Path != "/new" || !e.Pinned {
+		t.Errorf("Stat(new) = %+v, %v, want pinned /new", e, err)
+	}
+	if _, n, _ := c.DiskUsage(); n != n0-1 {
+		t.Errorf("DiskUsage entries = %d, want %d", n, n0-1)
+	}
+
+	if err := c.Rename("missing", "other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rename(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCostAwareEviction(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.WriteString("same size\n")
+		m := &LoadMeta{Cost: 1}
+		if strings.HasPrefix(path, "/dear") {
+			m.Cost = 10
+		}
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+	c.SetEvictionPolicy(CostAware)
+
+	// Try both orders of names, so that the result
+	// cannot depend on the tie-breaking by file name.
+	used := time.Now().Add(-1 * time.Hour)
+	for _, names := range [][2]string{{"cheap1", "dear1"}, {"dear2", "cheap2"}} {
+		for _, name := range names {
+			readFile(t, c, name)
+			setUsed(t, c, name, used)
+		}
+	}
+	c.SetMaxEntries(2)
+	c.checkDataLimit()
+	for _, name := range []string{"cheap1", "cheap2"} {
+		if cached(c, name) {
+			t.Errorf("%s still cached, want evicted", name)
+		}
+	}
+	for _, name := range []string{"dear1", "dear2"} {
+		if !cached(c, name) {
+			t.Errorf("%s evicted, want cached", name)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	content := strings.Repeat("streamed content\n", 1000)
+	c, cleanup := newCache(t, streamLoaderFunc(func(path string, w io.Writer, meta []byte) (bool, []byte, error) {
+		_, err := io.WriteString(w, content)
+		return false, nil, err
+	}))
+	defer cleanup()
+
+	readFile(t, c, "a")
+	e, err := c.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte(content))
+	if !bytes.Equal(e.SHA256, want[:]) {
+		t.Fatalf("SHA256 = %x, want %x", e.SHA256, want)
+	}
+	if err := c.Verify("a"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// Corrupt the copy.
+	_, prefix := c.locate("a")
+	if err := ioutil.WriteFile(prefix+".data", []byte("corrupt"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify("a"); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Verify of corrupt copy = %v, want ErrChecksum", err)
+	}
+	if err := c.Verify("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Verify(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMinExpiration(t *testing.T) {
+	loads := 0
+	noStore := false
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		// The origin advertises max-age=0.
+		m := &LoadMeta{MaxAge: -1, NoStore: noStore}
+		if meta != nil {
+			return true, m.Marshal(), nil
+		}
+		target.WriteString("hello\n")
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+	c.SetExpiration(1 * time.Hour)
+
+	readFile(t, c, "a")
+	readFile(t, c, "a")
+	if loads != 2 {
+		t.Fatalf("without minimum: %d loads, want 2", loads)
+	}
+
+	c.SetMinExpiration(1 * time.Hour)
+	loads = 0
+	readFile(t, c, "a")
+	readFile(t, c, "a")
+	if loads != 0 {
+		t.Fatalf("with minimum: %d loads, want 0", loads)
+	}
+	if e, err := c.Stat("a"); err != nil || time.Until(e.Expires) < 59*time.Minute {
+		t.Fatalf("with minimum: Stat = %+v, %v, want expiration in an hour", e, err)
+	}
+
+	// No-store copies are revalidated on every use regardless.
+	noStore = true
+	c.Expire("a")
+	readFile(t, c, "a")
+	loads = 0
+	readFile(t, c, "a")
+	if loads != 1 {
+		t.Fatalf("no-store: %d loads, want 1", loads)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	// subdir returns the subdirectory holding the entry for path.
+	// It must be called before removing the subdirectory,
+	// since locate creates it again.
+	subdir := func(path string) string {
+		_, prefix := c.locate(path)
+		return filepath.Dir(prefix)
+	}
+	dirA, dirB := subdir("a"), subdir("b")
+
+	readFile(t, c, "a")
+	readFile(t, c, "b")
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dirA); err != nil {
+		t.Fatalf("subdirectory removed without SetPruneDirs: %v", err)
+	}
+	n, err := c.Compact()
+	if err != nil || n != 1 {
+		t.Fatalf("Compact() = %d, %v, want 1, nil", n, err)
+	}
+	if _, err := os.Stat(dirA); !os.IsNotExist(err) {
+		t.Fatalf("subdirectory after Compact: %v, want removed", err)
+	}
+	if _, err := os.Stat(dirB); err != nil {
+		t.Fatalf("Compact removed subdirectory in use: %v", err)
+	}
+
+	c.SetPruneDirs(true)
+	if err := c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dirB); !os.IsNotExist(err) {
+		t.Fatalf("subdirectory after Delete: %v, want removed", err)
+	}
+
+	// An entry can be created in a subdirectory removed after locate created it.
+	_, prefix := c.locate("c")
+	if n, _ := c.Compact(); n != 1 {
+		t.Fatalf("Compact() = %d, want 1", n)
+	}
+	f, err := c.metaLockCreate(prefix)
+	if err != nil {
+		t.Fatalf("metaLockCreate after Compact: %v", err)
+	}
+	f.Close()
+}
+
+func TestInspector(t *testing.T) {
+	content := "clean content\n"
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.WriteString(content)
+		return false, nil, nil
+	}))
+	defer cleanup()
+	errVirus := errors.New("virus found")
+	c.SetInspector(func(path string, r io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(data, []byte("EICAR")) {
+			return nil, errVirus
+		}
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	})
+
+	if data := readFile(t, c, "a"); string(data) != "CLEAN CONTENT\n" {
+		t.Fatalf("read a = %q, want transformed %q", data, "CLEAN CONTENT\n")
+	}
+	e, err := c.Stat("a")
+	if sum := sha256.Sum256([]byte("CLEAN CONTENT\n")); err != nil || !bytes.Equal(e.SHA256, sum[:]) {
+		t.Fatalf("Stat(a) = %+v, %v, want checksum of transformed content", e, err)
+	}
+
+	// A rejected reload keeps the earlier copy.
+	content = "infected EICAR content\n"
+	if err := c.ForceReload("a"); !errors.Is(err, ErrRejected) || !errors.Is(err, errVirus) {
+		t.Fatalf("ForceReload of infected file = %v, want ErrRejected wrapping errVirus", err)
+	}
+	if data := readFile(t, c, "a"); string(data) != "CLEAN CONTENT\n" {
+		t.Fatalf("read a after rejection = %q, want %q", data, "CLEAN CONTENT\n")
+	}
+	if _, err := c.Open("b"); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Open of infected file = %v, want ErrRejected", err)
+	}
+	if cached(c, "b") {
+		t.Fatalf("rejected file was cached")
+	}
+	if _, _, err := c.Fetch("b"); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Fetch of infected file = %v, want ErrRejected", err)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	loads := 0
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	b1, err := c.Bytes("config")
+	if err != nil || string(b1) != "hello, /config #1\n" {
+		t.Fatalf("Bytes = %q, %v, want %q", b1, err, "hello, /config #1\n")
+	}
+	b2, err := c.Bytes("config")
+	if err != nil || &b1[0] != &b2[0] {
+		t.Fatalf("second Bytes did not return the same slice")
+	}
+	if loads != 1 {
+		t.Fatalf("loader called %d times, want 1", loads)
+	}
+
+	// Expired copy: the file is loaded again.
+	c.Expire("config")
+	b3, err := c.Bytes("config")
+	if err != nil || string(b3) != "hello, /config #2\n" || loads != 2 {
+		t.Fatalf("Bytes after Expire = %q, %v after %d loads, want %q after 2", b3, err, loads, "hello, /config #2\n")
+	}
+
+	// Replaced copy: the new content is read.
+	if err := c.Override("config", []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	b4, err := c.Bytes("config")
+	if err != nil || string(b4) != "new\n" {
+		t.Fatalf("Bytes after Override = %q, %v, want %q", b4, err, "new\n")
+	}
+	if string(b1) != "hello, /config #1\n" {
+		t.Fatalf("earlier slice changed to %q", b1)
+	}
+}
+
+func TestBytesLimit(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		_, err := target.Write(make([]byte, maxMemBytes))
+		return false, nil, err
+	}))
+	defer cleanup()
+
+	n := maxMemTotal/maxMemBytes + 4
+	for i := 0; i < n; i++ {
+		if _, err := c.Bytes(fmt.Sprint("file", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := func(name string) bool {
+		_, prefix := c.locate(name)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.mem.m[prefix] != nil
+	}
+	c.mu.Lock()
+	total, count := c.mem.bytes, c.mem.lru.Len()
+	c.mu.Unlock()
+	if total > maxMemTotal || count != maxMemTotal/maxMemBytes {
+		t.Fatalf("in memory: %d files, %d bytes, want %d files, at most %d bytes", count, total, maxMemTotal/maxMemBytes, maxMemTotal)
+	}
+	if held("file0") || !held(fmt.Sprint("file", n-1)) {
+		t.Fatalf("kept file0 = %v, file%d = %v, want false, true", held("file0"), n-1, held(fmt.Sprint("file", n-1)))
+	}
+
+	// Deleting or expiring copies drops them from memory.
+	last := fmt.Sprint("file", n-1)
+	if err := c.Delete(last); err != nil {
+		t.Fatal(err)
+	}
+	if held(last) {
+		t.Fatalf("deleted %s still in memory", last)
+	}
+	if err := c.ExpireAll(); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	total, count = c.mem.bytes, c.mem.lru.Len()
+	c.mu.Unlock()
+	if total != 0 || count != 0 {
+		t.Fatalf("after ExpireAll: %d files, %d bytes in memory, want none", count, total)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	var loadErr error
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if loadErr != nil {
+			return false, nil, loadErr
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	if _, _, ok := c.LastError("a"); ok {
+		t.Fatalf("LastError before any load: ok = true")
+	}
+
+	// Failure with no cached copy.
+	loadErr = errors.New("origin exploded")
+	start := time.Now()
+	if _, err := c.Open("a"); err == nil {
+		t.Fatalf("Open succeeded despite loader error")
+	}
+	msg, when, ok := c.LastError("a")
+	if !ok || msg != "origin exploded" || when.Before(start) {
+		t.Fatalf("LastError = %q, %v, %v, want %q at or after %v", msg, when, ok, "origin exploded", start)
+	}
+
+	// Success clears the error.
+	loadErr = nil
+	readFile(t, c, "a")
+	if msg, _, ok := c.LastError("a"); ok {
+		t.Fatalf("LastError after success = %q, want none", msg)
+	}
+
+	// Failure revalidating an existing copy keeps the copy's validators.
+	loadErr = errors.New("timeout")
+	if err := c.ForceReload("a"); err == nil {
+		t.Fatalf("ForceReload succeeded despite loader error")
+	}
+	if msg, _, ok := c.LastError("a"); !ok || msg != "timeout" {
+		t.Fatalf("LastError = %q, %v, want %q", msg, ok, "timeout")
+	}
+	if e, err := c.Stat("a"); err != nil || string(e.Meta) != "1" {
+		t.Fatalf("Stat after failed reload = %+v, %v, want loader metadata %q", e, err, "1")
+	}
+}
+
+func TestOpenIfModified(t *testing.T) {
+	version := 1
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if meta != nil && ParseLoadMeta(meta).ETag == etag {
+			return true, meta, nil
+		}
+		fmt.Fprintf(target, "version %d\n", version)
+		return false, (&LoadMeta{ETag: etag}).Marshal(), nil
+	}))
+	defer cleanup()
+
+	// Unknown ETag: the file is returned.
+	f, modified, err := c.OpenIfModified("file", `"v0"`)
+	if err != nil || !modified || f == nil {
+		t.Fatalf("OpenIfModified(v0) = %v, %v, %v, want file, true, nil", f, modified, err)
+	}
+	f.Close()
+
+	// Matching ETag: nothing to send.
+	f, modified, err = c.OpenIfModified("file", `"v1"`)
+	if err != nil || modified || f != nil {
+		t.Fatalf("OpenIfModified(v1) = %v, %v, %v, want nil, false, nil", f, modified, err)
+	}
+
+	// The file changes at the origin: the caller's copy is out of date.
+	version = 2
+	c.Expire("file")
+	f, modified, err = c.OpenIfModified("file", `"v1"`)
+	if err != nil || !modified || f == nil {
+		t.Fatalf("OpenIfModified(v1) after change = %v, %v, %v, want file, true, nil", f, modified, err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "version 2\n" {
+		t.Fatalf("OpenIfModified(v1) after change read %q, want %q", data, "version 2\n")
+	}
+
+	f, modified, err = c.OpenIfModified("file", "")
+	if err != nil || !modified || f == nil {
+		t.Fatalf("OpenIfModified with empty ETag = %v, %v, %v, want file, true, nil", f, modified, err)
+	}
+	f.Close()
+}
+
+func TestOpenExpiredLoadsOnce(t *testing.T) {
+	var mu sync.Mutex
+	loads := 0
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	for round := 1; round <= 3; round++ {
+		if round > 1 {
+			c.Expire("a")
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f, err := c.Open("a")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, err := ioutil.ReadAll(f)
+				f.Close()
+				if want := fmt.Sprintf("hello, /a #%d\n", round); err != nil || string(data) != want {
+					t.Errorf("round %d: read %q, %v, want %q", round, data, err, want)
+				}
+			}()
+		}
+		wg.Wait()
+		mu.Lock()
+		n := loads
+		mu.Unlock()
+		if n != round {
+			t.Fatalf("after round %d, %d loads, want %d", round, n, round)
+		}
+	}
+
+	// A client waiting for the lock while the holder replaces
+	// the .meta file must end up holding the new file's lock.
+	_, prefix := c.locate("a")
+	held, err := c.metaLock(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan *lockedFile)
+	go func() {
+		f, err := c.metaLock(prefix)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- f
+	}()
+	time.Sleep(20 * time.Millisecond)
+	os.Remove(prefix + ".meta")
+	if err := ioutil.WriteFile(prefix+".meta", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	held.Close()
+	f := <-locked
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	fi, err1 := f.Stat()
+	cur, err2 := os.Stat(prefix + ".meta")
+	if err1 != nil || err2 != nil || !os.SameFile(fi, cur) {
+		t.Fatalf("metaLock after replacement holds a stale file (%v, %v)", err1, err2)
+	}
+}
+
+func TestFlockUnsupported(t *testing.T) {
+	defer func(old func(int, int) error) { flock = old }(flock)
+	flock = func(int, int) error { return syscall.ENOTSUP }
+
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #1\n" {
+		t.Fatalf("read with lock files = %q", data)
+	}
+	c.Expire("a")
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #2\n" {
+		t.Fatalf("reload with lock files = %q", data)
+	}
+
+	// The lock file excludes other clients until released.
+	_, prefix := c.locate("a")
+	held, err := c.metaLock(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.tryMetaLock(prefix); err != syscall.EWOULDBLOCK {
+		t.Fatalf("tryMetaLock with lock held = %v, want EWOULDBLOCK", err)
+	}
+	held.Close()
+	if _, err := os.Stat(prefix + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("lock file remains after release: %v", err)
+	}
+
+	// A lock file abandoned long ago is broken.
+	if err := ioutil.WriteFile(prefix+".lock", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	os.Chtimes(prefix+".lock", old, old)
+	f, err := c.tryMetaLock(prefix)
+	if err != nil {
+		t.Fatalf("tryMetaLock with stale lock file: %v", err)
+	}
+	f.Close()
+}
+
+func TestInstallCrossDevice(t *testing.T) {
+	defer func(old func(string, string) error) { rename = old }(rename)
+	crossed := 0
+	rename = func(oldname, newname string) error {
+		if strings.HasSuffix(oldname, ".next") {
+			crossed++
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldname, newname)
+	}
+
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #1\n" {
+		t.Fatalf("read across devices = %q", data)
+	}
+	c.Expire("a")
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #2\n" {
+		t.Fatalf("reload across devices = %q", data)
+	}
+	if crossed != 2 {
+		t.Fatalf("%d cross-device installs, want 2", crossed)
+	}
+	_, prefix := c.locate("a")
+	for _, ext := range []string{".next", ".data.tmp"} {
+		if _, err := os.Stat(prefix + ext); !os.IsNotExist(err) {
+			t.Errorf("after install, %s exists", ext)
+		}
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	readFile(t, c, "a")
+	c.Expire("a")
+
+	// Another client holds the lock and never releases it.
+	_, prefix := c.locate("a")
+	held, err := c.metaLock(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	c.SetLockTimeout(50 * time.Millisecond)
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		f, err := c.Open("a")
+		if err == nil {
+			f.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLockTimeout) {
+			t.Fatalf("Open with lock held = %v, want ErrLockTimeout", err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Fatalf("Open gave up after %v, before the timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Open blocked despite lock timeout")
+	}
+
+	// Once the lock is released, Open succeeds.
+	held.Close()
+	if data := readFile(t, c, "a"); string(data) != "hello, /a #2\n" {
+		t.Fatalf("read after release = %q, want %q", data, "hello, /a #2\n")
+	}
+}
+
+func TestTrackUsage(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	c.SetTrackUsage(false)
+	c.SetMaxData(50)
+	start := time.Now().Add(-1 * time.Hour)
+	for i, name := range []string{"a", "b", "c"} {
+		readFile(t, c, name)
+		readFile(t, c, name)
+		_, prefix := c.locate(name)
+		if _, err := os.Stat(prefix + ".used"); !os.IsNotExist(err) {
+			t.Fatalf("%s.used exists with usage tracking disabled (%v)", name, err)
+		}
+		refresh := start.Add(time.Duration(i) * time.Minute)
+		if name == "a" {
+			refresh = start.Add(time.Hour / 2)
+		}
+		if err := os.Chtimes(prefix+".meta", refresh, refresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without usage tracking, the least recently refreshed copy goes first,
+	// even though it was just used.
+	readFile(t, c, "b")
+	readFile(t, c, "d")
+	if cached(c, "b") {
+		t.Errorf("b is cached, want evicted")
+	}
+	for _, name := range []string{"a", "c", "d"} {
+		if !cached(c, name) {
+			t.Errorf("%s was evicted, want cached", name)
+		}
+	}
+}
+
+func TestPrime(t *testing.T) {
+	var seen []byte
+	loads := 0
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		seen = meta
+		return true, meta, nil
+	}))
+	defer cleanup()
+
+	const content = "primed\n"
+	opts := PrimeOptions{ETag: `"p1"`, ContentType: "text/plain"}
+	if err := c.Prime("file", strings.NewReader(content), opts); err != nil {
+		t.Fatal(err)
+	}
+	c.SetExpiration(1 * time.Hour)
+	if data := readFile(t, c, "file"); string(data) != content {
+		t.Fatalf("read primed file = %q, want %q", data, content)
+	}
+	if loads != 0 {
+		t.Fatalf("loader called %d times for primed file, want 0", loads)
+	}
+	e, err := c.Stat("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := ParseLoadMeta(e.Meta); m.ETag != `"p1"` || m.ContentType != "text/plain" || m.Size != int64(len(content)) {
+		t.Fatalf("cached load metadata = %+v, want primed metadata", m)
+	}
+
+	// A copy primed with an old refresh time is revalidated using its ETag.
+	opts.RefreshTime = time.Now().Add(-2 * time.Hour)
+	if err := c.Prime("old", strings.NewReader(content), opts); err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "old"); string(data) != content {
+		t.Fatalf("read primed file = %q, want %q", data, content)
+	}
+	if loads != 1 || ParseLoadMeta(seen).ETag != `"p1"` {
+		t.Fatalf("loader called %d times with meta %q, want 1 revalidation of ETag \"p1\"", loads, seen)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	// Two writers race to create the entry; exactly one wins.
+	var wg sync.WaitGroup
+	won := make([]bool, 2)
+	for i := range won {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := c.CompareAndSwap("cert", nil, []byte(fmt.Sprintf("cert %d\n", i)), []byte(fmt.Sprint(i)))
+			if err != nil {
+				t.Error(err)
+			}
+			won[i] = ok
+		}(i)
+	}
+	wg.Wait()
+	if won[0] == won[1] {
+		t.Fatalf("racing CompareAndSwap results %v, want exactly one true", won)
+	}
+	winner := 0
+	if won[1] {
+		winner = 1
+	}
+	if data := readFile(t, c, "cert"); string(data) != fmt.Sprintf("cert %d\n", winner) {
+		t.Fatalf("after race, read %q, want writer %d's copy", data, winner)
+	}
+
+	// A swap from stale metadata fails; from current metadata it succeeds.
+	if ok, err := c.CompareAndSwap("cert", []byte(fmt.Sprint(1-winner)), []byte("lost\n"), nil); ok || err != nil {
+		t.Fatalf("CompareAndSwap with stale meta = %v, %v, want false, nil", ok, err)
+	}
+	if ok, err := c.CompareAndSwap("cert", []byte(fmt.Sprint(winner)), []byte("renewed\n"), []byte("2")); !ok || err != nil {
+		t.Fatalf("CompareAndSwap with current meta = %v, %v, want true, nil", ok, err)
+	}
+	if data := readFile(t, c, "cert"); string(data) != "renewed\n" {
+		t.Fatalf("after swap, read %q, want %q", data, "renewed\n")
+	}
+	if e, err := c.Stat("cert"); err != nil || string(e.Meta) != "2" {
+		t.Fatalf("after swap, Stat = %v, %v, want meta %q", e, err, "2")
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	var seen []string
+	allowed := func(path string) bool { return strings.HasPrefix(path, "/public/") }
+	l := AllowList(LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		seen = append(seen, path)
+		return loadHello(path, target, meta)
+	}), allowed)
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+
+	if data := readFile(t, c, "public/a"); string(data) != "hello, /public/a #1\n" {
+		t.Fatalf("read public/a = %q", data)
+	}
+	for _, name := range []string{"secret", "public/../secret", "/public"} {
+		if _, err := c.Open(name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Open(%q): %v, want not found", name, err)
+		}
+	}
+	if len(seen) != 1 || seen[0] != "/public/a" {
+		t.Fatalf("wrapped loader saw %q, want only /public/a", seen)
+	}
+
+	if _, ok := l.(StreamLoader); ok {
+		t.Errorf("AllowList(Loader) implements StreamLoader")
+	}
+	if _, ok := AllowList(streamLoaderFunc(nil), allowed).(StreamLoader); !ok {
+		t.Errorf("AllowList(StreamLoader) does not implement StreamLoader")
+	}
+
+	fsys := fstest.MapFS{
+		"public/a.txt":     {Data: []byte("a")},
+		"public/sub/b.txt": {Data: []byte("b")},
+		"secret.txt":       {Data: []byte("s")},
+	}
+	c2, cleanup2 := newCache(t, AllowList(NewFSLoader(fsys), func(path string) bool {
+		return path == "/" || strings.HasPrefix(path, "/public/")
+	}))
+	defer cleanup2()
+	list, err := c2.List("/")
+	if err != nil || len(list) != 1 || list[0].Name != "public" {
+		t.Fatalf("List(/) = %v, %v, want only public", list, err)
+	}
+	if list, err := c2.List("/public"); err != nil || len(list) != 2 {
+		t.Fatalf("List(/public) = %v, %v, want 2 entries", list, err)
+	}
+}
+
+func TestUsedFlushInterval(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	c.SetUsedFlushInterval(1 * time.Hour)
+	var last time.Time
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"a", "b"} {
+			last = time.Now()
+			readFile(t, c, name)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		_, prefix := c.locate(name)
+		if _, err := os.Stat(prefix + ".used"); !os.IsNotExist(err) {
+			t.Fatalf("%s.used written before flush (%v)", name, err)
+		}
+	}
+	if e, err := c.Stat("b"); err != nil || e.LastUsed.Before(last) {
+		t.Fatalf("Stat(b).LastUsed before flush = %v, %v, want at least %v", e.LastUsed, err, last)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		_, prefix := c.locate(name)
+		fi, err := os.Stat(prefix + ".used")
+		if err != nil {
+			t.Fatalf("%s.used after Close: %v", name, err)
+		}
+		if want := last.Add(-1 * time.Second); fi.ModTime().Before(want) || fi.ModTime().After(time.Now()) {
+			t.Errorf("%s.used mtime = %v, want most recent use near %v", name, fi.ModTime(), last)
+		}
+	}
+
+	// A deleted copy's pending use is discarded.
+	readFile(t, c, "a")
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, prefix := c.locate("a")
+	if _, err := os.Stat(prefix + ".used"); err == nil {
+		t.Errorf("a.used recreated after Delete")
+	}
+
+	// The flush does not create a .used file for an entry
+	// whose lock is held, as it is while being evicted or deleted.
+	readFile(t, c, "c")
+	_, prefix = c.locate("c")
+	lf, err := c.tryMetaLock(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Close()
+	if _, err := os.Stat(prefix + ".used"); err == nil {
+		t.Errorf("c.used created while entry locked")
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	loads := map[string]int{}
+	c, cleanup := newCache(t, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads[path]++
+		code, err := strconv.Atoi(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			return false, nil, &os.PathError{Path: path, Op: "load", Err: ErrNotFound}
+		}
+		return false, nil, &os.PathError{Path: path, Op: "load", Err: &StatusError{Code: code}}
+	}))
+	defer cleanup()
+	c.SetNegativeCaching(map[int]time.Duration{403: time.Hour, 404: time.Hour, 410: 1 * time.Nanosecond})
+
+	open := func(name string) error {
+		t.Helper()
+		f, err := c.Open(name)
+		if err == nil {
+			f.Close()
+			t.Fatalf("Open(%q) succeeded", name)
+		}
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err := open("403")
+		var se *StatusError
+		if !errors.Is(err, ErrPermission) || !errors.As(err, &se) || se.Code != 403 {
+			t.Fatalf("Open(403) #%d: %v, want status 403", i+1, err)
+		}
+		open("missing")
+		open("410")
+		open("500")
+	}
+	for name, want := range map[string]int{"/403": 1, "/missing": 1, "/410": 3, "/500": 3} {
+		if loads[name] != want {
+			t.Errorf("loader called %d times for %s, want %d", loads[name], name, want)
+		}
+	}
+
+	// ForceReload and Delete bypass the remembered failure.
+	c.ForceReload("403")
+	if loads["/403"] != 2 {
+		t.Errorf("loader called %d times for /403 after ForceReload, want 2", loads["/403"])
+	}
+	c.Delete("403")
+	open("403")
+	if loads["/403"] != 3 {
+		t.Errorf("loader called %d times for /403 after Delete, want 3", loads["/403"])
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	const want = "hello, /file #1\n"
+	var buf bytes.Buffer
+	for _, w := range []io.Writer{
+		&buf,                      // io.ReaderFrom
+		struct{ io.Writer }{&buf}, // plain io.Writer
+	} {
+		buf.Reset()
+		if n, err := c.WriteTo("file", w); n != int64(len(want)) || err != nil || buf.String() != want {
+			t.Fatalf("WriteTo(%T) = %d, %v, wrote %q, want %d, nil, %q", w, n, err, buf.String(), len(want), want)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "diskcache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if n, err := c.WriteTo("file", f); n != int64(len(want)) || err != nil {
+		t.Fatalf("WriteTo(file) = %d, %v, want %d, nil", n, err, len(want))
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != want {
+		t.Fatalf("WriteTo(file) wrote %q, want %q", data, want)
+	}
+
+	if _, err := c.WriteTo("file", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Loads != 1 {
+		t.Fatalf("loader called %d times, want 1", s.Loads)
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	dir, err := ioutil.TempDir("", "diskcache-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := bytes.Repeat([]byte("x"), 256<<10)
+	c, err := New(dir, LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		_, err := target.Write(content)
+		return false, nil, err
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := struct{ io.Writer }{ioutil.Discard} // no ReadFrom method
+
+	b.Run("Open+Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			f, err := c.Open("file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(w, f); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			if _, err := c.WriteTo("file", w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestStaleGrace(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	c.SetExpiration(1 * time.Minute)
+	c.SetStaleGrace(10 * time.Minute)
+
+	_, prefix := c.locate("file")
+	age := func(d time.Duration) {
+		t.Helper()
+		mtime := time.Now().Add(-d)
+		if err := os.Chtimes(prefix+".meta", mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readFile(t, c, "file")
+
+	// Within the grace period: served stale, refreshed in the background.
+	age(5 * time.Minute)
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #1\n" {
+		t.Fatalf("read within grace = %q, want stale copy", data)
+	}
+	for start := time.Now(); c.Stats().Loads < 2; time.Sleep(1 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for background revalidation")
+		}
+	}
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #2\n" {
+		t.Fatalf("read after background refresh = %q, want refreshed copy", data)
+	}
+
+	// Beyond the grace period: Open waits for revalidation.
+	age(20 * time.Minute)
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #3\n" {
+		t.Fatalf("read beyond grace = %q, want revalidated copy", data)
+	}
+
+	// Explicit expiration is not subject to the grace period.
+	c.Expire("file")
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #4\n" {
+		t.Fatalf("read after Expire = %q, want revalidated copy", data)
+	}
+	if n := c.Stats().Loads; n != 4 {
+		t.Fatalf("loader called %d times, want 4", n)
+	}
+}
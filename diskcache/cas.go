@@ -0,0 +1,82 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// CompareAndSwap installs newData as a valid cached copy of the file
+// with the given path, with loader metadata newMeta, but only if the
+// loader metadata of the current copy is oldMeta, reporting whether
+// it installed the copy. A nil oldMeta matches only when there is no
+// cached copy; an empty, non-nil oldMeta matches a copy whose loader
+// returned no metadata, as in the Loader interface.
+// The current copy's freshness does not matter.
+//
+// Because the comparison and the installation happen under the entry's
+// lock, which is shared with other caches using the same directory,
+// CompareAndSwap gives clients optimistic concurrency: of several racing
+// to replace the same copy, exactly one succeeds, and the others can
+// read the winner's metadata (see Stat) and copy, and decide what to do.
+func (c *Cache) CompareAndSwap(path string, oldMeta, newData, newMeta []byte) (bool, error) {
+	if c.readOnly {
+		return false, ErrReadOnly
+	}
+	path, prefix := c.locate(path)
+	metaFile, err := c.metaLockCreate(prefix)
+	if err != nil {
+		return false, err
+	}
+	defer metaFile.Close()
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(prefix + ".data")
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return false, err
+	case err != nil:
+		if oldMeta != nil {
+			return false, nil
+		}
+	default:
+		if oldMeta == nil || !bytes.Equal(meta.Load, oldMeta) {
+			return false, nil
+		}
+	}
+
+	_, sum, err := c.install(prefix, metaFile, bytes.NewReader(newData))
+	if err != nil {
+		return false, err
+	}
+	meta.Override = false
+	meta.Load = newMeta
+	meta.Sum = sum
+	meta.NextRanges = nil
+	meta.NextSize = 0
+	meta.NextLoad = nil
+	meta.LastError = ""
+	meta.LastErrorTime = time.Time{}
+	meta.LastStatus = 0
+	meta.CreateTime = time.Now()
+	meta.RefreshTime = meta.CreateTime
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+	}
+	meta.Path = path
+	if err := c.writeMeta(prefix, meta); err != nil {
+		return false, err
+	}
+	c.touch(prefix)
+	metaFile.Close()
+
+	c.checkDataLimit()
+	return true, nil
+}
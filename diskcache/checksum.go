@@ -0,0 +1,68 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrChecksum is the error returned by Verify when a cached copy
+// does not match the checksum recorded when it was loaded.
+var ErrChecksum = errors.New("diskcache: cached copy does not match checksum")
+
+// Verify checks the cached copy of the file with the given path against
+// the SHA-256 checksum recorded when the copy was loaded, returning an error
+// satisfying errors.Is(err, ErrChecksum) if the copy has been corrupted.
+// The cache computes checksums while loading files from a StreamLoader,
+// and for copies installed by Override; Verify returns nil for a copy
+// without a checksum, which can be recognized by an empty
+// CacheEntry.SHA256 in the result of Stat.
+// Verify does not invoke the loader. If there is no cached copy,
+// Verify returns an error satisfying errors.Is(err, ErrNotFound).
+func (c *Cache) Verify(path string) error {
+	path, prefix := c.locate(path)
+
+	// Hold the lock while opening the copy, so that the checksum
+	// describes the copy opened. Once opened, the copy does not change
+	// even if another client replaces it, so the lock can be released
+	// before hashing it.
+	metaFile, err := c.metaLock(prefix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &os.PathError{Path: path, Op: "verify", Err: os.ErrNotExist}
+		}
+		return err
+	}
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		metaFile.Close()
+		return err
+	}
+	data, err := os.Open(prefix + ".data")
+	metaFile.Close()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &os.PathError{Path: path, Op: "verify", Err: os.ErrNotExist}
+		}
+		return err
+	}
+	defer data.Close()
+	if meta.Sum == nil {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, data); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), meta.Sum) {
+		return fmt.Errorf("%w: %s", ErrChecksum, path)
+	}
+	return nil
+}
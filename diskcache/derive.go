@@ -0,0 +1,57 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// OpenDerived opens a copy of the file with the given path transformed
+// by derive, such as a compressed form of the file. The derived copy is
+// cached as an entry of its own, with the path path+"#"+name, so that
+// each transformation of a file is computed once per download of the file
+// rather than once per use. The name must not contain a slash.
+//
+// OpenDerived first opens the file itself, as Open does, revalidating it
+// as needed. It rebuilds the derived copy whenever the file has been
+// downloaded again since the copy was made, by calling derive to write the
+// transformed content of src to dst. The src argument is positioned at the
+// start of the file, and meta is the file's loader metadata.
+// Derive returns the loader metadata to record for the derived copy.
+//
+// Derived copies count toward the cache's limits and are evicted
+// like other entries; an evicted copy is rebuilt on next use.
+func (c *Cache) OpenDerived(path, name string, derive func(dst io.Writer, src *os.File, meta []byte) ([]byte, error)) (*os.File, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, &os.PathError{Path: path, Op: "open", Err: os.ErrInvalid}
+	}
+	src, err := c.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	se, err := c.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := se.Path + "#" + name
+	force := false
+	if de, err := c.Stat(key); err == nil && de.CreateTime.Before(se.CreateTime) {
+		// The file was downloaded again after the copy was derived.
+		force = true
+	}
+	l := LoaderFunc(func(_ string, target *os.File, meta []byte) (bool, []byte, error) {
+		if meta != nil {
+			// Expired, but derived from the current copy of the file.
+			return true, meta, nil
+		}
+		meta, err := derive(target, src, se.Meta)
+		return false, meta, err
+	})
+	return c.open(key, force, l)
+}
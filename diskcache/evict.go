@@ -0,0 +1,414 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Pin marks the cache entry for the file with the given path as pinned.
+// A pinned entry is never removed to stay within the maximum data size limit,
+// although it can still expire and be deleted explicitly.
+// Pinning a file that is not yet cached pins the copy that will be cached.
+func (c *Cache) Pin(path string) error {
+	return c.updateMeta(path, func(meta *metaDisk) { meta.Pinned = true })
+}
+
+// Unpin removes the mark set by Pin.
+func (c *Cache) Unpin(path string) error {
+	return c.updateMeta(path, func(meta *metaDisk) { meta.Pinned = false })
+}
+
+// An EvictionPolicy assigns a priority to a cached copy, given the current
+// time. To stay within its limits, the cache removes copies in increasing
+// order of priority, breaking ties by removing the least recently used first.
+// The entry's Meta field holds the loader metadata, which the policy
+// can parse with ParseLoadMeta.
+type EvictionPolicy func(e *CacheEntry, now time.Time) float64
+
+// SetEvictionPolicy sets the policy ordering the removal of cached copies
+// to stay within the cache's limits. If policy is nil (the default),
+// the cache removes the least recently used copies first.
+// A policy requires reading the metadata of every cached copy
+// when the cache is over its limits, so it makes eviction slower.
+func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) {
+	c.mu.Lock()
+	c.evictionPolicy = policy
+	c.mu.Unlock()
+}
+
+func (c *Cache) getEvictionPolicy() EvictionPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictionPolicy
+}
+
+// CostAware is an EvictionPolicy weighing the cost of loading a file again,
+// as recorded by the loader in LoadMeta.Cost, against the space its copy
+// occupies and the time since it was last used, in the manner of the
+// Greedy-Dual-Size-Frequency policy. Its priority for a copy is
+// its cost divided by its size and by the seconds since its last use,
+// so that among copies used equally recently, cheap copies are removed
+// before expensive ones of the same size.
+func CostAware(e *CacheEntry, now time.Time) float64 {
+	cost := ParseLoadMeta(e.Meta).Cost
+	if cost <= 0 {
+		cost = 1
+	}
+	size := float64(e.Size)
+	if size < 1 {
+		size = 1
+	}
+	age := now.Sub(e.LastUsed).Seconds()
+	if age < 1 {
+		age = 1
+	}
+	return cost / size / age
+}
+
+// SetPruneDirs sets whether to remove a cache subdirectory as soon as
+// deleting or evicting an entry leaves it empty. By default, empty
+// subdirectories remain until the next Compact or Sweep.
+func (c *Cache) SetPruneDirs(prune bool) {
+	var v int32
+	if prune {
+		v = 1
+	}
+	atomic.StoreInt32(&c.atomicPruneDirs, v)
+}
+
+// pruneDir removes the subdirectory holding the entry for prefix,
+// which has just been removed, if it is empty and SetPruneDirs is enabled.
+func (c *Cache) pruneDir(prefix string) {
+	if atomic.LoadInt32(&c.atomicPruneDirs) != 0 {
+		// Fails harmlessly if the directory is not empty.
+		os.Remove(filepath.Dir(prefix))
+	}
+}
+
+// Compact removes all empty cache subdirectories,
+// which accumulate as entries are deleted and evicted,
+// returning the number removed. Sweep calls Compact.
+func (c *Cache) Compact() (int, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	root, err := os.Open(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	dirs, err := root.Readdirnames(-1)
+	root.Close()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, dir := range dirs {
+		// Removing a directory that is not empty fails, which is fine:
+		// such a directory is in use, possibly since just now.
+		if isHexDir(dir) && os.Remove(filepath.Join(c.dir, dir)) == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// isHexDir reports whether name is the name of a cache subdirectory:
+// three lower-case hexadecimal digits.
+func isHexDir(name string) bool {
+	if len(name) != 3 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !('0' <= name[i] && name[i] <= '9' || 'a' <= name[i] && name[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// walk calls f with the file name prefix of each entry in the cache directory.
+// An entry is identified by its .meta file.
+func (c *Cache) walk(f func(prefix string) error) error {
+	root, err := os.Open(c.dir)
+	if err != nil {
+		return err
+	}
+	dirs, err := root.Readdirnames(-1)
+	root.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if !isHexDir(dir) {
+			continue
+		}
+		d, err := os.Open(filepath.Join(c.dir, dir))
+		if err != nil {
+			continue // removed or not a directory
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".meta") {
+				continue
+			}
+			if err := f(filepath.Join(c.dir, dir, strings.TrimSuffix(name, ".meta"))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A diskEntry describes a cache entry found by scan.
+type diskEntry struct {
+	prefix string
+	size   int64     // size of .data file
+	used   time.Time // time of last use
+
+	priority float64 // assigned by the eviction policy, if any
+}
+
+// scan returns the entries in the cache directory that have .data files,
+// or .next files holding partial copies or downloads in progress.
+func (c *Cache) scan() ([]*diskEntry, error) {
+	var list []*diskEntry
+	track := atomic.LoadInt32(&c.atomicNoTrackUsage) == 0
+	if track {
+		c.flushUsed()
+	}
+	err := c.walk(func(prefix string) error {
+		fi, err := os.Stat(prefix + ".data")
+		if err != nil {
+			if fi, err = os.Stat(prefix + ".next"); err != nil {
+				return nil
+			}
+		}
+		e := &diskEntry{prefix: prefix, size: fi.Size(), used: fi.ModTime()}
+		if !track {
+			// Order by refresh time instead.
+			if fi, err := os.Stat(prefix + ".meta"); err == nil {
+				e.used = fi.ModTime()
+			}
+		} else if fi, err := os.Stat(prefix + ".used"); err == nil {
+			e.used = fi.ModTime()
+		}
+		list = append(list, e)
+		return nil
+	})
+	return list, err
+}
+
+// checkDataLimit removes the least recently used cached copies
+// until the cached data fits within the maximum data size limit,
+// the number of copies within the maximum entry count limit,
+// and the free disk space is at least the minimum set by SetMinFreeDisk.
+func (c *Cache) checkDataLimit() {
+	c.makeRoom(0, 0)
+}
+
+// makeRoom removes cached copies as checkDataLimit does, but until
+// the cache is within its limits with room for the given number of
+// additional bytes and copies.
+func (c *Cache) makeRoom(bytes int64, entries int) {
+	c.planEviction(bytes, entries, func(e *diskEntry) bool {
+		return c.evict(e.prefix)
+	})
+}
+
+// planEviction visits the cached copies in eviction order,
+// least recently used first unless an eviction policy is set,
+// calling remove for each until the cache would be within its limits,
+// as described for checkDataLimit, with room for the reserved additional
+// bytes and copies. The remove function reports whether
+// it removed (or would remove) the copy. planEviction returns
+// the bytes the removed copies occupied.
+func (c *Cache) planEviction(reserveBytes int64, reserveEntries int, remove func(*diskEntry) bool) (bytes int64, err error) {
+	max, maxEntries, minFree := c.maxData(), c.maxEntries(), c.minFreeDisk()
+	if max <= 0 && maxEntries <= 0 && minFree <= 0 {
+		return 0, nil
+	}
+	var free int64
+	if minFree > 0 {
+		var err error
+		if free, err = freeDisk(c.dir); err != nil {
+			minFree = 0
+		}
+	}
+	list, err := c.scan()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range list {
+		total += e.size
+	}
+	c.setUsage(total, len(list))
+	total += reserveBytes
+	entries := len(list) + reserveEntries
+	over := func() bool {
+		return max > 0 && total > max || maxEntries > 0 && entries > maxEntries || minFree > 0 && free < minFree
+	}
+	if !over() {
+		return 0, nil
+	}
+	if policy := c.getEvictionPolicy(); policy != nil {
+		now := time.Now()
+		for _, e := range list {
+			if meta, _, err := peekMeta(e.prefix); err == nil {
+				if ce, err := c.stat(meta.Path, e.prefix); err == nil {
+					e.priority = policy(ce, now)
+				}
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].priority != list[j].priority {
+			return list[i].priority < list[j].priority
+		}
+		if !list[i].used.Equal(list[j].used) {
+			return list[i].used.Before(list[j].used)
+		}
+		return list[i].prefix < list[j].prefix
+	})
+	for _, e := range list {
+		if !over() {
+			break
+		}
+		if remove(e) {
+			bytes += e.size
+			total -= e.size
+			entries--
+			free += e.size // estimate: the space may not be freed until the copy is closed
+		}
+	}
+	return bytes, nil
+}
+
+// EvictionPlan returns the cached copies that eviction would remove
+// to bring the cache within its current limits (see SetMaxData,
+// SetMaxEntries, and SetMinFreeDisk), in the order it would remove them
+// (see SetEvictionPolicy), and the total bytes they occupy.
+// EvictionPlan removes nothing. Eviction skips copies another client
+// has locked at the time, which EvictionPlan cannot predict;
+// otherwise, given the same cache contents, the plan matches what
+// eviction does.
+func (c *Cache) EvictionPlan() ([]CacheEntry, int64, error) {
+	var plan []CacheEntry
+	bytes, err := c.planEviction(0, 0, func(de *diskEntry) bool {
+		prefix := de.prefix
+		meta, _, err := peekMeta(prefix)
+		if err != nil || meta.Pinned || meta.Override || c.isHeld(prefix) {
+			return false
+		}
+		e, err := c.stat(meta.Path, prefix)
+		if os.IsNotExist(err) {
+			// A partial copy.
+			e, err = &CacheEntry{Path: meta.Path, Size: de.size, LastUsed: de.used, Partial: true}, nil
+		}
+		if err != nil {
+			return false
+		}
+		plan = append(plan, *e)
+		return true
+	})
+	return plan, bytes, err
+}
+
+// evict removes the cached copy for prefix, reporting whether it did.
+// It skips pinned entries and entries held by OpenReaderAt,
+// as well as entries another client has locked, since those are in use.
+func (c *Cache) evict(prefix string) bool {
+	if c.isHeld(prefix) {
+		return false
+	}
+	metaFile, err := c.tryMetaLock(prefix)
+	if err != nil {
+		return false
+	}
+	defer metaFile.Close()
+	meta, err := readMeta(metaFile)
+	if err != nil || meta.Pinned || meta.Override {
+		return false
+	}
+	if c.removeEntry(prefix) != nil {
+		return false
+	}
+	metaFile.Close()
+	c.pruneDir(prefix)
+	return true
+}
+
+// DeleteExpired deletes the cache entries whose copies have expired,
+// returning the number of entries deleted. A partial copy made by
+// OpenRange or left by an interrupted download expires one expiration
+// period after it was last extended.
+// It skips pinned entries and entries held by OpenReaderAt,
+// as well as entries another client has locked, since those are being
+// loaded or revalidated.
+// Deleting expired copies reclaims their space but also
+// removes copies that could be served under SetStaleIfError.
+func (c *Cache) DeleteExpired() (int, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	d := c.expiration()
+	n := 0
+	err := c.walk(func(prefix string) error {
+		if c.deleteIfExpired(prefix, d, time.Now()) {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// deleteIfExpired deletes the entry for prefix if its copy has expired
+// as of now, given the expiration period d, reporting whether it did.
+func (c *Cache) deleteIfExpired(prefix string, d time.Duration, now time.Time) bool {
+	if c.isHeld(prefix) {
+		return false
+	}
+	metaFile, err := c.tryMetaLock(prefix)
+	if err != nil {
+		return false
+	}
+	defer metaFile.Close()
+	fi, err := metaFile.Stat()
+	if err != nil {
+		return false
+	}
+	modTime := fi.ModTime()
+	if _, err := os.Stat(prefix + ".data"); err != nil {
+		// A partial copy is never refreshed, so it expires
+		// as long after it was last extended.
+		nfi, err := os.Stat(prefix + ".next")
+		if err != nil {
+			return false
+		}
+		modTime = nfi.ModTime()
+	}
+	meta, err := readMeta(metaFile)
+	if err != nil || meta.Pinned || meta.Override || fresh(modTime, c.entryExpiration(meta, d), now) {
+		return false
+	}
+	if c.removeEntry(prefix) != nil {
+		return false
+	}
+	metaFile.Close()
+	c.pruneDir(prefix)
+	return true
+}
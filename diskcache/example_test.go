@@ -0,0 +1,37 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func ExampleLoaderFunc() {
+	dir, err := ioutil.TempDir("", "diskcache-example-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	load := func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		_, err := fmt.Fprintf(target, "contents of %s\n", path)
+		return false, nil, err
+	}
+	cache, err := diskcache.New(dir, diskcache.LoaderFunc(load))
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := cache.ReadFile("greeting.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s", data)
+	// Output: contents of /greeting.txt
+}
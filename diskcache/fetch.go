@@ -0,0 +1,67 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Fetch loads the file with the given path directly from the loader,
+// bypassing the cache: it neither uses nor updates any cached copy,
+// so content fetched for one client is never served to another.
+// Fetch is meant for content that must not be stored, such as
+// per-user responses.
+//
+// Fetch returns the loaded content as a temporary file, which is removed
+// from the file system before Fetch returns and disappears when closed,
+// along with the loader metadata for it (see LoadMeta).
+// The caller is responsible for closing the file.
+func (c *Cache) Fetch(path string) (f *os.File, meta []byte, err error) {
+	if c.readOnly {
+		return nil, nil, ErrReadOnly
+	}
+	path, _ = c.locate(path)
+	f, err = ioutil.TempFile(c.dir, "fetch-")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(f.Name())
+
+	cacheValid, meta, _, err := c.load(nil, path, f, nil)
+	if err == nil && cacheValid {
+		err = fmt.Errorf("diskcache: loader reported a valid copy of %s, but there is none", path)
+	}
+	if insp := c.getInspector(); insp != nil && err == nil {
+		f, err = c.inspectFetch(insp, path, f)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, meta, nil
+}
+
+// inspectFetch passes the content fetched into f through the inspector insp,
+// returning a new temporary file holding the result.
+// Whether or not it succeeds, inspectFetch closes f.
+func (c *Cache) inspectFetch(insp Inspector, path string, f *os.File) (*os.File, error) {
+	defer f.Close()
+	out, err := ioutil.TempFile(c.dir, "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(out.Name())
+	if _, err := inspect(insp, path, f, out); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// flock is syscall.Flock, replaced in tests.
+var flock = syscall.Flock
+
+// staleLockAge is the age after which a fallback lock file
+// is assumed to have been left by a client that crashed.
+const staleLockAge = 10 * time.Minute
+
+// warnNoFlock logs, once, that the cache is using fallback locks.
+var warnNoFlock sync.Once
+
+// A lockedFile is a .meta file locked by this client.
+// Closing it releases the lock.
+type lockedFile struct {
+	*os.File
+	lockName string // fallback lock file to remove on Close, if any
+}
+
+// Close releases the lock and closes the file.
+func (f *lockedFile) Close() error {
+	if f.lockName != "" {
+		os.Remove(f.lockName)
+		f.lockName = ""
+	}
+	return f.File.Close()
+}
+
+// flockUnsupported reports whether err, returned by flock,
+// means that the file system does not support flock at all,
+// as happens on some FUSE and NFS mounts.
+func flockUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOLCK)
+}
+
+// lockFile locks the open .meta file f for prefix as described by how,
+// which must include LOCK_EX. On error, the caller must close f.
+//
+// If the file system does not support flock, lockFile falls back to
+// creating prefix+".lock" exclusively, which the returned lockedFile
+// removes when closed. The fallback is weaker than flock: the kernel does
+// not release a lock file held by a client that crashes, so lockFile
+// breaks lock files older than staleLockAge, which may let two clients
+// proceed at once if one holds the lock that long.
+func lockFile(f *os.File, prefix string, how int) (*lockedFile, error) {
+	err := flock(int(f.Fd()), how)
+	if err == nil {
+		return &lockedFile{File: f}, nil
+	}
+	if !flockUnsupported(err) {
+		return nil, err
+	}
+	warnNoFlock.Do(func() {
+		log.Printf("diskcache: file system does not support flock (%v); using lock files, which are less reliable", err)
+	})
+	name := prefix + ".lock"
+	if err := lockFallback(name, how&syscall.LOCK_NB != 0); err != nil {
+		return nil, err
+	}
+	return &lockedFile{File: f, lockName: name}, nil
+}
+
+// lockFallback acquires the lock file name, waiting for another client
+// to release it unless nonblock is set, in which case it fails with
+// syscall.EWOULDBLOCK, as flock does.
+func lockFallback(name string, nonblock bool) error {
+	wait := 1 * time.Millisecond
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(name)
+			continue
+		}
+		if nonblock {
+			return syscall.EWOULDBLOCK
+		}
+		time.Sleep(wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1)))
+		if wait < 100*time.Millisecond {
+			wait *= 2
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// SetMinFreeDisk sets the minimum free space, in bytes, to maintain on the
+// file system holding the cache directory, which is useful when the cache
+// shares a disk with other programs. After installing a new copy,
+// if the space available to unprivileged users is below the minimum,
+// the cache removes the least recently used copies until the space
+// they occupied would restore it. Like the maximum data size limit,
+// the minimum is imposed in a best effort fashion.
+// A minimum of zero or less means no minimum.
+func (c *Cache) SetMinFreeDisk(bytes int64) {
+	atomic.StoreInt64(&c.atomicMinFree, bytes)
+}
+
+func (c *Cache) minFreeDisk() int64 {
+	return atomic.LoadInt64(&c.atomicMinFree)
+}
+
+// freeDisk returns the space available to unprivileged users
+// on the file system holding dir. It is a variable for testing.
+var freeDisk = func(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
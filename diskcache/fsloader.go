@@ -0,0 +1,179 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	pathpkg "path"
+	"strings"
+)
+
+// NewFSLoader returns a Loader that reads files from fsys,
+// which may be an embed.FS or any other fs.FS.
+// Cache paths are interpreted relative to the root of fsys.
+//
+// The loader uses a file's size and modification time as its validator:
+// a file whose size and modification time are unchanged is considered unchanged.
+// Since the content of an embed.FS never changes within a binary,
+// revalidation of its files always succeeds without rereading them.
+// The loader implements Lister and StatLoader.
+func NewFSLoader(fsys fs.FS) Loader {
+	return &fsLoader{fsys: fsys}
+}
+
+// NewHashingFSLoader is like NewFSLoader but uses a SHA-256 hash of
+// a file's content as its validator, for file systems where modification
+// times are unreliable, such as files restored from backup or rewritten
+// by build systems. A file whose size and modification time are unchanged
+// is still considered unchanged without reading it, but otherwise the
+// loader hashes the file, and a file whose content is unchanged
+// is considered unchanged. Hashing reads the whole file,
+// so revalidating a large file whose modification time changed is costly.
+func NewHashingFSLoader(fsys fs.FS) Loader {
+	return &fsLoader{fsys: fsys, hash: true}
+}
+
+type fsLoader struct {
+	fsys fs.FS
+	hash bool // validate by content hash; see NewHashingFSLoader
+}
+
+// fsName returns the fs.FS name for the cache path.
+func fsName(path string) string {
+	name := strings.TrimPrefix(CleanPath(path), "/")
+	if name == "" {
+		name = "."
+	}
+	return name
+}
+
+// fsValidator returns the validator the FS loader uses for a file with info fi.
+func fsValidator(fi fs.FileInfo) string {
+	t := fi.ModTime()
+	return fmt.Sprintf(`"%x-%x.%x"`, fi.Size(), t.Unix(), t.Nanosecond())
+}
+
+// hashValidator returns the validator the hashing FS loader uses
+// for a file with the given SHA-256 hash.
+func hashValidator(sum []byte) string {
+	return fmt.Sprintf(`"sha256-%x"`, sum)
+}
+
+// hashFile returns the hashing FS loader's validator for the named file.
+func (l *fsLoader) hashFile(name string) (string, error) {
+	f, err := l.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hashValidator(h.Sum(nil)), nil
+}
+
+func (l *fsLoader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	f, err := l.fsys.Open(fsName(path))
+	if err != nil {
+		return false, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, nil, err
+	}
+	if fi.IsDir() {
+		return false, nil, &os.PathError{Path: path, Op: "open", Err: os.ErrNotExist}
+	}
+
+	m := &LoadMeta{
+		ETag:         fsValidator(fi),
+		LastModified: fi.ModTime(),
+		ContentType:  mime.TypeByExtension(pathpkg.Ext(path)),
+		Size:         fi.Size(),
+	}
+	if l.hash {
+		return l.loadHashed(path, f, fi, target, m, meta)
+	}
+	if len(meta) > 0 && ParseLoadMeta(meta).ETag == m.ETag {
+		return true, m.Marshal(), nil
+	}
+	if _, err := io.Copy(target, f); err != nil {
+		return false, nil, err
+	}
+	return false, m.Marshal(), nil
+}
+
+// loadHashed implements Load for the hashing FS loader,
+// given the open file f with info fi and the new metadata m,
+// whose ETag loadHashed replaces with the content hash.
+func (l *fsLoader) loadHashed(path string, f fs.File, fi fs.FileInfo, target *os.File, m *LoadMeta, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	if len(meta) > 0 {
+		old := ParseLoadMeta(meta)
+		if old.Size == fi.Size() && old.LastModified.Equal(fi.ModTime()) {
+			return true, meta, nil
+		}
+		etag, err := l.hashFile(fsName(path))
+		if err != nil {
+			return false, nil, err
+		}
+		m.ETag = etag
+		if old.ETag == etag {
+			return true, m.Marshal(), nil
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(target, h), f); err != nil {
+		return false, nil, err
+	}
+	m.ETag = hashValidator(h.Sum(nil))
+	return false, m.Marshal(), nil
+}
+
+func (l *fsLoader) Stat(path string) (ObjectInfo, error) {
+	fi, err := fs.Stat(l.fsys, fsName(path))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, &os.PathError{Path: path, Op: "stat", Err: os.ErrNotExist}
+	}
+	etag := fsValidator(fi)
+	if l.hash {
+		if etag, err = l.hashFile(fsName(path)); err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+	return ObjectInfo{
+		Size:         fi.Size(),
+		ContentType:  mime.TypeByExtension(pathpkg.Ext(path)),
+		ETag:         etag,
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (l *fsLoader) List(dir string) ([]ListEntry, error) {
+	dirs, err := fs.ReadDir(l.fsys, fsName(dir))
+	if err != nil {
+		return nil, err
+	}
+	var list []ListEntry
+	for _, d := range dirs {
+		e := ListEntry{Name: d.Name(), IsDir: d.IsDir()}
+		if !e.IsDir {
+			if fi, err := d.Info(); err == nil {
+				e.Size = fi.Size()
+			}
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFSLoader(t *testing.T) {
+	mtime := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"a.txt":     {Data: []byte("hello\n"), ModTime: mtime},
+		"dir/b.txt": {Data: []byte("world\n"), ModTime: mtime},
+	}
+	c, cleanup := newCache(t, NewFSLoader(fsys))
+	defer cleanup()
+
+	if data := readFile(t, c, "a.txt"); string(data) != "hello\n" {
+		t.Fatalf("read a.txt = %q, want %q", data, "hello\n")
+	}
+	if data := readFile(t, c, "/dir/b.txt"); string(data) != "world\n" {
+		t.Fatalf("read /dir/b.txt = %q, want %q", data, "world\n")
+	}
+
+	// Same size and modification time: revalidation keeps the cached copy.
+	fsys["a.txt"].Data = []byte("HELLO\n")
+	c.Expire("a.txt")
+	if data := readFile(t, c, "a.txt"); string(data) != "hello\n" {
+		t.Fatalf("revalidated read a.txt = %q, want %q", data, "hello\n")
+	}
+
+	// New modification time: revalidation reloads.
+	fsys["a.txt"].ModTime = mtime.Add(1 * time.Second)
+	c.Expire("a.txt")
+	if data := readFile(t, c, "a.txt"); string(data) != "HELLO\n" {
+		t.Fatalf("reloaded read a.txt = %q, want %q", data, "HELLO\n")
+	}
+
+	for _, name := range []string{"missing.txt", "dir", "/"} {
+		if _, err := c.Open(name); !os.IsNotExist(err) {
+			t.Errorf("Open(%q): %v, want not exist", name, err)
+		}
+	}
+}
+
+func TestHashingFSLoader(t *testing.T) {
+	mtime := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"a.txt": {Data: []byte("hello\n"), ModTime: mtime},
+	}
+	l := NewHashingFSLoader(fsys)
+	target, err := ioutil.TempFile("", "diskcache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(target.Name())
+	defer target.Close()
+
+	valid, meta, err := l.Load("/a.txt", target, nil)
+	if valid || err != nil {
+		t.Fatalf("first Load = %v, %v, want false, nil", valid, err)
+	}
+	etag := ParseLoadMeta(meta).ETag
+
+	// New modification time, same content: still valid.
+	fsys["a.txt"].ModTime = mtime.Add(1 * time.Hour)
+	valid, meta, err = l.Load("/a.txt", target, meta)
+	if !valid || err != nil {
+		t.Fatalf("Load after touch = %v, %v, want true, nil", valid, err)
+	}
+	if m := ParseLoadMeta(meta); m.ETag != etag || !m.LastModified.Equal(mtime.Add(1*time.Hour)) {
+		t.Fatalf("Load after touch: ETag %s, LastModified %v, want %s, %v", m.ETag, m.LastModified, etag, mtime.Add(1*time.Hour))
+	}
+
+	// Through a cache, touching the file keeps the cached copy,
+	// and changing it reloads.
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+	if data := readFile(t, c, "a.txt"); string(data) != "hello\n" {
+		t.Fatalf("read a.txt = %q, want %q", data, "hello\n")
+	}
+	fsys["a.txt"].ModTime = mtime.Add(2 * time.Hour)
+	c.Expire("a.txt")
+	e1, _ := c.Stat("a.txt")
+	if data := readFile(t, c, "a.txt"); string(data) != "hello\n" {
+		t.Fatalf("read touched a.txt = %q, want %q", data, "hello\n")
+	}
+	if e2, err := c.Stat("a.txt"); err != nil || !e2.CreateTime.Equal(e1.CreateTime) {
+		t.Fatalf("touched a.txt was reloaded")
+	}
+	fsys["a.txt"].Data = []byte("HELLO\n")
+	fsys["a.txt"].ModTime = mtime.Add(3 * time.Hour)
+	c.Expire("a.txt")
+	if data := readFile(t, c, "a.txt"); string(data) != "HELLO\n" {
+		t.Fatalf("read changed a.txt = %q, want %q", data, "HELLO\n")
+	}
+}
+
+func TestFSLoaderList(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/b.txt":     {Data: []byte("b")},
+		"dir/a.txt":     {Data: []byte("aaa")},
+		"dir/sub/c.txt": {Data: []byte("c")},
+	}
+	c, cleanup := newCache(t, NewFSLoader(fsys))
+	defer cleanup()
+
+	list, err := c.List("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ListEntry{
+		{Name: "a.txt", Size: 3},
+		{Name: "b.txt", Size: 1},
+		{Name: "sub", IsDir: true},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("List(dir) = %+v, want %+v", list, want)
+	}
+	if _, err := c.List("missing"); !os.IsNotExist(err) {
+		t.Errorf("List(missing): %v, want not exist", err)
+	}
+
+	c2, cleanup2 := newCache(t, LoaderFunc(loadHello))
+	defer cleanup2()
+	if _, err := c2.List("dir"); err != ErrNoList {
+		t.Errorf("List with non-Lister loader: %v, want ErrNoList", err)
+	}
+}
+
+func TestCacheFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":           {Data: []byte("hello\n")},
+		"dir/b.txt":       {Data: []byte("world\n")},
+		"dir/sub/c.txt":   {Data: []byte("nested\n")},
+		"other/d.txt":     {Data: []byte("other\n")},
+		"other/deep/x/e":  {Data: []byte("deep\n")},
+		"other/deep/y.go": {Data: []byte("package y\n")},
+	}
+	c, cleanup := newCache(t, NewFSLoader(fsys))
+	defer cleanup()
+
+	var walked []string
+	err := fs.WalkDir(c.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() != (d.Type() == fs.ModeDir) {
+			t.Errorf("%s: IsDir() = %v but Type() = %v", path, d.IsDir(), d.Type())
+		}
+		if d.IsDir() {
+			path += "/"
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"./",
+		"a.txt",
+		"dir/",
+		"dir/b.txt",
+		"dir/sub/",
+		"dir/sub/c.txt",
+		"other/",
+		"other/d.txt",
+		"other/deep/",
+		"other/deep/x/",
+		"other/deep/x/e",
+		"other/deep/y.go",
+	}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("WalkDir visited:\n%q\nwant:\n%q", walked, want)
+	}
+
+	data, err := fs.ReadFile(c.FS(), "dir/sub/c.txt")
+	if err != nil || string(data) != "nested\n" {
+		t.Errorf("ReadFile(dir/sub/c.txt) = %q, %v, want %q", data, err, "nested\n")
+	}
+	fi, err := fs.Stat(c.FS(), "dir/sub")
+	if err != nil || !fi.IsDir() || fi.Name() != "sub" {
+		t.Errorf("Stat(dir/sub) = %v, %v, want directory named sub", fi, err)
+	}
+	fi, err = fs.Stat(c.FS(), "dir/b.txt")
+	if err != nil || fi.IsDir() || fi.Name() != "b.txt" || fi.Size() != 6 {
+		t.Errorf("Stat(dir/b.txt) = %v, %v, want 6-byte file named b.txt", fi, err)
+	}
+	if _, err := c.FS().Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(missing) = %v, want ErrNotExist", err)
+	}
+}
+
+// statCounter is an FS loader counting calls to Load and Stat.
+type statCounter struct {
+	StatLoader
+	loads, stats int
+}
+
+func (l *statCounter) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	l.loads++
+	return l.StatLoader.Load(path, target, meta)
+}
+
+func (l *statCounter) Stat(path string) (ObjectInfo, error) {
+	l.stats++
+	return l.StatLoader.Stat(path)
+}
+
+func TestOpenMeta(t *testing.T) {
+	mtime := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"video.mp4": {Data: []byte("0123456789"), ModTime: mtime},
+	}
+	l := &statCounter{StatLoader: NewFSLoader(fsys).(StatLoader)}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+	c.SetMetaExpiration(1 * time.Hour)
+
+	fi, err := fs.Stat(fsys, "video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ObjectInfo{Size: 10, ContentType: "video/mp4", ETag: fsValidator(fi), LastModified: mtime}
+	for i := 0; i < 3; i++ {
+		info, err := c.OpenMeta("video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info != want {
+			t.Fatalf("OpenMeta = %+v, want %+v", info, want)
+		}
+	}
+	if l.stats != 1 || l.loads != 0 {
+		t.Fatalf("after three OpenMeta calls: %d stats, %d loads, want 1, 0", l.stats, l.loads)
+	}
+	if cached(c, "video.mp4") {
+		t.Fatalf("OpenMeta cached file content")
+	}
+
+	// Expired information is refreshed with another Stat.
+	fsys["video.mp4"].Data = []byte("01234")
+	c.Expire("video.mp4#meta")
+	if info, err := c.OpenMeta("video.mp4"); err != nil || info.Size != 5 {
+		t.Fatalf("OpenMeta after change = %+v, %v, want size 5", info, err)
+	}
+	if l.stats != 2 || l.loads != 0 {
+		t.Fatalf("after refresh: %d stats, %d loads, want 2, 0", l.stats, l.loads)
+	}
+
+	if _, err := c.OpenMeta("missing"); !os.IsNotExist(err) {
+		t.Fatalf("OpenMeta(missing): %v, want not exist", err)
+	}
+	c2, cleanup2 := newCache(t, LoaderFunc(loadHello))
+	defer cleanup2()
+	if _, err := c2.OpenMeta("file"); err != ErrNoStat {
+		t.Fatalf("OpenMeta without StatLoader: %v, want ErrNoStat", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// inflight counts the loader invocations in progress.
+type inflight struct {
+	mu    sync.Mutex
+	n     int
+	opens int           // calls to open past the fast path, which may load and install
+	idle  chan struct{} // closed when n and opens drop to zero; nil if no waiters
+
+	installed chan struct{}    // closed when a copy is installed or an open ends; nil if no waiters
+	pending   map[string]int   // opens in progress and prefetches queued, by prefix
+	failed    map[string]error // error from the most recent failed open, by prefix
+}
+
+// maxFailed is the number of open errors remembered for WaitFor.
+const maxFailed = 1000
+
+// startLoad records the start of a loader invocation.
+func (c *Cache) startLoad() {
+	c.inflight.mu.Lock()
+	c.inflight.n++
+	c.inflight.mu.Unlock()
+}
+
+// endLoad records the end of a loader invocation.
+func (c *Cache) endLoad() {
+	c.inflight.mu.Lock()
+	c.inflight.n--
+	c.checkIdle()
+	c.inflight.mu.Unlock()
+}
+
+// startOpen records the start of an open of the entry for prefix
+// that may load and install a copy.
+func (c *Cache) startOpen(prefix string) {
+	c.inflight.mu.Lock()
+	c.inflight.opens++
+	c.addPending(prefix)
+	c.inflight.mu.Unlock()
+}
+
+// endOpen records the end of an open recorded by startOpen,
+// which returned err.
+func (c *Cache) endOpen(prefix string, err error) {
+	c.inflight.mu.Lock()
+	c.inflight.opens--
+	c.checkIdle()
+	c.donePending(prefix, err)
+	c.inflight.mu.Unlock()
+}
+
+// startPrefetch records that a prefetch of the entry for prefix is queued.
+func (c *Cache) startPrefetch(prefix string) {
+	c.inflight.mu.Lock()
+	c.addPending(prefix)
+	c.inflight.mu.Unlock()
+}
+
+// endPrefetch records the end of a prefetch recorded by startPrefetch.
+func (c *Cache) endPrefetch(prefix string, err error) {
+	c.inflight.mu.Lock()
+	c.donePending(prefix, err)
+	c.inflight.mu.Unlock()
+}
+
+// addPending records the start of a pending download for prefix.
+// The caller must hold c.inflight.mu.
+func (c *Cache) addPending(prefix string) {
+	if c.inflight.pending == nil {
+		c.inflight.pending = make(map[string]int)
+	}
+	c.inflight.pending[prefix]++
+}
+
+// donePending records the end of a pending download for prefix,
+// which returned err, and wakes the WaitFor calls.
+// The caller must hold c.inflight.mu.
+func (c *Cache) donePending(prefix string, err error) {
+	if c.inflight.pending[prefix]--; c.inflight.pending[prefix] <= 0 {
+		delete(c.inflight.pending, prefix)
+	}
+	if err == nil {
+		delete(c.inflight.failed, prefix)
+	} else {
+		if c.inflight.failed == nil {
+			c.inflight.failed = make(map[string]error)
+		}
+		if len(c.inflight.failed) >= maxFailed {
+			for p := range c.inflight.failed {
+				delete(c.inflight.failed, p)
+				break
+			}
+		}
+		c.inflight.failed[prefix] = err
+	}
+	if c.inflight.installed != nil {
+		close(c.inflight.installed)
+		c.inflight.installed = nil
+	}
+}
+
+// checkIdle wakes the WaitIdle calls if the cache is idle.
+// The caller must hold c.inflight.mu.
+func (c *Cache) checkIdle() {
+	if c.inflight.n == 0 && c.inflight.opens == 0 && c.inflight.idle != nil {
+		close(c.inflight.idle)
+		c.inflight.idle = nil
+	}
+}
+
+// InFlight returns the number of downloads in progress in this cache:
+// that is, the number of loader invocations that have not yet returned.
+// Downloads by other caches sharing the directory are not counted.
+func (c *Cache) InFlight() int {
+	c.inflight.mu.Lock()
+	defer c.inflight.mu.Unlock()
+	return c.inflight.n
+}
+
+// WaitIdle waits until no downloads are in progress in this cache,
+// or until ctx is done, in which case it returns ctx.Err().
+// A download is in progress until the open that started it has
+// installed the copy and returned, including an open abandoned
+// by OpenFast that continues in the background.
+// Downloads started after WaitIdle returns are not waited for,
+// so to drain a cache before shutdown, stop opening files first.
+// Once idle, WaitIdle also writes any uses of cached copies
+// not yet written to disk, as Close does.
+func (c *Cache) WaitIdle(ctx context.Context) error {
+	c.inflight.mu.Lock()
+	if c.inflight.n == 0 && c.inflight.opens == 0 {
+		c.inflight.mu.Unlock()
+		c.flushUsed()
+		return nil
+	}
+	if c.inflight.idle == nil {
+		c.inflight.idle = make(chan struct{})
+	}
+	idle := c.inflight.idle
+	c.inflight.mu.Unlock()
+
+	select {
+	case <-idle:
+		c.flushUsed()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyInstalled wakes the WaitFor calls waiting for
+// a cached copy to be installed.
+func (c *Cache) notifyInstalled() {
+	c.inflight.mu.Lock()
+	if c.inflight.installed != nil {
+		close(c.inflight.installed)
+		c.inflight.installed = nil
+	}
+	c.inflight.mu.Unlock()
+}
+
+// WaitFor waits until the cache holds a copy of the file with
+// the given path, or until ctx is done, in which case it returns ctx.Err().
+// If the file is already cached, WaitFor returns immediately.
+// WaitFor does not load the file itself: it is meant for waiting
+// on a download started elsewhere, such as by Prefetch.
+// If the most recent download of the file in this cache failed
+// and no other download of it is in progress or queued,
+// WaitFor returns that download's error.
+// It is woken by downloads in this cache; a copy installed
+// by another cache sharing the directory is noticed only when
+// this cache installs a copy of some file.
+func (c *Cache) WaitFor(ctx context.Context, path string) error {
+	_, prefix := c.locate(path)
+	for {
+		c.inflight.mu.Lock()
+		if c.inflight.installed == nil {
+			c.inflight.installed = make(chan struct{})
+		}
+		installed := c.inflight.installed
+		pending := c.inflight.pending[prefix]
+		failed := c.inflight.failed[prefix]
+		c.inflight.mu.Unlock()
+
+		if _, err := os.Stat(prefix + ".data"); err == nil {
+			return nil
+		}
+		if pending == 0 && failed != nil {
+			return failed
+		}
+		select {
+		case <-installed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
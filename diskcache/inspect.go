@@ -0,0 +1,87 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrRejected is wrapped by the errors the cache returns
+// when the inspector set by SetInspector rejects a file.
+var ErrRejected = errors.New("diskcache: file rejected by inspector")
+
+// An Inspector examines the content of a newly loaded file before the cache
+// installs it, for example to scan it for malware. It is called with
+// the file's path and a reader of its content and returns a reader of
+// the content to install, which may be r itself or a transformation of it.
+// To reject the file, the inspector returns an error, either from
+// the call itself or from reading the returned reader.
+type Inspector func(path string, r io.Reader) (io.Reader, error)
+
+// SetInspector sets an inspector through which the cache passes
+// the content of each file it loads, including files loaded by Fetch,
+// before installing or returning it. Copies that the loader reports
+// still valid are not inspected again.
+// If the inspector rejects a file, the cache discards the new content,
+// keeping any earlier copy on disk, and the Open or Fetch returns
+// an error satisfying errors.Is(err, ErrRejected) that also wraps
+// the inspector's error.
+// Since an inspector needs the entire content, OpenRange loads
+// entire files while an inspector is set.
+// If f is nil (the default), content is installed as loaded.
+func (c *Cache) SetInspector(f Inspector) {
+	c.mu.Lock()
+	c.inspector = f
+	c.mu.Unlock()
+}
+
+func (c *Cache) getInspector() Inspector {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inspector
+}
+
+// inspect passes the loaded content in src, for the file with the
+// given path, through the inspector f, writing the result to dst
+// and returning its SHA-256 checksum.
+func inspect(f Inspector, path string, src, dst *os.File) (sum []byte, err error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, err := f(path, src)
+	if err == nil {
+		h := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(dst, h), r); err == nil {
+			return h.Sum(nil), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s: %w", ErrRejected, path, err)
+}
+
+// inspectNext passes the content loaded into next, the .next file
+// for prefix, through the inspector f, replacing the .next file with
+// the result, which it returns along with its SHA-256 checksum.
+// Whether or not it succeeds, inspectNext closes next.
+func (c *Cache) inspectNext(f Inspector, path, prefix string, next *os.File) (*os.File, []byte, error) {
+	defer next.Close()
+	scan, err := os.OpenFile(prefix+".scan", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum, err := inspect(f, path, next, scan)
+	if err == nil {
+		err = os.Rename(prefix+".scan", prefix+".next")
+	}
+	if err != nil {
+		scan.Close()
+		os.Remove(prefix + ".scan")
+		return nil, nil, err
+	}
+	return scan, sum, nil
+}
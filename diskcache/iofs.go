@@ -0,0 +1,149 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"time"
+)
+
+// FS returns the cached files as an fs.FS, which can be used with
+// fs.WalkDir, template.ParseFS, and similar functions.
+// Opening a file opens it as Open does. Directories are available only
+// if the cache's loader implements Lister: the returned file system
+// implements fs.ReadDirFS using List, and its directory entries report
+// each listed entry as a directory or a file as the listing does,
+// such as for object store prefixes and objects.
+// Like List, directory listings are not cached.
+func (c *Cache) FS() fs.FS {
+	return &cacheFS{c}
+}
+
+type cacheFS struct {
+	c *Cache
+}
+
+func (fsys *cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		f, err := fsys.c.Open(name)
+		if err == nil {
+			return &cacheFile{f, pathpkg.Base(name)}, nil
+		}
+		if _, ok := fsys.c.getLoader().(Lister); !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	// Not a file, but might be a directory.
+	list, err := fsys.c.List(name)
+	if err != nil || len(list) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &cacheDir{name: pathpkg.Base(name), list: dirEntries(list)}, nil
+}
+
+func (fsys *cacheFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	list, err := fsys.c.List(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return dirEntries(list), nil
+}
+
+// dirEntries converts a listing, which List sorts by name, to directory entries.
+func dirEntries(list []ListEntry) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(list))
+	for i, e := range list {
+		entries[i] = &listInfo{e}
+	}
+	return entries
+}
+
+// A cacheFile is an opened cached file, reporting the file's base name
+// in Stat instead of the name of the cached copy.
+type cacheFile struct {
+	*os.File
+	name string
+}
+
+func (f *cacheFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &namedInfo{fi, f.name}, nil
+}
+
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *namedInfo) Name() string { return fi.name }
+
+// A cacheDir is an opened directory, whose entries come from a listing.
+type cacheDir struct {
+	name string
+	list []fs.DirEntry
+}
+
+func (d *cacheDir) Stat() (fs.FileInfo, error) { return &dirInfo{d.name}, nil }
+func (d *cacheDir) Close() error               { return nil }
+
+func (d *cacheDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *cacheDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 || n > len(d.list) {
+		if n > 0 && len(d.list) == 0 {
+			return nil, io.EOF
+		}
+		n = len(d.list)
+	}
+	list := d.list[:n]
+	d.list = d.list[n:]
+	return list, nil
+}
+
+// A listInfo is a listing entry, as both an fs.DirEntry and an fs.FileInfo.
+type listInfo struct {
+	e ListEntry
+}
+
+func (fi *listInfo) Name() string               { return fi.e.Name }
+func (fi *listInfo) Size() int64                { return fi.e.Size }
+func (fi *listInfo) ModTime() time.Time         { return time.Time{} }
+func (fi *listInfo) IsDir() bool                { return fi.e.IsDir }
+func (fi *listInfo) Sys() interface{}           { return nil }
+func (fi *listInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *listInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi *listInfo) Mode() fs.FileMode {
+	if fi.e.IsDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// A dirInfo describes a directory with no other known attributes.
+type dirInfo struct {
+	name string
+}
+
+func (fi *dirInfo) Name() string       { return fi.name }
+func (fi *dirInfo) Size() int64        { return 0 }
+func (fi *dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (fi *dirInfo) ModTime() time.Time { return time.Time{} }
+func (fi *dirInfo) IsDir() bool        { return true }
+func (fi *dirInfo) Sys() interface{}   { return nil }
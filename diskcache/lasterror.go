@@ -0,0 +1,43 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"os"
+	"time"
+)
+
+// LastError returns the message and time of the most recent error
+// loading the file with the given path, without invoking the loader.
+// A successful load clears the recorded error. If no error is recorded,
+// LastError returns ok == false. The error is recorded even if there is
+// no cached copy of the file, so LastError reports why a file
+// that has never loaded successfully keeps failing.
+func (c *Cache) LastError(path string) (msg string, t time.Time, ok bool) {
+	_, prefix := c.locate(path)
+	meta, _, err := peekMeta(prefix)
+	if err != nil || meta.LastError == "" {
+		return "", time.Time{}, false
+	}
+	return meta.LastError, meta.LastErrorTime, true
+}
+
+// recordError records err as the most recent error loading path,
+// whose .meta file for prefix the caller has locked and read as meta.
+// It preserves mtime as the .meta file's modification time,
+// which records when the copy, if any, was last refreshed.
+// Errors recording the error are ignored: the record is only diagnostic.
+func (c *Cache) recordError(prefix, path string, meta *metaDisk, mtime time.Time, err error) {
+	meta.LastError = err.Error()
+	meta.LastErrorTime = time.Now()
+	meta.LastStatus = errorStatus(err)
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+		meta.Path = path
+	}
+	if c.writeMeta(prefix, meta) == nil {
+		os.Chtimes(prefix+".meta", mtime, mtime)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"sort"
+)
+
+// A ListEntry describes a file or directory in a remote directory listing.
+type ListEntry struct {
+	Name  string // base name
+	IsDir bool   // entry is a directory
+	Size  int64  // size of file, if known
+}
+
+// A Lister is a Loader that can also list the contents of remote directories.
+//
+// The List method returns the entries in the remote directory dir.
+// It returns an error satisfying os.IsNotExist if there is no such directory.
+// As in Load, the elements in dir are separated by slash characters.
+type Lister interface {
+	Loader
+	List(dir string) ([]ListEntry, error)
+}
+
+// ErrNoList is the error returned by List when the cache's loader
+// does not implement Lister.
+var ErrNoList = errors.New("diskcache: loader does not support listing")
+
+// List returns the entries in the remote directory dir, sorted by name.
+// It requires the cache's loader to implement Lister.
+// Listings are not cached: each call invokes the loader.
+func (c *Cache) List(dir string) ([]ListEntry, error) {
+	l, ok := c.getLoader().(Lister)
+	if !ok {
+		return nil, ErrNoList
+	}
+	list, err := l.List(CleanPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
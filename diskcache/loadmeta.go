@@ -0,0 +1,162 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"os"
+	"time"
+)
+
+// loadMetaVersion is the current LoadMeta encoding version.
+const loadMetaVersion = 1
+
+// A LoadMeta is a structured form of the metadata a Loader returns from Load.
+// The cache treats loader metadata as opaque bytes, but loaders that need
+// more than a single validator can use LoadMeta to encode several validators
+// and attributes of the remote file in a common, versioned format.
+//
+// When revalidating, a loader holding both validators should send both;
+// following HTTP semantics, the ETag takes precedence over LastModified.
+type LoadMeta struct {
+	Version      int
+	ETag         string `json:",omitempty"`
+	LastModified time.Time
+	ContentType  string `json:",omitempty"`
+	Size         int64  `json:",omitempty"`
+
+	// ContentEncoding is the content coding applied to the cached bytes,
+	// such as "gzip", as for an HTTP Content-Encoding header.
+	// It is empty if the cached bytes are the file content itself.
+	ContentEncoding string `json:",omitempty"`
+
+	// MustRevalidate records that the file must not be served
+	// once expired without a successful revalidation,
+	// as for an HTTP response with Cache-Control: must-revalidate.
+	// In particular, the cache never serves such a file
+	// under the stale-if-error policy set by SetStaleIfError.
+	MustRevalidate bool `json:",omitempty"`
+
+	// MaxAge is the lifetime the origin advertised for the file,
+	// as for an HTTP Cache-Control max-age directive. If positive,
+	// it replaces the cache's expiration period for this copy.
+	// If negative, the origin allows no caching without revalidation,
+	// as with max-age=0 or no-cache, and the copy expires at once,
+	// subject to the minimum set by Cache.SetMinExpiration.
+	// Zero means the origin advertised no lifetime.
+	MaxAge time.Duration `json:",omitempty"`
+
+	// NoStore records that the origin forbids keeping the file,
+	// as for an HTTP response with Cache-Control: no-store.
+	// The cache then revalidates the copy on every use,
+	// regardless of Cache.SetMinExpiration.
+	NoStore bool `json:",omitempty"`
+
+	// Cost is the relative cost of loading the file again, for use by
+	// eviction policies such as CostAware. Zero means the default cost, 1.
+	// A loader might record a higher cost for files that are slow
+	// or expensive to produce, such as large renders.
+	Cost float64 `json:",omitempty"`
+
+	// Header holds response headers to replay verbatim when serving
+	// the file, such as Content-Disposition, keyed by canonical header name.
+	// Loaders record only headers they are configured to capture
+	// (see CaptureHeaders), never volatile ones like Date.
+	Header map[string]string `json:",omitempty"`
+}
+
+// CaptureHeaders records in m.Header the values in h of the headers
+// with the given names, which are matched without regard to case.
+// Headers missing from h are not recorded. The type of h matches
+// http.Header, so a loader can pass a response's headers directly.
+func (m *LoadMeta) CaptureHeaders(h map[string][]string, names []string) {
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if v := h[name]; len(v) > 0 {
+			if m.Header == nil {
+				m.Header = make(map[string]string)
+			}
+			m.Header[name] = v[0]
+		}
+	}
+}
+
+// ParseLoadMeta parses loader metadata previously returned by LoadMeta.Marshal.
+// For compatibility with loaders that stored a bare ETag as their metadata,
+// metadata that is not a versioned LoadMeta encoding is taken to be an ETag.
+// ParseLoadMeta never fails: empty metadata yields an empty LoadMeta.
+func ParseLoadMeta(meta []byte) *LoadMeta {
+	m := new(LoadMeta)
+	if len(meta) == 0 {
+		return m
+	}
+	if meta[0] == '{' && json.Unmarshal(meta, m) == nil && m.Version >= 1 {
+		return m
+	}
+	return &LoadMeta{ETag: string(meta)}
+}
+
+// Marshal returns the encoding of m, suitable for returning from Load
+// and for parsing with ParseLoadMeta.
+func (m *LoadMeta) Marshal() []byte {
+	m.Version = loadMetaVersion
+	js, err := json.Marshal(m)
+	if err != nil {
+		// Cannot happen: LoadMeta contains only marshalable fields.
+		panic("diskcache: marshaling LoadMeta: " + err.Error())
+	}
+	return js
+}
+
+// Validator returns the validators recorded for the cached copy
+// of the file with the given path, without invoking the loader:
+// the ETag and Last-Modified time from the copy's loader metadata
+// (see ParseLoadMeta). The ETag is returned as recorded, including quotes,
+// so it can be sent in an ETag header as is.
+// If there is no cached copy, or the copy has neither validator,
+// Validator returns ok == false.
+func (c *Cache) Validator(path string) (etag string, lastModified time.Time, ok bool, err error) {
+	e, err := c.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", time.Time{}, false, nil
+		}
+		return "", time.Time{}, false, err
+	}
+	m := ParseLoadMeta(e.Meta)
+	if m.ETag == "" && m.LastModified.IsZero() {
+		return "", time.Time{}, false, nil
+	}
+	return m.ETag, m.LastModified, true, nil
+}
+
+// OpenIfModified is like Open but takes the ETag of a copy of the file
+// the caller already holds, such as one returned earlier by Validator.
+// After Open loads or revalidates the file as needed, if the cached copy's
+// ETag equals knownETag, OpenIfModified returns (nil, false, nil),
+// meaning the caller's copy is current. Otherwise it returns
+// the opened file and modified == true. An empty knownETag
+// matches nothing. ETags are compared exactly, including quotes.
+func (c *Cache) OpenIfModified(path, knownETag string) (f *os.File, modified bool, err error) {
+	f, err = c.Open(path)
+	if err != nil || knownETag == "" {
+		return f, err == nil, err
+	}
+	_, prefix := c.locate(path)
+	meta, _, err := peekMeta(prefix)
+	if err != nil || ParseLoadMeta(meta.Load).ETag != knownETag {
+		return f, true, nil
+	}
+	// Make sure the metadata describes the copy we opened,
+	// not one installed since.
+	fi1, err1 := f.Stat()
+	fi2, err2 := os.Stat(prefix + ".data")
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		return f, true, nil
+	}
+	f.Close()
+	return nil, false, nil
+}
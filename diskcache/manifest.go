@@ -0,0 +1,154 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// manifestName is the name of the manifest file in the cache root directory.
+const manifestName = "manifest"
+
+// SetManifest sets whether the cache records the path of each new entry
+// in a manifest file in the cache root directory. The manifest makes it
+// possible to tell which path a group of cache files holds, for recovery
+// or auditing, even if the entry's .meta file is lost or damaged.
+//
+// Each line of the manifest gives the entry's file name prefix,
+// relative to the cache root directory, a tab, and the Go-quoted path:
+//
+//	123/45678901234567890	"/dir/file"
+//
+// The manifest is only appended to; Sweep removes lines for deleted entries.
+// The default is not to write a manifest.
+func (c *Cache) SetManifest(enabled bool) {
+	c.mu.Lock()
+	c.manifest = enabled
+	c.mu.Unlock()
+}
+
+func (c *Cache) manifestEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.manifest
+}
+
+// openManifest opens the manifest file with the given flags
+// and locks it as described by how. Because Sweep replaces the manifest,
+// openManifest checks that the file it locked is still the manifest.
+func (c *Cache) openManifest(flag, how int) (*os.File, error) {
+	name := filepath.Join(c.dir, manifestName)
+	for {
+		f, err := os.OpenFile(name, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock(int(f.Fd()), how); err != nil && !flockUnsupported(err) {
+			f.Close()
+			return nil, err
+		}
+		fi1, err1 := f.Stat()
+		fi2, err2 := os.Stat(name)
+		if err1 == nil && err2 == nil && os.SameFile(fi1, fi2) {
+			return f, nil
+		}
+		f.Close()
+		if err1 != nil {
+			return nil, err1
+		}
+	}
+}
+
+// recordManifest appends a line for the entry for path,
+// with file name prefix, to the manifest, if enabled.
+// Errors are ignored: the manifest is only an aid to recovery.
+func (c *Cache) recordManifest(prefix, path string) {
+	if !c.manifestEnabled() {
+		return
+	}
+	rel, err := filepath.Rel(c.dir, prefix)
+	if err != nil {
+		return
+	}
+	f, err := c.openManifest(os.O_WRONLY|os.O_APPEND|os.O_CREATE, syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\t%s\n", filepath.ToSlash(rel), strconv.Quote(path))
+}
+
+// Sweep performs routine maintenance of the cache directory.
+// Currently, it compacts the manifest written under SetManifest,
+// removing lines for deleted entries and duplicate lines,
+// and removes empty subdirectories, as Compact does.
+func (c *Cache) Sweep() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if err := c.compactManifest(); err != nil {
+		return err
+	}
+	_, err := c.Compact()
+	return err
+}
+
+// compactManifest rewrites the manifest to contain one line
+// for each entry that still exists.
+func (c *Cache) compactManifest() error {
+	f, err := c.openManifest(os.O_RDONLY, syscall.LOCK_EX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		rel, quoted, ok := strings.Cut(s.Text(), "\t")
+		if !ok {
+			continue // damaged line
+		}
+		if _, err := os.Stat(filepath.Join(c.dir, filepath.FromSlash(rel)) + ".meta"); err != nil {
+			delete(paths, rel)
+			continue
+		}
+		paths[rel] = quoted
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	var rels []string
+	for rel := range paths {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var buf bytes.Buffer
+	for _, rel := range rels {
+		fmt.Fprintf(&buf, "%s\t%s\n", rel, paths[rel])
+	}
+
+	// Write the new manifest and rename it into place
+	// while holding the lock on the old one.
+	tmp := filepath.Join(c.dir, manifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, manifestName))
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// A MetaCodec is an encoding for the .meta files in a cache directory.
+// The available codecs are JSONMeta and BinaryMeta,
+// either of which can be wrapped by GzipMeta.
+//
+// A cache reads .meta files in any of the encodings, detecting the encoding
+// from the file content, and writes them in the encoding selected by
+// SetMetaCodec. Switching codecs, or sharing a directory between caches
+// using different codecs, is therefore safe: each .meta file is converted
+// to the new encoding the next time it is written.
+type MetaCodec interface {
+	encode(meta *metaDisk) ([]byte, error)
+}
+
+var (
+	// JSONMeta encodes metadata as JSON, which is easy to inspect.
+	// It is the default.
+	JSONMeta MetaCodec = jsonCodec{}
+
+	// BinaryMeta encodes metadata in a compact binary form,
+	// which is faster to encode and decode than JSON
+	// but not human-readable.
+	BinaryMeta MetaCodec = binaryCodec{}
+)
+
+// SetMetaCodec sets the codec used to write .meta files.
+// If codec is nil, the cache uses JSONMeta.
+func (c *Cache) SetMetaCodec(codec MetaCodec) {
+	c.mu.Lock()
+	c.metaCodec = codec
+	c.mu.Unlock()
+}
+
+func (c *Cache) getMetaCodec() MetaCodec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metaCodec == nil {
+		return JSONMeta
+	}
+	return c.metaCodec
+}
+
+// decodeMeta decodes metadata in any supported encoding.
+// JSON-encoded metadata always begins with '{';
+// binary-encoded metadata begins with binaryTag;
+// gzip-compressed metadata begins with the gzip magic number.
+func decodeMeta(data []byte) (*metaDisk, error) {
+	meta := new(metaDisk)
+	if len(data) == 0 {
+		return meta, nil
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(data, gzipMagic) {
+			return nil, fmt.Errorf("nested gzip encoding")
+		}
+		return decodeMeta(data)
+	}
+	var err error
+	switch data[0] {
+	case '{':
+		err = json.Unmarshal(data, meta)
+	case binaryTag:
+		err = decodeBinary(data[1:], meta)
+	default:
+		err = fmt.Errorf("unknown encoding")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// gzipMagic is the magic number beginning every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// GzipMeta returns a codec that encodes metadata using codec
+// and gzip-compresses encodings longer than minSize bytes.
+// Compression saves space for entries with large metadata,
+// such as many annotations or recorded headers,
+// at the cost of slower encoding and decoding.
+func GzipMeta(codec MetaCodec, minSize int) MetaCodec {
+	return gzipCodec{codec, minSize}
+}
+
+type gzipCodec struct {
+	codec   MetaCodec
+	minSize int
+}
+
+func (c gzipCodec) encode(meta *metaDisk) ([]byte, error) {
+	data, err := c.codec.encode(meta)
+	if err != nil || len(data) <= c.minSize {
+		return data, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(meta *metaDisk) ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+// The binary encoding is binaryTag followed by a sequence of fields,
+// each a uvarint field number, a uvarint length, and that many bytes
+// of field value. Decoders skip fields with unknown numbers, so that
+// newer versions of the package can add fields that older versions ignore.
+// A string or byte slice field's value is the bytes themselves,
+// and a boolean field's value is empty; strings within a value holding
+// several are a uvarint length followed by the bytes.
+// Integers and durations are varints; times are varint Unix seconds
+// followed by uvarint nanoseconds.
+// Zero-valued fields are omitted, but empty non-nil byte slices are not.
+const binaryTag = 0x01
+
+// Field numbers in the binary encoding. Never reuse a number.
+const (
+	binPath = 1 + iota
+	binCreateTime
+	binRefreshTime
+	binLoad
+	binPinned
+	binAnnotation // one per annotation: key, value
+	binExpiration
+	binNextRange // one per range: offset, end
+	binNextSize
+	binNextLoad
+	binOverride
+	binSum
+	binLastError
+	binLastErrorTime
+	binLastStatus
+)
+
+var errBinaryMeta = errors.New("malformed binary metadata")
+
+type binaryCodec struct{}
+
+func (binaryCodec) encode(meta *metaDisk) ([]byte, error) {
+	b := make([]byte, 1, 128)
+	b[0] = binaryTag
+	var v []byte // value of the field being encoded
+	field := func(n int) {
+		b = binary.AppendUvarint(b, uint64(n))
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+		v = v[:0]
+	}
+	str := func(s string) {
+		v = binary.AppendUvarint(v, uint64(len(s)))
+		v = append(v, s...)
+	}
+	bytes := func(n int, x []byte) {
+		if x != nil {
+			v = append(v, x...)
+			field(n)
+		}
+	}
+	tm := func(n int, t time.Time) {
+		if !t.IsZero() {
+			v = binary.AppendVarint(v, t.Unix())
+			v = binary.AppendUvarint(v, uint64(t.Nanosecond()))
+			field(n)
+		}
+	}
+	integer := func(n int, x int64) {
+		if x != 0 {
+			v = binary.AppendVarint(v, x)
+			field(n)
+		}
+	}
+
+	if meta.Path != "" {
+		v = append(v, meta.Path...)
+		field(binPath)
+	}
+	tm(binCreateTime, meta.CreateTime)
+	tm(binRefreshTime, meta.RefreshTime)
+	bytes(binLoad, meta.Load)
+	if meta.Pinned {
+		field(binPinned)
+	}
+	keys := make([]string, 0, len(meta.Annotations))
+	for k := range meta.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		str(k)
+		str(meta.Annotations[k])
+		field(binAnnotation)
+	}
+	integer(binExpiration, int64(meta.Expiration))
+	for _, r := range meta.NextRanges {
+		v = binary.AppendVarint(v, r.Off)
+		v = binary.AppendVarint(v, r.End)
+		field(binNextRange)
+	}
+	integer(binNextSize, meta.NextSize)
+	bytes(binNextLoad, meta.NextLoad)
+	if meta.Override {
+		field(binOverride)
+	}
+	bytes(binSum, meta.Sum)
+	if meta.LastError != "" {
+		v = append(v, meta.LastError...)
+		field(binLastError)
+	}
+	tm(binLastErrorTime, meta.LastErrorTime)
+	integer(binLastStatus, int64(meta.LastStatus))
+	return b, nil
+}
+
+func decodeBinary(b []byte, meta *metaDisk) error {
+	bad := false
+	uvarint := func(b *[]byte) uint64 {
+		x, n := binary.Uvarint(*b)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		*b = (*b)[n:]
+		return x
+	}
+
+	var v []byte // value of the field being decoded
+	varint := func() int64 {
+		x, n := binary.Varint(v)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		v = v[n:]
+		return x
+	}
+	str := func() string {
+		n := uvarint(&v)
+		if bad || n > uint64(len(v)) {
+			bad = true
+			return ""
+		}
+		s := string(v[:n])
+		v = v[n:]
+		return s
+	}
+	tm := func() time.Time {
+		sec := varint()
+		nsec := uvarint(&v)
+		return time.Unix(sec, int64(nsec)).UTC()
+	}
+
+	for len(b) > 0 && !bad {
+		num := uvarint(&b)
+		n := uvarint(&b)
+		if bad || n > uint64(len(b)) {
+			bad = true
+			break
+		}
+		v, b = b[:n], b[n:]
+		switch num {
+		case binPath:
+			meta.Path = string(v)
+		case binCreateTime:
+			meta.CreateTime = tm()
+		case binRefreshTime:
+			meta.RefreshTime = tm()
+		case binLoad:
+			meta.Load = append([]byte{}, v...)
+		case binPinned:
+			meta.Pinned = true
+		case binAnnotation:
+			key, val := str(), str()
+			if meta.Annotations == nil {
+				meta.Annotations = make(map[string]string)
+			}
+			meta.Annotations[key] = val
+		case binExpiration:
+			meta.Expiration = time.Duration(varint())
+		case binNextRange:
+			off, end := varint(), varint()
+			meta.NextRanges = append(meta.NextRanges, byteRange{off, end})
+		case binNextSize:
+			meta.NextSize = varint()
+		case binNextLoad:
+			meta.NextLoad = append([]byte{}, v...)
+		case binOverride:
+			meta.Override = true
+		case binSum:
+			meta.Sum = append([]byte{}, v...)
+		case binLastError:
+			meta.LastError = string(v)
+		case binLastErrorTime:
+			meta.LastErrorTime = tm()
+		case binLastStatus:
+			meta.LastStatus = int(varint())
+		default:
+			// A field added by a newer version. Skip it.
+		}
+	}
+	if bad {
+		return errBinaryMeta
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var codecs = []struct {
+	name  string
+	codec MetaCodec
+}{
+	{"json", JSONMeta},
+	{"binary", BinaryMeta},
+	{"gzip", GzipMeta(BinaryMeta, 0)},
+}
+
+func testMeta() *metaDisk {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	return &metaDisk{
+		Path:        "/dir/file",
+		CreateTime:  now,
+		RefreshTime: now.Add(time.Hour),
+		Load:        []byte(`{"Version":1,"ETag":"\"abc\""}`),
+		Pinned:      true,
+		Annotations: map[string]string{"owner": "web"},
+		Expiration:  5 * time.Minute,
+		NextRanges:  []byteRange{{0, 10}, {20, 30}},
+		NextSize:    100,
+		NextLoad:    []byte("v1"),
+		Override:    true,
+		Sum:         []byte{0x12, 0x34},
+
+		LastError:     "load /dir/file: 503 Service Unavailable",
+		LastErrorTime: now.Add(2 * time.Hour),
+		LastStatus:    503,
+	}
+}
+
+func TestMetaCodecRoundTrip(t *testing.T) {
+	// The binary codec must be updated when fields are added to metaDisk.
+	v := reflect.ValueOf(testMeta()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Fatalf("testMeta does not set metaDisk.%s", v.Type().Field(i).Name)
+		}
+	}
+
+	for _, tt := range codecs {
+		meta := testMeta()
+		data, err := tt.codec.encode(meta)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tt.name, err)
+		}
+		meta2, err := decodeMeta(data)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(meta, meta2) {
+			t.Errorf("%s: round trip:\nhave %+v\nwant %+v", tt.name, meta2, meta)
+		}
+	}
+}
+
+func TestBinaryMetaUnknownField(t *testing.T) {
+	// A field added by a newer version, before and after the known fields,
+	// is skipped rather than rejecting the whole entry.
+	data, err := BinaryMeta.encode(testMeta())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := []byte{100, 3, 'x', 'y', 'z'}
+	data = append(append([]byte{binaryTag}, unknown...), append(data[1:], unknown...)...)
+	meta, err := decodeMeta(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if want := testMeta(); !reflect.DeepEqual(meta, want) {
+		t.Errorf("decode:\nhave %+v\nwant %+v", meta, want)
+	}
+
+	// A truncated field is still an error.
+	if _, err := decodeMeta(data[:len(data)-1]); err == nil {
+		t.Errorf("decode of truncated metadata succeeded")
+	}
+}
+
+func TestSetMetaCodec(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+
+	// Entries written with one codec remain readable with another.
+	for _, tt := range codecs {
+		c.SetMetaCodec(tt.codec)
+		if err := c.SetAnnotation("file", "codec", tt.name); err != nil {
+			t.Fatal(err)
+		}
+		readFile(t, c, "file")
+		c.Expire("file")
+		if v, _ := c.Annotation("file", "codec"); v != tt.name {
+			t.Errorf("%s: annotation = %q, want %q", tt.name, v, tt.name)
+		}
+		_, prefix := c.locate("file")
+		data, err := os.ReadFile(prefix + ".meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]byte{"json": '{', "binary": binaryTag, "gzip": gzipMagic[0]}[tt.name]; data[0] != want {
+			t.Errorf("%s: .meta file begins with %#x, want %#x", tt.name, data[0], want)
+		}
+	}
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #4\n" {
+		t.Errorf("read file = %q, want fourth load", data)
+	}
+}
+
+func TestGzipMeta(t *testing.T) {
+	c, cleanup := newCache(t, LoaderFunc(loadHello))
+	defer cleanup()
+	c.SetMetaCodec(GzipMeta(JSONMeta, 512))
+	_, prefix := c.locate("file")
+	readMetaFile := func() []byte {
+		t.Helper()
+		data, err := os.ReadFile(prefix + ".meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Small metadata is not compressed.
+	readFile(t, c, "file")
+	if data := readMetaFile(); data[0] != '{' {
+		t.Fatalf("small .meta file begins with %#x, want JSON", data[0])
+	}
+
+	large := strings.Repeat("annotation value ", 100)
+	for i := 0; i < 10; i++ {
+		if err := c.SetAnnotation("file", fmt.Sprint("key", i), large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := readMetaFile()
+	if !bytes.HasPrefix(data, gzipMagic) || len(data) >= len(large) {
+		t.Fatalf("large .meta file is %d bytes beginning with %#x, want gzip-compressed", len(data), data[:2])
+	}
+	for i := 0; i < 10; i++ {
+		if v, _ := c.Annotation("file", fmt.Sprint("key", i)); v != large {
+			t.Fatalf("annotation key%d = %.20q..., want %.20q...", i, v, large)
+		}
+	}
+	if data := readFile(t, c, "file"); string(data) != "hello, /file #1\n" {
+		t.Errorf("read file = %q, want first load", data)
+	}
+}
+
+func BenchmarkMetaCodec(b *testing.B) {
+	for _, tt := range codecs {
+		meta := testMeta()
+		b.Run(tt.name+"/encode", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := tt.codec.encode(meta); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		data, _ := tt.codec.encode(meta)
+		b.Run(tt.name+"/decode", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeMeta(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A StatusError is a loader error reporting an unsuccessful status
+// from a remote server, such as an HTTP response status.
+// Loaders should return a StatusError, typically as the Err field
+// of an *os.PathError, when a server reports a status,
+// so that the cache can remember the failure (see SetNegativeCaching).
+//
+// A StatusError classifies itself by its code, as the HTTP status codes do:
+// errors.Is reports that codes 404 and 410 match ErrNotFound,
+// codes 401 and 403 match ErrPermission, and codes 408, 429,
+// and 500 and above match ErrTransient.
+type StatusError struct {
+	Code   int    // status code, such as 403
+	Status string // status line, such as "403 Forbidden", if known
+}
+
+func (e *StatusError) Error() string {
+	if e.Status != "" {
+		return e.Status
+	}
+	return fmt.Sprintf("status %d", e.Code)
+}
+
+// Is reports whether target is the error classifying e's status.
+// Note that os.IsNotExist and os.IsPermission, unlike errors.Is,
+// do not consult it, so a loader wanting os.IsNotExist to recognize
+// a 404 should return ErrNotFound itself, which the cache
+// treats as status 404.
+func (e *StatusError) Is(target error) bool {
+	switch code := e.Code; {
+	case code == 404 || code == 410:
+		return target == ErrNotFound
+	case code == 401 || code == 403:
+		return target == ErrPermission
+	case code == 408 || code == 429 || code >= 500:
+		return target == ErrTransient
+	}
+	return false
+}
+
+// SetNegativeCaching sets how long the cache remembers a failure to load
+// a file it holds no copy of, by the status the loader reported.
+// While a failure is remembered, Open returns an error with the same
+// status without invoking the loader, sparing the origin repeated requests
+// for missing or forbidden files. For example, to remember 404 Not Found
+// for a minute and 403 Forbidden and 410 Gone, which are usually
+// lasting, for an hour:
+//
+//	c.SetNegativeCaching(map[int]time.Duration{
+//		404: 1 * time.Minute,
+//		403: 1 * time.Hour,
+//		410: 1 * time.Hour,
+//	})
+//
+// The status of a failure is the Code of the *StatusError the loader
+// returned. A failure wrapping ErrNotFound without a StatusError,
+// as from a file system loader, counts as status 404.
+// Failures are remembered in the entry's metadata, so caches sharing
+// a directory share them. ForceReload ignores remembered failures,
+// and Delete forgets them. If ttls is empty (the default),
+// the cache remembers no failures.
+func (c *Cache) SetNegativeCaching(ttls map[int]time.Duration) {
+	m := make(map[int]time.Duration, len(ttls))
+	for code, d := range ttls {
+		m[code] = d
+	}
+	c.mu.Lock()
+	c.negativeTTLs = m
+	c.mu.Unlock()
+}
+
+// negativeTTL returns how long to remember a failure with the given status.
+func (c *Cache) negativeTTL(code int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.negativeTTLs[code]
+}
+
+// errorStatus returns the status code of the load error err,
+// or 0 if it has none.
+func errorStatus(err error) int {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	if errors.Is(err, ErrNotFound) {
+		return 404
+	}
+	return 0
+}
+
+// negativeHit returns the remembered failure to load path,
+// whose metadata is meta, or nil if there is none.
+func (c *Cache) negativeHit(path string, meta *metaDisk) error {
+	if meta.LastStatus == 0 {
+		return nil
+	}
+	ttl := c.negativeTTL(meta.LastStatus)
+	if ttl <= 0 || time.Since(meta.LastErrorTime) >= ttl {
+		return nil
+	}
+	return &os.PathError{Path: path, Op: "load", Err: &StatusError{Code: meta.LastStatus, Status: meta.LastError}}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"os"
+	"time"
+)
+
+// OpenFast opens the file with the given path for a latency-sensitive caller,
+// spending at most about budget waiting for the loader when there is
+// a cached copy to fall back on. If the cached copy is fresh, OpenFast
+// returns it, as Open does. Otherwise it revalidates or reloads the copy,
+// and if that does not finish within budget, OpenFast returns the stale copy
+// while the revalidation continues in the background, updating the cache
+// for later calls. OpenFast also returns the stale copy if the revalidation
+// fails with an error that may be transient (see ErrTransient).
+// It waits for the loader regardless of budget only when there is
+// no cached copy at all, since then there is nothing else to serve.
+//
+// OpenFast never serves a stale copy whose loader metadata sets
+// MustRevalidate or NoStore, nor any stale copy in strict freshness mode
+// (see SetStrictFreshness); for those it behaves like Open.
+func (c *Cache) OpenFast(path string, budget time.Duration) (*os.File, error) {
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	done, abandon := c.openAsync(path)
+	select {
+	case r := <-done:
+		if r.err != nil && transient(r.err) {
+			if f := c.openStale(path); f != nil {
+				return f, nil
+			}
+		}
+		return r.f, r.err
+	case <-timer.C:
+	}
+	if f := c.openStale(path); f != nil {
+		abandon()
+		return f, nil
+	}
+	r := <-done
+	return r.f, r.err
+}
+
+// openStale opens the cached copy of path without checking its freshness,
+// returning nil if there is none or the copy must not be served stale.
+func (c *Cache) openStale(path string) *os.File {
+	if c.strictFreshness() {
+		return nil
+	}
+	_, prefix := c.locate(path)
+	meta, _, err := peekMeta(prefix)
+	if err != nil {
+		return nil
+	}
+	if m := ParseLoadMeta(meta.Load); m.MustRevalidate || m.NoStore {
+		return nil
+	}
+	f, err := os.Open(prefix + ".data")
+	if err != nil {
+		return nil
+	}
+	c.touch(prefix)
+	return f
+}
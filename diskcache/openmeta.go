@@ -0,0 +1,99 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// An ObjectInfo describes a remote file without its content.
+type ObjectInfo struct {
+	Size         int64
+	ContentType  string    `json:",omitempty"`
+	ETag         string    `json:",omitempty"`
+	LastModified time.Time `json:",omitempty"`
+}
+
+// A StatLoader is a Loader that can also describe remote files
+// without loading their content.
+//
+// The Stat method returns information about the remote file path.
+// It returns an error satisfying os.IsNotExist if there is no such file.
+// As in Load, the elements in path are separated by slash characters.
+type StatLoader interface {
+	Loader
+	Stat(path string) (ObjectInfo, error)
+}
+
+// ErrNoStat is the error returned by OpenMeta when the cache's loader
+// does not implement StatLoader.
+var ErrNoStat = errors.New("diskcache: loader does not support stat")
+
+// SetMetaExpiration sets the expiration period for the information
+// cached by OpenMeta. If d is zero (the default), the information
+// expires like cached files, after the period set by SetExpiration.
+func (c *Cache) SetMetaExpiration(d time.Duration) {
+	atomic.StoreInt64(&c.atomicMetaExpiration, int64(d))
+}
+
+func (c *Cache) metaExpiration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.atomicMetaExpiration))
+}
+
+// OpenMeta returns information about the file with the given path,
+// such as its size and content type, without loading its content.
+// It requires the cache's loader to implement StatLoader.
+// The information is cached as an entry of its own, with the path
+// path+"#meta", whether or not the file itself is cached, and it is
+// refreshed using the loader's Stat method when it expires
+// (see SetMetaExpiration). Cached information counts toward the cache's
+// limits and is evicted like other entries.
+func (c *Cache) OpenMeta(path string) (ObjectInfo, error) {
+	sl, ok := c.getLoader().(StatLoader)
+	if !ok {
+		return ObjectInfo{}, ErrNoStat
+	}
+	path = CleanPath(path)
+	l := LoaderFunc(func(_ string, target *os.File, meta []byte) (bool, []byte, error) {
+		info, err := sl.Stat(path)
+		if err != nil {
+			return false, nil, err
+		}
+		m := &LoadMeta{
+			ETag:         info.ETag,
+			LastModified: info.LastModified,
+			ContentType:  info.ContentType,
+			Size:         info.Size,
+			MaxAge:       c.metaExpiration(),
+		}
+		if old := ParseLoadMeta(meta); len(meta) > 0 && old.ETag == m.ETag && old.Size == m.Size &&
+			old.ContentType == m.ContentType && old.LastModified.Equal(m.LastModified) {
+			return true, m.Marshal(), nil
+		}
+		if err := json.NewEncoder(target).Encode(&info); err != nil {
+			return false, nil, err
+		}
+		return false, m.Marshal(), nil
+	})
+	f, err := c.open(path+"#meta", false, l)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return ObjectInfo{}, &os.PathError{Path: path, Op: "open", Err: err}
+	}
+	return info, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// Override installs data as the cached copy of the file with the given path,
+// replacing any existing copy. The cache serves an overridden copy
+// indefinitely: it never consults the loader about the file, even after
+// the copy expires, and it never removes the copy to stay within the
+// maximum data size limit. An overridden copy can still be deleted explicitly.
+// Override is meant as an operational escape hatch, for example to
+// replace bad content during an incident.
+func (c *Cache) Override(path string, data []byte) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	path, prefix := c.locate(path)
+	metaFile, err := c.metaLockCreate(prefix)
+	if err != nil {
+		return err
+	}
+	defer metaFile.Close()
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return err
+	}
+
+	_, sum, err := c.install(prefix, metaFile, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	meta.Override = true
+	meta.Load = nil
+	meta.Sum = sum
+	meta.NextRanges = nil
+	meta.NextSize = 0
+	meta.NextLoad = nil
+	meta.CreateTime = time.Now()
+	meta.RefreshTime = meta.CreateTime
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+	}
+	meta.Path = path
+	if err := c.writeMeta(prefix, meta); err != nil {
+		return err
+	}
+	c.touch(prefix)
+	metaFile.Close()
+
+	c.checkDataLimit()
+	return nil
+}
+
+// ClearOverride removes the copy of the file with the given path
+// installed by Override, so that the next Open loads the file
+// from the loader as usual. If the cached copy was not installed
+// by Override, ClearOverride does nothing.
+func (c *Cache) ClearOverride(path string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	_, prefix := c.locate(path)
+	metaFile, err := c.metaLock(prefix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer metaFile.Close()
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return err
+	}
+	if !meta.Override {
+		return nil
+	}
+	if fi, err := os.Stat(prefix + ".data"); err == nil {
+		c.addUsage(-fi.Size(), -1)
+	}
+	if err := os.Remove(prefix + ".data"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	meta.Override = false
+	if err := c.writeMeta(prefix, meta); err != nil {
+		return err
+	}
+	t := time.Unix(0, 0)
+	return os.Chtimes(prefix+".meta", t, t)
+}
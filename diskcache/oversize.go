@@ -0,0 +1,92 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrTooLarge is the error returned by Open, under OversizeReject,
+// for a file too large to cache within the maximum data size limit.
+var ErrTooLarge = errors.New("diskcache: file exceeds maximum data size")
+
+// An OversizePolicy says how Open keeps a newly downloaded copy
+// within the maximum data size limit set by SetMaxData.
+// A copy is oversized if it alone exceeds the limit.
+type OversizePolicy int
+
+const (
+	// OversizeEvictAfter, the default, installs each new copy and then
+	// removes the least recently used copies until the cache fits
+	// within its limits. The cache can briefly exceed the limit,
+	// and an oversized copy is removed as soon as it is installed,
+	// along with all the others.
+	OversizeEvictAfter OversizePolicy = iota
+
+	// OversizeEvictFirst removes the least recently used copies
+	// to make room for a new copy before installing it, so that
+	// the cache does not exceed the limit. An oversized copy is
+	// handled as under OversizeStreamThrough, since no eviction
+	// could make room for it.
+	OversizeEvictFirst
+
+	// OversizeStreamThrough serves an oversized copy to the caller
+	// without keeping it in the cache. Other copies are handled as
+	// under OversizeEvictAfter.
+	OversizeStreamThrough
+
+	// OversizeReject discards an oversized copy, and Open returns
+	// an error wrapping ErrTooLarge. Other copies are handled as
+	// under OversizeEvictAfter.
+	OversizeReject
+)
+
+// SetOversizePolicy sets how Open keeps newly downloaded copies
+// within the maximum data size limit.
+// Under the policies that do not keep an oversized copy, an older copy
+// it would have replaced is removed too, since it is out of date.
+// The policy applies only to copies downloaded by Open and the functions
+// using it, since only they learn a copy's size before installing it.
+func (c *Cache) SetOversizePolicy(p OversizePolicy) {
+	atomic.StoreInt32(&c.atomicOversize, int32(p))
+}
+
+func (c *Cache) oversizePolicy() OversizePolicy {
+	return OversizePolicy(atomic.LoadInt32(&c.atomicOversize))
+}
+
+// admitNext applies the oversize policy to the new copy of the file
+// with the given path, of the given size, in the .next file for prefix,
+// whose lock the caller holds. The copy replaces one of oldSize bytes,
+// or none if oldSize is negative. admitNext reports whether to install
+// the copy; if not, it has removed the entry, and it returns an error
+// if Open should fail rather than serve the copy.
+func (c *Cache) admitNext(path, prefix string, size, oldSize int64) (bool, error) {
+	max := c.maxData()
+	if max <= 0 {
+		return true, nil
+	}
+	policy := c.oversizePolicy()
+	if size <= max || policy == OversizeEvictAfter {
+		if policy == OversizeEvictFirst {
+			if oldSize >= 0 {
+				c.makeRoom(size-oldSize, 0)
+			} else {
+				// The .next file already counts as a partial copy.
+				c.makeRoom(0, 0)
+			}
+		}
+		return true, nil
+	}
+	if err := c.removeEntry(prefix); err != nil {
+		return false, err
+	}
+	if policy == OversizeReject {
+		return false, fmt.Errorf("diskcache: %s: %w", path, ErrTooLarge)
+	}
+	return false, nil
+}
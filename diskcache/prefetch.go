@@ -0,0 +1,49 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+// SetPrefetch sets a function reporting the files related to a given file,
+// such as the style sheets and scripts used by an HTML page.
+// After each successful Open of a file, the cache prefetches the related files
+// in the background, without delaying the Open.
+// The function is called with the cleaned path, beginning with a slash.
+// If the function is nil (the default), Open prefetches nothing.
+func (c *Cache) SetPrefetch(related func(path string) []string) {
+	c.mu.Lock()
+	c.related = related
+	c.mu.Unlock()
+}
+
+func (c *Cache) getRelated() func(string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.related
+}
+
+// Prefetch loads the files with the given paths into the cache
+// in the background, returning immediately.
+// Prefetched files are loaded a few at a time by the cache's background
+// workers (see SetBackgroundWorkers), and they count against
+// the maximum data size limit like any other cached file.
+// Errors loading prefetched files are not reported,
+// except to WaitFor.
+// Prefetching a file does not prefetch the files related to it.
+func (c *Cache) Prefetch(paths ...string) {
+	if c.readOnly {
+		return
+	}
+	for _, path := range paths {
+		path := path
+		_, prefix := c.locate(path)
+		c.startPrefetch(prefix)
+		c.goBackground(func() {
+			f, err := c.open(path, false, nil)
+			if err == nil {
+				f.Close()
+			}
+			c.endPrefetch(prefix, err)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// PrimeOptions describes the copy installed by Prime.
+type PrimeOptions struct {
+	// ETag is the validator recorded for the copy,
+	// which the loader receives when revalidating it.
+	ETag string
+
+	// LastModified is the modification time recorded for the copy.
+	LastModified time.Time
+
+	// ContentType is the content type recorded for the copy.
+	ContentType string
+
+	// RefreshTime is the time the copy was last refreshed,
+	// from which its expiration is computed.
+	// If zero, it is the current time.
+	RefreshTime time.Time
+}
+
+// Prime installs the content read from r as a valid cached copy
+// of the file with the given path, replacing any existing copy,
+// as though the loader had just loaded it with the metadata in opts.
+// Unlike Override, Prime installs an ordinary copy: once it expires,
+// the cache revalidates it with the loader as usual.
+// Prime is meant for tests and tools that need to seed a cache
+// without a loader.
+func (c *Cache) Prime(path string, r io.Reader, opts PrimeOptions) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	path, prefix := c.locate(path)
+	metaFile, err := c.metaLockCreate(prefix)
+	if err != nil {
+		return err
+	}
+	defer metaFile.Close()
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return err
+	}
+
+	n, sum, err := c.install(prefix, metaFile, r)
+	if err != nil {
+		return err
+	}
+
+	refresh := opts.RefreshTime
+	if refresh.IsZero() {
+		refresh = time.Now()
+	}
+	lm := &LoadMeta{
+		ETag:         opts.ETag,
+		LastModified: opts.LastModified,
+		ContentType:  opts.ContentType,
+		Size:         n,
+	}
+	meta.Override = false
+	meta.Load = lm.Marshal()
+	meta.Sum = sum
+	meta.NextRanges = nil
+	meta.NextSize = 0
+	meta.NextLoad = nil
+	meta.LastError = ""
+	meta.LastErrorTime = time.Time{}
+	meta.LastStatus = 0
+	meta.CreateTime = time.Now()
+	meta.RefreshTime = refresh
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+	}
+	meta.Path = path
+	if err := c.writeMeta(prefix, meta); err != nil {
+		return err
+	}
+	if err := os.Chtimes(prefix+".meta", refresh, refresh); err != nil {
+		return err
+	}
+	c.touch(prefix)
+	metaFile.Close()
+
+	c.checkDataLimit()
+	return nil
+}
+
+// install copies r to a new .next file for prefix and renames it
+// over the .data file, returning the size and SHA-256 checksum
+// of the installed copy. The caller must hold the lock on metaFile.
+func (c *Cache) install(prefix string, metaFile *lockedFile, r io.Reader) (int64, []byte, error) {
+	next, err := c.createNext(prefix, metaFile)
+	if err != nil {
+		return 0, nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(next, h), r)
+	if err != nil {
+		next.Close()
+		os.Remove(prefix + ".next")
+		return 0, nil, fmt.Errorf("writing cached file: %v", err)
+	}
+	if err := next.Close(); err != nil {
+		os.Remove(prefix + ".next")
+		return 0, nil, fmt.Errorf("writing cached file: %v", err)
+	}
+	oldSize := int64(-1)
+	if fi, err := os.Stat(prefix + ".data"); err == nil {
+		oldSize = fi.Size()
+	}
+	if err := installNext(prefix); err != nil {
+		os.Remove(prefix + ".next")
+		return 0, nil, fmt.Errorf("installing cached file: %v", err)
+	}
+	c.notifyInstalled()
+	if oldSize >= 0 {
+		c.addUsage(n-oldSize, 0)
+	} else {
+		c.addUsage(n, 1)
+	}
+	return n, h.Sum(nil), nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrChanged is the error returned by a RangeLoader when the remote file
+// no longer matches the metadata passed to LoadRange.
+var ErrChanged = errors.New("diskcache: remote file changed")
+
+// A RangeLoader is a Loader that can also load part of a remote file.
+//
+// The LoadRange method fetches n bytes of path starting at offset off,
+// or all bytes from off to the end of the file if n is negative,
+// and writes them to target. A range extending past the end of the file
+// is truncated. LoadRange returns the total size of the remote file
+// and the loader metadata describing the version of the file
+// the bytes came from, in the same form Load would return.
+// If meta is non-nil, it is metadata returned by an earlier call to LoadRange,
+// and LoadRange must fetch the bytes from the same version of the file,
+// returning ErrChanged if the file has changed since (compare HTTP's If-Range).
+type RangeLoader interface {
+	Loader
+	LoadRange(path string, target io.Writer, off, n int64, meta []byte) (size int64, newMeta []byte, err error)
+}
+
+// SetRangeChunkSize sets the chunk size for partial copies made by OpenRange.
+// If n is positive, OpenRange loads whole n-byte chunks, aligned to
+// multiples of n, containing the requested bytes, instead of exactly
+// the requested bytes, so that later nearby requests, such as those
+// of sequential media playback, find their bytes already cached.
+// If n is zero (the default), OpenRange loads only the requested bytes.
+func (c *Cache) SetRangeChunkSize(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&c.atomicRangeChunkSize, n)
+}
+
+func (c *Cache) rangeChunkSize() int64 {
+	return atomic.LoadInt64(&c.atomicRangeChunkSize)
+}
+
+// alignRange widens [off, end) to whole chunks of the given size.
+// An end of 1<<63-1, meaning the end of the file, is left unchanged.
+func alignRange(off, end, chunk int64) (int64, int64) {
+	if chunk <= 0 {
+		return off, end
+	}
+	off -= off % chunk
+	if end != 1<<63-1 {
+		if r := end % chunk; r != 0 {
+			if end > 1<<63-1-(chunk-r) {
+				end = 1<<63 - 1
+			} else {
+				end += chunk - r
+			}
+		}
+	}
+	return off, end
+}
+
+// A byteRange is a half-open range of byte offsets [Off, End).
+type byteRange struct {
+	Off, End int64
+}
+
+// addRange returns the sorted, merged list of ranges covering list and r.
+func addRange(list []byteRange, r byteRange) []byteRange {
+	if r.Off >= r.End {
+		return list
+	}
+	list = append(list, r)
+	sort.Slice(list, func(i, j int) bool { return list[i].Off < list[j].Off })
+	out := list[:1]
+	for _, r := range list[1:] {
+		last := &out[len(out)-1]
+		if r.Off <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// missingRanges returns the parts of [off, end) not covered by list.
+func missingRanges(list []byteRange, off, end int64) []byteRange {
+	var gaps []byteRange
+	for _, r := range list {
+		if r.End <= off {
+			continue
+		}
+		if r.Off >= end {
+			break
+		}
+		if r.Off > off {
+			gaps = append(gaps, byteRange{off, r.Off})
+		}
+		off = r.End
+	}
+	if off < end {
+		gaps = append(gaps, byteRange{off, end})
+	}
+	return gaps
+}
+
+// A countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// A sectionFile reads a section of a file and closes the file when done.
+type sectionFile struct {
+	*io.SectionReader
+	f    *os.File
+	size int64 // size of complete file
+}
+
+func (s *sectionFile) Close() error { return s.f.Close() }
+
+// Stat returns the FileInfo for the file, reporting the size
+// of the complete file even when s reads from a partial copy.
+func (s *sectionFile) Stat() (os.FileInfo, error) {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &sizedInfo{fi, s.size}, nil
+}
+
+// A sizedInfo is a FileInfo with its size replaced.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *sizedInfo) Size() int64 { return fi.size }
+
+// OpenRange returns a reader for n bytes of the file with the given path
+// starting at offset off, or all bytes from off to the end of the file
+// if n is negative. The caller is responsible for closing the reader.
+//
+// If the file is cached, OpenRange reads from the cached copy,
+// revalidating it as Open does. Otherwise, if the cache's loader
+// implements RangeLoader, OpenRange loads only the bytes that are needed
+// and not already cached (rounded out to whole chunks; see SetRangeChunkSize),
+// adding them to a partial copy of the file.
+// Once the partial copy covers the entire file, it becomes
+// an ordinary cached copy. Partial copies are not revalidated,
+// but all parts of a partial copy come from the same version of the file.
+// Partial copies count against the cache's limits (see SetMaxData),
+// and eviction and DeleteExpired remove them as they do complete copies.
+// If the loader does not implement RangeLoader, or an inspector is set
+// (see SetInspector), OpenRange loads the entire file.
+//
+// The returned reader has a Size method reporting the length of the range
+// and a Stat method whose result reports the size of the complete file.
+func (c *Cache) OpenRange(path string, off, n int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("diskcache: invalid range offset %d", off)
+	}
+	rl, ok := c.getLoader().(RangeLoader)
+	if !ok || c.readOnly || c.getInspector() != nil {
+		return c.openFullRange(path, off, n)
+	}
+	cleaned, prefix := c.locate(path)
+	if _, err := os.Stat(prefix + ".data"); err == nil {
+		return c.openFullRange(path, off, n)
+	}
+
+	metaFile, err := c.metaLockCreate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer metaFile.Close()
+	if _, err := os.Stat(prefix + ".data"); err == nil {
+		// Completed while we waited for the lock.
+		metaFile.Close()
+		return c.openFullRange(path, off, n)
+	}
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Path == "" {
+		c.recordManifest(prefix, cleaned)
+	}
+	meta.Path = cleaned
+
+	complete, err := c.loadRange(rl, prefix, meta, off, n)
+	if err != nil {
+		return nil, err
+	}
+	name := prefix + ".next"
+	if complete {
+		name = prefix + ".data"
+	} else {
+		c.touch(prefix) // for eviction; see scan
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size := meta.NextSize
+	if complete {
+		// Installed, so meta.NextSize was cleared.
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+		c.touch(prefix)
+	}
+	metaFile.Close()
+	if complete {
+		c.checkDataLimit()
+	}
+	return newSectionFile(f, off, n, size), nil
+}
+
+func newSectionFile(f *os.File, off, n, size int64) *sectionFile {
+	if off > size {
+		off = size
+	}
+	if n < 0 || off+n > size {
+		n = size - off
+	}
+	return &sectionFile{io.NewSectionReader(f, off, n), f, size}
+}
+
+// openFullRange implements OpenRange using Open.
+func (c *Cache) openFullRange(path string, off, n int64) (io.ReadCloser, error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newSectionFile(f, off, n, fi.Size()), nil
+}
+
+// loadRange loads the parts of the range [off, off+n) missing from the
+// partial copy described by meta into the .next file for prefix,
+// whose lock the caller holds, and updates and writes meta.
+// If the partial copy then covers the entire file, loadRange installs it
+// as the .data file and reports complete == true.
+func (c *Cache) loadRange(rl RangeLoader, prefix string, meta *metaDisk, off, n int64) (complete bool, err error) {
+	next, err := os.OpenFile(prefix+".next", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, fmt.Errorf("creating cached file: %v", err)
+	}
+	defer next.Close()
+
+	// A partial copy is present if any ranges are;
+	// its loader metadata may be nil, since loaders need not return any.
+	// The partial copy's ranges record which chunks are present.
+	loaded := false // a LoadRange call succeeded
+	for retry := 0; ; retry++ {
+		partial := len(meta.NextRanges) > 0
+		end := off + n
+		if n < 0 {
+			end = 1<<63 - 1
+		}
+		lo, end := alignRange(off, end, c.rangeChunkSize())
+		if partial && end > meta.NextSize {
+			end = meta.NextSize
+		}
+		var gaps []byteRange
+		if partial {
+			gaps = missingRanges(meta.NextRanges, lo, end)
+		} else {
+			gaps = []byteRange{{lo, end}}
+		}
+		err = nil
+		for _, g := range gaps {
+			fw := &firstByteWriter{w: io.NewOffsetWriter(next, g.Off)}
+			cw := &countingWriter{w: fw}
+			length := g.End - g.Off
+			if g.End == 1<<63-1 {
+				length = -1
+			}
+			var size int64
+			var newMeta []byte
+			c.startLoad()
+			start := time.Now()
+			size, newMeta, err = rl.LoadRange(meta.Path, cw, g.Off, length, meta.NextLoad)
+			c.recordLoad(start, fw.first, err)
+			c.endLoad()
+			if err != nil {
+				break
+			}
+			loaded = true
+			meta.NextSize = size
+			meta.NextLoad = newMeta
+			meta.NextRanges = addRange(meta.NextRanges, byteRange{g.Off, g.Off + cw.n})
+		}
+		if errors.Is(err, ErrChanged) && retry == 0 {
+			// Partial copy is from an old version. Start over.
+			meta.NextRanges = nil
+			meta.NextSize = 0
+			meta.NextLoad = nil
+			if err := next.Truncate(0); err != nil {
+				return false, err
+			}
+			continue
+		}
+		break
+	}
+
+	full := len(meta.NextRanges) == 1 && meta.NextRanges[0] == byteRange{0, meta.NextSize} ||
+		loaded && meta.NextSize == 0
+	if err == nil && full {
+		if err := next.Truncate(meta.NextSize); err != nil {
+			return false, err
+		}
+		if err := next.Close(); err != nil {
+			return false, fmt.Errorf("writing cached file: %v", err)
+		}
+		if err := installNext(prefix); err != nil {
+			return false, fmt.Errorf("installing cached file: %v", err)
+		}
+		c.notifyInstalled()
+		c.addUsage(meta.NextSize, 1)
+		meta.Load = meta.NextLoad
+		meta.RefreshTime = time.Now()
+		meta.CreateTime = meta.RefreshTime
+		meta.Sum = nil
+		meta.NextRanges = nil
+		meta.NextSize = 0
+		meta.NextLoad = nil
+		if err := c.writeMeta(prefix, meta); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	// Record progress, even after an error.
+	// The .meta file has no .data file to describe,
+	// so its modification time is immaterial.
+	if werr := c.writeMeta(prefix, meta); werr != nil && err == nil {
+		err = werr
+	}
+	return false, err
+}
+
+// resumeNext completes the partial copy in the .next file for prefix,
+// whose .meta file the caller has locked, by loading only its missing
+// ranges, and returns the installed copy. The .meta file records the
+// loader metadata of the partial copy, so the missing ranges are loaded
+// from the same version of the file (or, if the file has changed,
+// from scratch), even if the copy was started by a client that has
+// since exited. resumeNext returns nil, nil if there is no partial copy,
+// or l cannot load ranges, or the partial copy is a prefix of the file
+// that l, a ResumeLoader, can resume (see resumableNext), leaving
+// the caller to load the entire file or the rest of it.
+func (c *Cache) resumeNext(l Loader, path, prefix string, meta *metaDisk) (*os.File, error) {
+	if l == nil {
+		l = c.getLoader()
+	}
+	rl, ok := l.(RangeLoader)
+	if !ok || len(meta.NextRanges) == 0 || c.getInspector() != nil {
+		return nil, nil
+	}
+	if _, ok := l.(ResumeLoader); ok && meta.NextRanges[0].Off == 0 && len(meta.NextRanges) == 1 {
+		// A download can resume the partial copy in a single request.
+		return nil, nil
+	}
+	if _, err := os.Stat(prefix + ".next"); err != nil {
+		return nil, nil
+	}
+	if meta.Path == "" {
+		c.recordManifest(prefix, path)
+	}
+	meta.Path = path
+	complete, err := c.loadRange(rl, prefix, meta, 0, -1)
+	if err != nil || !complete {
+		return nil, err
+	}
+	return os.Open(prefix + ".data")
+}
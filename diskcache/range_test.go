@@ -0,0 +1,300 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const letters = "abcdefghijklmnopqrstuvwxyz"
+
+// A rangeLoader serves letters, counting the bytes it loads.
+type rangeLoader struct {
+	loads int
+	bytes int64
+	meta  string
+}
+
+func (l *rangeLoader) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	l.loads++
+	l.bytes += int64(len(letters))
+	io.WriteString(target, letters)
+	return false, []byte(l.meta), nil
+}
+
+func (l *rangeLoader) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (int64, []byte, error) {
+	if meta != nil && string(meta) != l.meta {
+		return 0, nil, ErrChanged
+	}
+	l.loads++
+	end := off + n
+	if n < 0 || end > int64(len(letters)) {
+		end = int64(len(letters))
+	}
+	if off < end {
+		io.WriteString(target, letters[off:end])
+		l.bytes += end - off
+	}
+	return int64(len(letters)), []byte(l.meta), nil
+}
+
+func readRange(t *testing.T, c *Cache, off, n int64) string {
+	r, err := c.OpenRange("file", off, n)
+	if err != nil {
+		t.Fatalf("OpenRange(%d, %d): %v", off, n, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("OpenRange(%d, %d): %v", off, n, err)
+	}
+	return string(data)
+}
+
+func TestOpenRange(t *testing.T) {
+	l := &rangeLoader{meta: "v1"}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+
+	if s := readRange(t, c, 2, 3); s != "cde" {
+		t.Fatalf("range [2,5) = %q, want %q", s, "cde")
+	}
+	if s := readRange(t, c, 3, 2); s != "de" || l.loads != 1 {
+		t.Fatalf("range [3,5) = %q after %d loads, want %q after 1", s, l.loads, "de")
+	}
+	if cached(c, "file") {
+		t.Fatalf("partial copy reported as cached")
+	}
+	if s := readRange(t, c, 10, -1); s != letters[10:] || l.bytes != 3+16 {
+		t.Fatalf("range [10,) = %q after %d bytes, want %q after 19", s, l.bytes, letters[10:])
+	}
+
+	// A changed file discards the partial copy.
+	l.meta = "v2"
+	if s := readRange(t, c, 0, 4); s != "abcd" || l.bytes != 19+4 {
+		t.Fatalf("range [0,4) = %q after %d bytes, want %q after 23", s, l.bytes, "abcd")
+	}
+	if s := readRange(t, c, 4, -1); s != letters[4:] {
+		t.Fatalf("range [4,) = %q, want %q", s, letters[4:])
+	}
+	if !cached(c, "file") {
+		t.Fatalf("complete partial copy not cached")
+	}
+	loads := l.loads
+	if data := readFile(t, c, "file"); string(data) != letters || l.loads != loads {
+		t.Fatalf("Open = %q after %d more loads, want %q after none", data, l.loads-loads, letters)
+	}
+	if s := readRange(t, c, 24, 10); s != "yz" || l.loads != loads {
+		t.Fatalf("range [24,34) = %q after %d more loads, want %q after none", s, l.loads-loads, "yz")
+	}
+	if u, n, err := c.DiskUsage(); err != nil || u != int64(len(letters)) || n != 1 {
+		t.Fatalf("DiskUsage() = %d, %d, %v, want %d, 1, nil", u, n, err, len(letters))
+	}
+}
+
+func TestOpenRangeChunks(t *testing.T) {
+	l := &rangeLoader{meta: "v1"}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+	c.SetRangeChunkSize(8)
+
+	// Two nearby ranges in one chunk load the chunk once.
+	if s := readRange(t, c, 2, 3); s != "cde" || l.loads != 1 || l.bytes != 8 {
+		t.Fatalf("range [2,5) = %q after %d loads of %d bytes, want %q after 1 of 8", s, l.loads, l.bytes, "cde")
+	}
+	if s := readRange(t, c, 5, 2); s != "fg" || l.loads != 1 {
+		t.Fatalf("range [5,7) = %q after %d loads, want %q after 1", s, l.loads, "fg")
+	}
+
+	// A range spanning chunks loads only the missing ones.
+	if s := readRange(t, c, 6, 4); s != "ghij" || l.loads != 2 || l.bytes != 16 {
+		t.Fatalf("range [6,10) = %q after %d loads of %d bytes, want %q after 2 of 16", s, l.loads, l.bytes, "ghij")
+	}
+
+	// The last chunk is short; loading the rest completes the copy.
+	if s := readRange(t, c, 17, 8); s != letters[17:25] || l.loads != 3 || l.bytes != 26 {
+		t.Fatalf("range [17,25) = %q after %d loads of %d bytes, want %q after 3 of 26", s, l.loads, l.bytes, letters[17:25])
+	}
+	if !cached(c, "file") {
+		t.Fatalf("copy covering all chunks not installed")
+	}
+}
+
+func TestAlignRange(t *testing.T) {
+	const eof = 1<<63 - 1
+	for _, tt := range []struct{ off, end, chunk, wantOff, wantEnd int64 }{
+		{100, 200, 0, 100, 200},
+		{100, 200, 1024, 0, 1024},
+		{1024, 2048, 1024, 1024, 2048},
+		{1500, 2049, 1024, 1024, 3072},
+		{1500, eof, 1024, 1024, eof},
+		{0, eof - 5, 1024, 0, eof},
+	} {
+		off, end := alignRange(tt.off, tt.end, tt.chunk)
+		if off != tt.wantOff || end != tt.wantEnd {
+			t.Errorf("alignRange(%d, %d, %d) = %d, %d, want %d, %d", tt.off, tt.end, tt.chunk, off, end, tt.wantOff, tt.wantEnd)
+		}
+	}
+}
+
+func TestOpenRangeNoMeta(t *testing.T) {
+	l := &rangeLoader{}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+
+	if s := readRange(t, c, 0, 13); s != letters[:13] {
+		t.Fatalf("range [0,13) = %q, want %q", s, letters[:13])
+	}
+	if s := readRange(t, c, 13, -1); s != letters[13:] {
+		t.Fatalf("range [13,) = %q, want %q", s, letters[13:])
+	}
+	if !cached(c, "file") || l.bytes != int64(len(letters)) {
+		t.Fatalf("after loading both halves: cached=%v, loaded %d bytes, want true, %d", cached(c, "file"), l.bytes, len(letters))
+	}
+}
+
+func TestOpenResumesPartial(t *testing.T) {
+	l := &rangeLoader{meta: "v1"}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+
+	if s := readRange(t, c, 0, 10); s != letters[:10] {
+		t.Fatalf("range [0,10) = %q, want %q", s, letters[:10])
+	}
+
+	// A new cache on the same directory, as after a restart,
+	// loads only the rest of the file.
+	c, err := New(c.dir, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "file"); string(data) != letters || l.loads != 2 || l.bytes != int64(len(letters)) {
+		t.Fatalf("Open = %q after %d loads of %d bytes, want %q after 2 loads of %d", data, l.loads, l.bytes, letters, len(letters))
+	}
+	_, prefix := c.locate("file")
+	if _, err := os.Stat(prefix + ".next"); !os.IsNotExist(err) {
+		t.Fatalf("partial copy left behind: %v", err)
+	}
+
+	// A partial copy of a changed file is discarded.
+	c.Delete("file")
+	readRange(t, c, 0, 10)
+	l.meta = "v2"
+	if data := readFile(t, c, "file"); string(data) != letters || l.bytes != 26+10+26 {
+		t.Fatalf("Open changed file = %q after %d bytes, want %q after %d", data, l.bytes, letters, 26+10+26)
+	}
+}
+
+// A resumeLoader serves its version followed by letters,
+// failing after writing failAt bytes if failAt is positive.
+type resumeLoader struct {
+	version string
+	failAt  int
+	offs    []int64 // offsets passed to LoadResume
+}
+
+func (l *resumeLoader) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	return l.LoadResume(path, target, meta, 0, nil, func([]byte, bool) error { return nil })
+}
+
+func (l *resumeLoader) LoadResume(path string, target io.Writer, meta []byte, off int64, partial []byte, begin func([]byte, bool) error) (bool, []byte, error) {
+	l.offs = append(l.offs, off)
+	resumed := off > 0 && string(partial) == l.version
+	if !resumed {
+		off = 0
+	}
+	if err := begin([]byte(l.version), resumed); err != nil {
+		return false, nil, err
+	}
+	data := l.version + ":" + letters
+	if l.failAt > 0 {
+		io.WriteString(target, data[off:l.failAt])
+		return false, nil, fmt.Errorf("connection reset (%w)", ErrTransient)
+	}
+	io.WriteString(target, data[off:])
+	return false, []byte(l.version), nil
+}
+
+func TestOpenResumesDownload(t *testing.T) {
+	l := &resumeLoader{version: "v1", failAt: 10}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+
+	if _, err := c.Open("file"); err == nil {
+		t.Fatalf("Open with failing loader succeeded")
+	}
+
+	// A new cache on the same directory, as after a restart,
+	// loads only the rest of the file.
+	l.failAt = 0
+	c, err := New(c.dir, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, c, "file"); string(data) != "v1:"+letters || fmt.Sprint(l.offs) != "[0 10]" {
+		t.Fatalf("Open = %q after loads at offsets %v, want %q after [0 10]", data, l.offs, "v1:"+letters)
+	}
+
+	// A changed file is loaded from the start.
+	c.Delete("file")
+	l.failAt = 10
+	c.Open("file")
+	l.version, l.failAt, l.offs = "v2", 0, nil
+	if data := readFile(t, c, "file"); string(data) != "v2:"+letters || fmt.Sprint(l.offs) != "[10]" {
+		t.Fatalf("Open changed file = %q after loads at offsets %v, want %q after [10]", data, l.offs, "v2:"+letters)
+	}
+	if e, err := c.Stat("file"); err != nil || e.Size != int64(len("v2:"+letters)) {
+		t.Fatalf("Stat = %+v, %v, want size %d", e, err, len("v2:"+letters))
+	}
+	if err := c.Verify("file"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+func TestPartialLimits(t *testing.T) {
+	l := &rangeLoader{meta: "v1"}
+	c, cleanup := newCache(t, l)
+	defer cleanup()
+	_, prefix := c.locate("file")
+
+	readRange(t, c, 0, 10)
+	if u, n, err := c.DiskUsage(); u != 10 || n != 1 || err != nil {
+		t.Fatalf("DiskUsage() = %d, %d, %v, want 10, 1, nil", u, n, err)
+	}
+
+	// A partial copy counts against the data size limit.
+	c.SetMaxData(5)
+	plan, _, err := c.EvictionPlan()
+	if err != nil || len(plan) != 1 || !plan[0].Partial || plan[0].Size != 10 {
+		t.Fatalf("EvictionPlan() = %+v, %v, want the partial copy", plan, err)
+	}
+	c.checkDataLimit()
+	if _, err := os.Stat(prefix + ".next"); !os.IsNotExist(err) {
+		t.Fatalf("partial copy not evicted: %v", err)
+	}
+	c.SetMaxData(0)
+
+	// A partial copy expires as long after it was last extended.
+	c.SetExpiration(time.Minute)
+	readRange(t, c, 0, 10)
+	if n, err := c.DeleteExpired(); n != 0 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 0, nil", n, err)
+	}
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(prefix+".next", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.DeleteExpired(); n != 1 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v, want 1, nil", n, err)
+	}
+	if _, err := os.Stat(prefix + ".next"); !os.IsNotExist(err) {
+		t.Fatalf("expired partial copy not deleted: %v", err)
+	}
+}
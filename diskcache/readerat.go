@@ -0,0 +1,67 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// OpenReaderAt opens the file with the given path, as Open does,
+// and returns it as an io.ReaderAt for random access, such as by
+// archive/zip, along with a function to close it.
+// The ReaderAt also has a Size method returning the size of the file.
+//
+// Until the close function is called, the cached copy is held in the cache:
+// this cache does not evict it, neither to stay within its limits
+// nor in DeleteExpired, although it can still be deleted explicitly.
+// The hold is kept in memory, so other caches sharing the directory
+// do not observe it; the open file remains readable even if they remove it.
+func (c *Cache) OpenReaderAt(path string) (io.ReaderAt, func() error, error) {
+	_, prefix := c.locate(path)
+	c.hold(prefix, 1)
+	f, err := c.Open(path)
+	if err != nil {
+		c.hold(prefix, -1)
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		c.hold(prefix, -1)
+		return nil, nil, err
+	}
+	var once sync.Once
+	closer := func() error {
+		err := os.ErrClosed
+		once.Do(func() {
+			err = f.Close()
+			c.hold(prefix, -1)
+		})
+		return err
+	}
+	return io.NewSectionReader(f, 0, fi.Size()), closer, nil
+}
+
+// hold adjusts the count of OpenReaderAt handles for prefix by delta.
+func (c *Cache) hold(prefix string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.held == nil {
+		c.held = make(map[string]int)
+	}
+	c.held[prefix] += delta
+	if c.held[prefix] <= 0 {
+		delete(c.held, prefix)
+	}
+}
+
+// isHeld reports whether an OpenReaderAt handle for prefix is open.
+func (c *Cache) isHeld(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.held[prefix] > 0
+}
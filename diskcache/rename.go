@@ -0,0 +1,126 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"fmt"
+	"os"
+)
+
+// Rename moves the cached copy of the file with path oldPath to be the
+// cached copy of the file with path newPath, without loading the file again.
+// The copy keeps its metadata, including its refresh time and whether it is
+// pinned, and any existing copy of newPath is replaced.
+// Rename is meant for restructuring the served paths: it does not change
+// what the loader returns for either path.
+// If there is no cached copy of oldPath, Rename returns an error
+// satisfying errors.Is(err, ErrNotFound).
+func (c *Cache) Rename(oldPath, newPath string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	oldPath, oldPrefix := c.locate(oldPath)
+	newPath, newPrefix := c.locate(newPath)
+	if oldPrefix == newPrefix {
+		return nil
+	}
+	notFound := &os.PathError{Path: oldPath, Op: "rename", Err: os.ErrNotExist}
+
+	// Lock both entries, in prefix order so that two
+	// concurrent renames of the same pair cannot deadlock.
+	var oldMeta, newMeta *lockedFile
+	var err error
+	if oldPrefix < newPrefix {
+		if oldMeta, err = c.lockEntry(oldPrefix); err == nil {
+			newMeta, err = c.metaLockCreate(newPrefix)
+		}
+	} else {
+		if newMeta, err = c.metaLockCreate(newPrefix); err == nil {
+			oldMeta, err = c.lockEntry(oldPrefix)
+		}
+	}
+	if oldMeta != nil {
+		defer oldMeta.Close()
+	}
+	if newMeta != nil {
+		defer newMeta.Close()
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFound
+		}
+		return err
+	}
+
+	meta, err := readMeta(oldMeta)
+	if err != nil {
+		return err
+	}
+	fi, err := oldMeta.Stat()
+	if err != nil {
+		return fmt.Errorf("stat'ing metadata file: %v", err)
+	}
+	if _, err := os.Stat(oldPrefix + ".data"); err != nil {
+		if os.IsNotExist(err) {
+			return notFound
+		}
+		return err
+	}
+
+	prev, err := readMeta(newMeta)
+	if err != nil {
+		return err
+	}
+
+	// Replace any copy of newPath.
+	if dfi, err := os.Stat(newPrefix + ".data"); err == nil {
+		c.addUsage(-dfi.Size(), -1)
+	}
+	os.Remove(newPrefix + ".next")
+	os.Remove(newPrefix + ".used")
+	if err := os.Rename(oldPrefix+".data", newPrefix+".data"); err != nil {
+		return fmt.Errorf("renaming cached file: %v", err)
+	}
+	c.notifyInstalled()
+	os.Rename(oldPrefix+".used", newPrefix+".used")
+	os.Remove(oldPrefix + ".next")
+
+	// A partial copy in .next belonged to the old entry.
+	meta.NextRanges = nil
+	meta.NextSize = 0
+	meta.NextLoad = nil
+	meta.Path = newPath
+	if err := c.writeMeta(newPrefix, meta); err != nil {
+		return err
+	}
+	if err := os.Chtimes(newPrefix+".meta", fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	if prev.Path == "" {
+		c.recordManifest(newPrefix, newPath)
+	}
+	if err := os.Remove(oldPrefix + ".meta"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	oldMeta.Close()
+	c.pruneDir(oldPrefix)
+	return nil
+}
+
+// lockEntry is like metaLock but also fails with an os.ErrNotExist error
+// if the entry was deleted while waiting for the lock.
+func (c *Cache) lockEntry(prefix string) (*lockedFile, error) {
+	f, err := c.metaLock(prefix)
+	if err != nil {
+		return nil, err
+	}
+	fi1, err1 := f.Stat()
+	fi2, err2 := os.Stat(prefix + ".meta")
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		f.Close()
+		return nil, &os.PathError{Path: prefix + ".meta", Op: "open", Err: os.ErrNotExist}
+	}
+	return f, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+)
+
+// A ResumeLoader is a Loader that can resume a download interrupted
+// partway through, even by a crash or restart of the program.
+//
+// The LoadResume method is like LoadStream (see StreamLoader),
+// writing the file to target in order, except that before writing
+// any bytes it calls begin with loader metadata identifying the version
+// of the file being fetched, such as its ETag, so that the cache can
+// record which version the bytes written come from. If begin returns
+// an error, LoadResume must return that error without writing to target.
+//
+// If off is positive, target already holds the first off bytes of the
+// version of the file described by partial, metadata passed to an earlier
+// call to begin. LoadResume then fetches only the rest of the file,
+// provided the remote file still matches partial, and calls begin
+// with resumed set to true. If the file has changed, LoadResume instead
+// fetches the entire new version, calling begin with resumed set to false,
+// and the cache discards the bytes from the old version (compare HTTP's
+// If-Range, which asks for a range of a file if it is unchanged
+// and the entire file otherwise). If off is zero, resumed must be false.
+type ResumeLoader interface {
+	Loader
+	LoadResume(path string, target io.Writer, meta []byte, off int64, partial []byte, begin func(newMeta []byte, resumed bool) error) (cacheValid bool, newMeta []byte, err error)
+}
+
+// resumableNext opens the .next file for prefix, whose .meta file
+// the caller has locked, to resume the download of the partial copy
+// described by meta. It returns the file, positioned at the end of the
+// bytes to keep, and the number of those bytes, or nil, 0 if there is
+// no partial copy that a download can resume.
+// A partial copy can be resumed if it is a prefix of the file: either
+// an interrupted download, whose bytes run to the end of the .next file,
+// or a partial copy made by OpenRange holding only the file's first bytes.
+func resumableNext(prefix string, meta *metaDisk) (*os.File, int64) {
+	if meta.NextLoad == nil {
+		return nil, 0
+	}
+	end := int64(-1)
+	switch r := meta.NextRanges; {
+	case len(r) == 0:
+		// An interrupted download.
+	case len(r) == 1 && r[0].Off == 0:
+		end = r[0].End
+	default:
+		return nil, 0
+	}
+	f, err := os.OpenFile(prefix+".next", os.O_RDWR, 0)
+	if err != nil {
+		return nil, 0
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0
+	}
+	if end < 0 || end > fi.Size() {
+		end = fi.Size()
+	}
+	if end == 0 {
+		f.Close()
+		return nil, 0
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, 0
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0
+	}
+	return f, end
+}
+
+// loadResume is like load for the ResumeLoader rl, resuming the download
+// of the partial copy of off bytes in next, which come from the version
+// of the file described by partial. It calls begin with the loader
+// metadata for the version being loaded once next holds only bytes
+// of that version. The checksum covers the entire copy.
+func (c *Cache) loadResume(rl ResumeLoader, path string, next *os.File, meta []byte, off int64, partial []byte, begin func(newMeta []byte) error) (cacheValid bool, newMeta, sum []byte, err error) {
+	c.startLoad()
+	defer c.endLoad()
+	start := time.Now()
+	h := sha256.New()
+	if off > 0 {
+		if _, err := io.Copy(h, io.NewSectionReader(next, 0, off)); err != nil {
+			return false, nil, nil, err
+		}
+	}
+	fw := &firstByteWriter{w: io.MultiWriter(next, h)}
+	cacheValid, newMeta, err = rl.LoadResume(path, fw, meta, off, partial, func(m []byte, resumed bool) error {
+		if !resumed && off > 0 {
+			// The file has changed. Start over.
+			if err := next.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := next.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			h.Reset()
+		}
+		return begin(m)
+	})
+	c.recordLoad(start, fw.first, err)
+	if err == nil && !cacheValid {
+		sum = h.Sum(nil)
+	}
+	return cacheValid, newMeta, sum, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SetStaleGrace sets the period after a copy expires during which
+// Open serves the expired copy immediately and revalidates it
+// in the background (stale-while-revalidate), instead of waiting
+// for the revalidation. Once a copy has been expired for longer than d,
+// Open waits for revalidation as usual. For example, with an expiration
+// period of one minute and a stale grace of ten minutes, a copy is
+// fresh for its first minute, is served as is while a background
+// refresh runs for the next ten, and is served only after revalidation
+// from then on. Background revalidations run on the cache's
+// background workers (see SetBackgroundWorkers), at most one per file.
+// If d is zero (the default), Open always waits for revalidation.
+//
+// The grace does not apply to copies expired explicitly by Expire
+// or ExpireAll, to copies the loader marked MustRevalidate or NoStore
+// or gave a negative MaxAge, or in strict freshness mode.
+func (c *Cache) SetStaleGrace(d time.Duration) {
+	atomic.StoreInt64(&c.atomicStaleGrace, int64(d))
+}
+
+func (c *Cache) staleGrace() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.atomicStaleGrace))
+}
+
+// openGrace returns the cached copy of path if it has expired
+// but is within the stale grace period, starting its revalidation
+// in the background. Otherwise it returns nil.
+func (c *Cache) openGrace(path string) *os.File {
+	grace := c.staleGrace()
+	if grace <= 0 || c.readOnly || c.strictFreshness() {
+		return nil
+	}
+	path, prefix := c.locate(path)
+	meta, fi, err := peekMeta(prefix)
+	if err != nil || meta.Override {
+		return nil
+	}
+	now := time.Now()
+	d := c.entryExpiration(meta, c.expiration())
+	t := expiresAt(fi.ModTime(), d)
+	if t.IsZero() || now.Before(t) || fi.ModTime().Unix() == 0 || !now.Before(t.Add(grace)) {
+		// Fresh, explicitly expired, or beyond the grace period.
+		return nil
+	}
+	if m := ParseLoadMeta(meta.Load); m.MustRevalidate || m.NoStore || m.MaxAge < 0 {
+		return nil
+	}
+	data, err := os.Open(prefix + ".data")
+	if err != nil {
+		return nil
+	}
+	c.touch(prefix)
+	c.revalidateAsync(path, prefix)
+	return data
+}
+
+// revalidateAsync revalidates path, with entry prefix, in the background,
+// unless a background revalidation of it is already pending.
+func (c *Cache) revalidateAsync(path, prefix string) {
+	c.mu.Lock()
+	if c.revalidating[prefix] {
+		c.mu.Unlock()
+		return
+	}
+	if c.revalidating == nil {
+		c.revalidating = make(map[string]bool)
+	}
+	c.revalidating[prefix] = true
+	c.mu.Unlock()
+
+	c.goBackground(func() {
+		if f, err := c.open(path, false, nil); err == nil {
+			f.Close()
+		}
+		c.mu.Lock()
+		delete(c.revalidating, prefix)
+		c.mu.Unlock()
+	})
+}
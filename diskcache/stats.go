@@ -0,0 +1,145 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Summary summarizes a series of durations.
+type Summary struct {
+	Count int64         // number of durations
+	Total time.Duration // sum of durations
+	Min   time.Duration // smallest duration
+	Max   time.Duration // largest duration
+}
+
+// Mean returns the mean duration, or zero if there are none.
+func (s Summary) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+func (s *Summary) add(d time.Duration) {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Total += d
+}
+
+// Stats holds statistics about a cache's use of its loader.
+// The statistics cover only this cache, not others sharing its directory.
+type Stats struct {
+	Hits       int64 // opens served from a fresh cached copy without invoking the loader
+	Loads      int64 // loader invocations, including revalidations and range loads
+	LoadErrors int64 // loader invocations returning errors
+
+	// LoadTime summarizes the durations of loader invocations.
+	LoadTime Summary
+
+	// FirstByte summarizes the times from the start of a loader invocation
+	// to the first byte of content written, for loaders that implement
+	// StreamLoader or RangeLoader. Invocations writing no content,
+	// such as successful revalidations, are not included.
+	FirstByte Summary
+
+	// BackgroundQueue is the number of background tasks, such as prefetches,
+	// waiting for a worker, and BackgroundWorkers is the number of
+	// goroutines running background tasks (see SetBackgroundWorkers).
+	BackgroundQueue   int
+	BackgroundWorkers int
+}
+
+// stats is the cache's running statistics.
+type stats struct {
+	mu sync.Mutex
+	s  Stats
+}
+
+// Stats returns a snapshot of the cache's statistics.
+func (c *Cache) Stats() Stats {
+	c.stats.mu.Lock()
+	s := c.stats.s
+	c.stats.mu.Unlock()
+	s.BackgroundQueue, s.BackgroundWorkers = c.background.counts()
+	return s
+}
+
+// recordHit records an open served from a fresh cached copy.
+func (c *Cache) recordHit() {
+	c.stats.mu.Lock()
+	c.stats.s.Hits++
+	c.stats.mu.Unlock()
+}
+
+// recordLoad records a loader invocation that started at start,
+// wrote its first byte at first (zero if never), and returned err.
+func (c *Cache) recordLoad(start, first time.Time, err error) {
+	d := time.Since(start)
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	s := &c.stats.s
+	s.Loads++
+	if err != nil {
+		s.LoadErrors++
+	}
+	s.LoadTime.add(d)
+	if !first.IsZero() {
+		s.FirstByte.add(first.Sub(start))
+	}
+}
+
+// A firstByteWriter records the time of the first write of content to w.
+type firstByteWriter struct {
+	w     io.Writer
+	first time.Time
+}
+
+func (fw *firstByteWriter) Write(p []byte) (int, error) {
+	if fw.first.IsZero() && len(p) > 0 {
+		fw.first = time.Now()
+	}
+	return fw.w.Write(p)
+}
+
+// load invokes the loader l, or the cache's loader if l is nil, to load path into next,
+// tracking the invocation in InFlight and Stats.
+// If the loader is a StreamLoader, load also computes the SHA-256 checksum
+// of the content as it is written, returning it in sum.
+// A Loader writes to the file directly, possibly out of order,
+// so for other loaders sum is nil.
+func (c *Cache) load(l Loader, path string, next *os.File, meta []byte) (cacheValid bool, newMeta, sum []byte, err error) {
+	c.startLoad()
+	defer c.endLoad()
+	start := time.Now()
+	var first time.Time
+	if l == nil {
+		l = c.getLoader()
+	}
+	switch l := l.(type) {
+	case StreamLoader:
+		h := sha256.New()
+		fw := &firstByteWriter{w: io.MultiWriter(next, h)}
+		cacheValid, newMeta, err = l.LoadStream(path, fw, meta)
+		first = fw.first
+		if err == nil && !cacheValid {
+			sum = h.Sum(nil)
+		}
+	default:
+		cacheValid, newMeta, err = l.Load(path, next, meta)
+	}
+	c.recordLoad(start, first, err)
+	return cacheValid, newMeta, sum, err
+}
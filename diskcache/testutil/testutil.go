@@ -0,0 +1,134 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package testutil provides helpers for testing and benchmarking
+// code that uses a diskcache.Cache: a cache in a temporary directory
+// and a fake loader serving files from memory.
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// NewTempCache returns a new cache in a temporary directory, using loader,
+// and a cleanup function that closes the cache and removes the directory.
+// It calls tb.Fatal if the cache cannot be created.
+func NewTempCache(tb testing.TB, loader diskcache.Loader) (*diskcache.Cache, func()) {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "diskcache-testutil-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c, err := diskcache.New(dir+"/cache", loader)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// A FakeLoader is a diskcache.Loader serving files from memory.
+// Each call to Set creates a new version of a file, so a test can
+// simulate a remote change; the loader reports an unchanged file's
+// cached copy as valid without rewriting it.
+// The zero FakeLoader serves no files and is ready to use.
+// A FakeLoader is safe for concurrent use, but its hook fields
+// must not be changed while loads are in progress.
+type FakeLoader struct {
+	// Latency is how long each load waits before doing anything,
+	// to simulate a slow remote file system.
+	Latency time.Duration
+
+	// Err, if non-nil, is called at the start of each load (after Latency),
+	// and a non-nil result is returned as the load's error,
+	// to simulate remote failures.
+	Err func(path string) error
+
+	mu    sync.Mutex
+	files map[string]fakeFile
+	loads map[string]int
+	total int
+}
+
+type fakeFile struct {
+	data    string
+	version int
+}
+
+// Set sets the content of the file with the given path,
+// which must begin with a slash, making a new version of the file.
+func (l *FakeLoader) Set(path, data string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.files == nil {
+		l.files = make(map[string]fakeFile)
+	}
+	f := l.files[path]
+	l.files[path] = fakeFile{data, f.version + 1}
+}
+
+// Remove removes the file with the given path.
+func (l *FakeLoader) Remove(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.files, path)
+}
+
+// Loads returns the number of loads of the file with the given path,
+// or of all files if path is empty, including loads that failed
+// or found the cached copy still valid.
+func (l *FakeLoader) Loads(path string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if path == "" {
+		return l.total
+	}
+	return l.loads[path]
+}
+
+// Load implements diskcache.Loader.
+func (l *FakeLoader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	l.mu.Lock()
+	if l.loads == nil {
+		l.loads = make(map[string]int)
+	}
+	l.loads[path]++
+	l.total++
+	l.mu.Unlock()
+
+	if l.Latency > 0 {
+		time.Sleep(l.Latency)
+	}
+	if l.Err != nil {
+		if err := l.Err(path); err != nil {
+			return false, nil, err
+		}
+	}
+
+	l.mu.Lock()
+	f, ok := l.files[path]
+	l.mu.Unlock()
+	if !ok {
+		return false, nil, &os.PathError{Path: path, Op: "load", Err: diskcache.ErrNotFound}
+	}
+	version := strconv.Itoa(f.version)
+	if string(meta) == version {
+		return true, meta, nil
+	}
+	if _, err := target.WriteString(f.data); err != nil {
+		return false, nil, fmt.Errorf("writing %s: %v", path, err)
+	}
+	return false, []byte(version), nil
+}
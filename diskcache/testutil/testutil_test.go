@@ -0,0 +1,70 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFakeLoader(t *testing.T) {
+	l := new(FakeLoader)
+	l.Set("/a", "hello")
+	c, cleanup := NewTempCache(t, l)
+	defer cleanup()
+
+	read := func(path string) (string, error) {
+		data, err := c.ReadFile(path)
+		return string(data), err
+	}
+
+	if s, err := read("/a"); s != "hello" || err != nil || l.Loads("/a") != 1 {
+		t.Fatalf("read /a = %q, %v after %d loads, want %q after 1", s, err, l.Loads("/a"), "hello")
+	}
+
+	// An unchanged file revalidates; a changed one reloads.
+	c.Expire("/a")
+	if s, _ := read("/a"); s != "hello" || l.Loads("/a") != 2 {
+		t.Fatalf("read unchanged /a = %q after %d loads, want %q after 2", s, l.Loads("/a"), "hello")
+	}
+	l.Set("/a", "goodbye")
+	c.Expire("/a")
+	if s, _ := read("/a"); s != "goodbye" {
+		t.Fatalf("read changed /a = %q, want %q", s, "goodbye")
+	}
+
+	if _, err := read("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("read /missing: %v, want not-exist error", err)
+	}
+
+	// Hooks add latency and inject errors.
+	errDown := errors.New("remote down")
+	l.Latency = 20 * time.Millisecond
+	l.Err = func(path string) error { return errDown }
+	start := time.Now()
+	if _, err := c.Open("/b"); !errors.Is(err, errDown) {
+		t.Fatalf("Open with Err hook: %v, want %v", err, errDown)
+	}
+	if d := time.Since(start); d < l.Latency {
+		t.Fatalf("Open returned after %v, before latency %v", d, l.Latency)
+	}
+	if n := l.Loads(""); n != 5 {
+		t.Fatalf("%d loads in all, want 5", n)
+	}
+}
+
+func BenchmarkCachedRead(b *testing.B) {
+	l := new(FakeLoader)
+	l.Set("/a", "hello")
+	c, cleanup := NewTempCache(b, l)
+	defer cleanup()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ReadFile("/a"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
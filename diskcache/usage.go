@@ -0,0 +1,74 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"sync"
+	"time"
+)
+
+// usageReconcile is how often DiskUsage rescans the cache directory.
+// Between scans, it reports a running total maintained as this cache
+// installs and removes copies. The running total does not account for
+// changes made by other caches sharing the directory; the scan does.
+const usageReconcile = 1 * time.Minute
+
+// usage is the running total of cached data.
+type usage struct {
+	mu      sync.Mutex
+	valid   bool      // bytes and entries are known
+	bytes   int64     // total size of .data files and partial copies
+	entries int       // number of .data files and partial copies
+	scanned time.Time // time of last scan
+}
+
+// DiskUsage returns the total size of the cached copies and their number.
+// It counts partial copies (see OpenRange), including first downloads
+// of files in progress, but not metadata or new versions of cached copies
+// being downloaded.
+// DiskUsage usually returns a running total maintained in memory,
+// periodically reconciled with a scan of the cache directory.
+func (c *Cache) DiskUsage() (bytes int64, entries int, err error) {
+	u := &c.usage
+	u.mu.Lock()
+	if u.valid && time.Since(u.scanned) < usageReconcile {
+		bytes, entries = u.bytes, u.entries
+		u.mu.Unlock()
+		return bytes, entries, nil
+	}
+	u.mu.Unlock()
+
+	list, err := c.scan()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range list {
+		bytes += e.size
+	}
+	c.setUsage(bytes, len(list))
+	return bytes, len(list), nil
+}
+
+// setUsage records the result of a scan of the cache directory.
+func (c *Cache) setUsage(bytes int64, entries int) {
+	u := &c.usage
+	u.mu.Lock()
+	u.valid = true
+	u.bytes = bytes
+	u.entries = entries
+	u.scanned = time.Now()
+	u.mu.Unlock()
+}
+
+// addUsage adjusts the running total after installing or removing a copy.
+func (c *Cache) addUsage(bytes int64, entries int) {
+	u := &c.usage
+	u.mu.Lock()
+	if u.valid {
+		u.bytes += bytes
+		u.entries += entries
+	}
+	u.mu.Unlock()
+}
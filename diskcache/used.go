@@ -0,0 +1,120 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// usedFlusher holds uses of cached copies not yet written to .used files
+// (see SetUsedFlushInterval).
+type usedFlusher struct {
+	mu       sync.Mutex
+	interval time.Duration
+	pending  map[string]time.Time // last use, by prefix
+	timer    *time.Timer          // pending flush, if any
+}
+
+// SetUsedFlushInterval sets how often the cache writes recorded uses
+// of cached copies to their .used files. By default (an interval of zero),
+// each Open writes the .used file of the copy it opens before returning.
+// With a positive interval, Open only notes the use in memory,
+// and the cache writes the uses noted since the last flush in a batch,
+// at most one interval later, keeping file writes out of the request path.
+// Eviction, Stat, WaitIdle, and Close see uses not yet written.
+// Uses not yet written when the program exits are lost,
+// so a program setting an interval should call Close before exiting.
+func (c *Cache) SetUsedFlushInterval(d time.Duration) {
+	u := &c.used
+	u.mu.Lock()
+	u.interval = d
+	u.mu.Unlock()
+	if d <= 0 {
+		c.flushUsed()
+	}
+}
+
+// deferTouch notes a use of the cached copy for prefix, to be written
+// by a later flush, reporting whether it did. If it reports false,
+// uses are not batched, and the caller must write the .used file itself.
+func (c *Cache) deferTouch(prefix string) bool {
+	u := &c.used
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.interval <= 0 {
+		return false
+	}
+	if u.pending == nil {
+		u.pending = make(map[string]time.Time)
+	}
+	u.pending[prefix] = time.Now()
+	if u.timer == nil {
+		u.timer = time.AfterFunc(u.interval, c.flushUsed)
+	}
+	return true
+}
+
+// pendingUse returns the time of the last use of the copy for prefix
+// not yet written to its .used file, if any.
+func (c *Cache) pendingUse(prefix string) (time.Time, bool) {
+	u := &c.used
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	t, ok := u.pending[prefix]
+	return t, ok
+}
+
+// flushUsed writes the pending uses to their .used files.
+func (c *Cache) flushUsed() {
+	u := &c.used
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = nil
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+	u.mu.Unlock()
+
+	for prefix, t := range pending {
+		c.writeUsed(prefix, t)
+	}
+}
+
+// writeUsed writes t as the last use of the copy for prefix.
+// It creates the .used file only while holding the entry lock,
+// so that it cannot leave a .used file behind for an entry
+// being evicted or deleted. If another client holds the lock,
+// writeUsed only updates an existing .used file.
+func (c *Cache) writeUsed(prefix string, t time.Time) {
+	metaFile, err := c.tryMetaLock(prefix)
+	if err != nil {
+		if err == syscall.EWOULDBLOCK {
+			os.Chtimes(prefix+".used", t, t)
+		}
+		return
+	}
+	defer metaFile.Close()
+	if _, err := os.Stat(prefix + ".data"); err != nil {
+		// Deleted or evicted since the use.
+		return
+	}
+	if err := os.Chtimes(prefix+".used", t, t); err != nil {
+		ioutil.WriteFile(prefix+".used", []byte("\n"), 0666)
+		os.Chtimes(prefix+".used", t, t)
+	}
+}
+
+// Close writes any uses of cached copies not yet written to disk
+// (see SetUsedFlushInterval). The cache remains usable after Close,
+// but a program should call Close before exiting.
+func (c *Cache) Close() error {
+	c.flushUsed()
+	return nil
+}
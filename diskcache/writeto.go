@@ -0,0 +1,41 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufs holds buffers for WriteTo.
+var copyBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// WriteTo writes the content of the file with the given path to w,
+// loading or revalidating the file as Open does,
+// and returns the number of bytes written.
+// If w implements io.ReaderFrom, as *os.File, network connections,
+// and net/http's response writers do, WriteTo lets it read the cached copy,
+// which on some systems copies the data in the kernel (using sendfile).
+// Otherwise WriteTo copies the data using a buffer from a shared pool,
+// allocating none of its own.
+func (c *Cache) WriteTo(path string, w io.Writer) (int64, error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(f)
+	}
+	bp := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(bp)
+	// Hide f's WriteTo method, so that io.CopyBuffer uses the buffer.
+	return io.CopyBuffer(w, struct{ io.Reader }{f}, *bp)
+}
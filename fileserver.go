@@ -0,0 +1,312 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"net/http"
+	pathpkg "path"
+	"strings"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// DefaultCacheControl is the Cache-Control header a file server sends
+// for paths not matched by DirOptions.CacheControl.
+const DefaultCacheControl = "public, max-age=300"
+
+// DefaultContentTypes maps file name extensions to the Content-Type
+// a file server sends for them, overriding both the type recorded
+// from the origin and the type the standard library would choose.
+// It lists formats that are commonly mislabeled or missing
+// from system MIME tables. See DirOptions.ContentTypes.
+var DefaultContentTypes = map[string]string{
+	".avif":        "image/avif",
+	".mjs":         "text/javascript; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+// DirOptions holds optional settings for a file server created by FileServer.
+type DirOptions struct {
+	// CacheControl, if non-nil, reports the Cache-Control header to send
+	// for the file with the given path, which is relative to the served root
+	// and begins with a slash. If CacheControl returns ok == false,
+	// the file server sends DefaultCacheControl instead.
+	//
+	// For example, content-hashed file names like app.abc123.js are immutable
+	// and can be served with "public, max-age=31536000, immutable".
+	CacheControl func(path string) (cacheControl string, ok bool)
+
+	// DirListing specifies whether to serve an HTML listing
+	// of a directory that has no index.html file.
+	// Listings are only available if the cache's loader
+	// implements diskcache.Lister. Each listing carries an ETag
+	// derived from its entries, so that clients revalidating
+	// an unchanged listing receive 304 Not Modified.
+	DirListing bool
+
+	// Compress specifies whether to compress responses on the fly
+	// for clients that accept it, as CompressHandler does.
+	// Range requests are served uncompressed.
+	// See CompressHandler for details.
+	Compress bool
+
+	// CacheCompressed specifies whether to store gzip-compressed copies
+	// of compressible files in the cache, as entries of their own
+	// (see diskcache.Cache.OpenDerived), and serve them to clients that
+	// accept gzip. Each file is then compressed once per download
+	// rather than once per request. Range requests are served uncompressed,
+	// and clients that do not accept gzip are served the file itself.
+	CacheCompressed bool
+
+	// NoCache, if non-nil, reports whether the file with the given path,
+	// which is relative to the served root and begins with a slash,
+	// must bypass the cache. The file server loads such files
+	// directly from the cache's loader for each request, using
+	// diskcache.Cache.Fetch, and never stores them in the shared cache.
+	// NoCache is meant for per-user content; such responses should
+	// usually also be marked private using CacheControl.
+	NoCache func(path string) bool
+
+	// ContentTypes maps file name extensions, such as ".wasm",
+	// to the Content-Type to send for files with those extensions.
+	// Its entries are added to DefaultContentTypes, replacing
+	// entries for the same extensions; an entry with an empty type
+	// removes the default for its extension. Extensions are matched
+	// without regard to case. The types take precedence over both the
+	// type recorded from the origin and the type the standard library
+	// would choose from the extension or by sniffing the content.
+	ContentTypes map[string]string
+
+	// Push, if non-nil, reports the resources to push to the client
+	// using HTTP/2 server push when serving the file with the given path,
+	// which is relative to the served root and begins with a slash.
+	// For example, an HTML page might push its style sheets and scripts.
+	// The targets are paths as the client requests them, beginning
+	// with a slash, and the pushed requests are served by the same
+	// server as ordinary requests. The file server pushes only with
+	// a 200 OK response, not with errors, redirects, or 304 Not Modified,
+	// and it pushes nothing if the connection does not support push.
+	Push func(path string) []string
+
+	// IndexNames lists the names of the index documents to serve
+	// for a request for a directory, such as "index.html" or
+	// "default.html", in order of preference. The file server serves
+	// the first one the directory has. If IndexNames is nil,
+	// the only index document is index.html.
+	// When the cache's loader implements diskcache.StatLoader,
+	// the file server looks for index documents using
+	// diskcache.Cache.OpenMeta, without loading the files it rejects.
+	IndexNames []string
+}
+
+// FileServer returns an http.Handler serving files from the cached
+// subtree rooted at dir. It behaves like http.FileServer(Dir(cache, dir))
+// but also applies the settings in opts, which may be nil.
+//
+// Like a conventional web server, FileServer treats a path as a directory
+// if it has an index.html file (or another index document named in
+// opts.IndexNames). A request for /dir/ serves /dir/index.html
+// directly, without looking for a file named /dir, while a request for /dir
+// that has no file of its own is redirected to /dir/ (301 Moved Permanently).
+// A request for /dir/index.html is redirected to /dir/.
+//
+// A typical use of FileServer is:
+//
+//	http.Handle("/static/", http.StripPrefix("/static", cloud.FileServer(cache, "/myfiles", nil)))
+func FileServer(cache *diskcache.Cache, dir string, opts *DirOptions) http.Handler {
+	s := &fileServer{fs: &fileSystem{c: cache, root: dir}}
+	if opts != nil {
+		s.opts = *opts
+	}
+	s.fs.listing = s.opts.DirListing
+	s.fs.noCache = s.opts.NoCache
+	s.fs.cacheGzip = s.opts.CacheCompressed
+	s.fs.index = s.opts.IndexNames
+	s.types = make(map[string]string)
+	for ext, typ := range DefaultContentTypes {
+		s.types[ext] = typ
+	}
+	for ext, typ := range s.opts.ContentTypes {
+		ext = strings.ToLower(ext)
+		if typ == "" {
+			delete(s.types, ext)
+		} else {
+			s.types[ext] = typ
+		}
+	}
+	return s
+}
+
+type fileServer struct {
+	fs    *fileSystem
+	opts  DirOptions
+	types map[string]string // Content-Type overrides, by lower-case extension
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := pathpkg.Clean("/" + r.URL.Path)
+	resp := w
+	if s.opts.CacheControl != nil {
+		cc, ok := s.opts.CacheControl(path)
+		if !ok {
+			cc = DefaultCacheControl
+		}
+		resp = &cacheControlWriter{ResponseWriter: w, cc: cc}
+	}
+	if typ, ok := s.types[strings.ToLower(pathpkg.Ext(path))]; ok {
+		w.Header().Set("Content-Type", typ)
+	}
+
+	if s.opts.Push != nil && r.Method == "GET" {
+		if p, ok := w.(http.Pusher); ok {
+			resp = &pushWriter{ResponseWriter: resp, pusher: p, push: func() []string { return s.opts.Push(path) }}
+		}
+	}
+
+	// Serve through a per-request copy of the file system,
+	// so that Open can set headers for files stored compressed.
+	fs := *s.fs
+	rw := &rawEncodingWriter{ResponseWriter: resp}
+	fs.w = rw
+	fs.raw = func(coding string) bool {
+		return r.Header.Get("Range") == "" && acceptsEncoding(r, coding)
+	}
+	files := http.FileServer(&fs)
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveIndex(&fs, w, r) && !listingNotModified(&fs, w, r) {
+			files.ServeHTTP(w, r)
+		}
+	})
+	if s.opts.Compress {
+		h = CompressHandler(h)
+	}
+	h.ServeHTTP(rw, r)
+}
+
+// A cacheControlWriter sets the Cache-Control header of a successful
+// response, so that a long lifetime meant for a file is not applied
+// to an error, such as a 404 for a missing fingerprinted path.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	cc          string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < 300 || code == http.StatusNotModified {
+			w.Header().Set("Cache-Control", w.cc)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheControlWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// A pushWriter pushes resources to the client once the response
+// turns out to be a 200 OK, so that nothing is pushed with an error,
+// a redirect, or a 304 Not Modified response.
+type pushWriter struct {
+	http.ResponseWriter
+	pusher      http.Pusher
+	push        func() []string
+	wroteHeader bool
+}
+
+func (w *pushWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK {
+			for _, target := range w.push() {
+				// Errors mean push is unavailable or refused;
+				// the client will request the resource itself.
+				if err := w.pusher.Push(target, nil); err != nil {
+					break
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *pushWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// serveIndex serves the index document for a request for a directory path,
+// one ending in a slash, reporting whether it did.
+func serveIndex(fs *fileSystem, w http.ResponseWriter, r *http.Request) bool {
+	upath := r.URL.Path
+	if !strings.HasSuffix(upath, "/") {
+		return false
+	}
+	name, ok := fs.findIndex(pathpkg.Clean("/" + upath))
+	if !ok {
+		return false
+	}
+	f, err := fs.openFile(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	http.ServeContent(w, r, pathpkg.Base(name), fi.ModTime(), f)
+	return true
+}
+
+// listingNotModified responds 304 Not Modified to a conditional request
+// for a directory listing whose ETag matches the request's If-None-Match
+// header, reporting whether it did.
+func listingNotModified(fs *fileSystem, w http.ResponseWriter, r *http.Request) bool {
+	inm := r.Header.Get("If-None-Match")
+	if !fs.listing || inm == "" || !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	f, err := fs.Open(pathpkg.Clean("/" + r.URL.Path))
+	if err != nil {
+		return false
+	}
+	f.Close()
+	if _, ok := f.(*listDir); !ok || !etagMatch(inm, w.Header().Get("Etag")) {
+		return false
+	}
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch reports whether the If-None-Match header value inm
+// matches etag, using the weak comparison RFC 7232 specifies.
+func etagMatch(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
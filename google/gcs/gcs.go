@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	pathpkg "path"
+	"strconv"
 	"strings"
 
 	"golang.org/x/oauth2"
@@ -20,6 +21,9 @@ import (
 
 const scopeReadOnly = "https://www.googleapis.com/auth/devstorage.read_only"
 
+// storageURL is the base URL for the XML API.
+const storageURL = "https://storage.googleapis.com/"
+
 func NewLoader(root string) (diskcache.Loader, error) {
 	client, err := google.DefaultClient(oauth2.NoContext, scopeReadOnly)
 	if err != nil {
@@ -32,16 +36,31 @@ func NewLoaderWithClient(client *http.Client, root string) diskcache.Loader {
 	l := &loader{
 		client: client,
 		root:   root,
+		base:   storageURL,
 	}
 	return l
 }
 
+// NewAnonymousLoader returns a loader that fetches objects under root
+// without credentials, using http.DefaultClient.
+// It can only load objects that are publicly readable,
+// but it works on machines with no Google credentials at all.
+func NewAnonymousLoader(root string) diskcache.Loader {
+	return NewLoaderWithClient(http.DefaultClient, root)
+}
+
 type loader struct {
 	client *http.Client
 	root   string
+	base   string // base URL for XML API
 }
 
 func (l *loader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	return l.LoadStream(path, target, meta)
+}
+
+// LoadStream implements diskcache.StreamLoader.
+func (l *loader) LoadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error) {
 	path = pathpkg.Join("/", l.root, path)[1:]
 	println("LOAD", path)
 	defer func() {
@@ -65,34 +84,164 @@ func (l *loader) Load(path string, target *os.File, meta []byte) (cacheValid boo
 	// Also I seem to get 404s when I try even the correct JSON URL here,
 	// although somehow not from curl. This is clearly a giant mess.
 	// There may be an escaping problem lurking here even with the XML API. Not clear.
+	// NewJSONLoader offers the JSON API, escaping object names as shown above.
 
-	url := "https://storage.googleapis.com/" + path
+	url := l.base + path
 	println("URL", url)
+	m := diskcache.ParseLoadMeta(meta)
 	req, err := http.NewRequest("GET", url, nil)
-	if len(meta) > 0 {
-		req.Header.Set("If-None-Match", string(meta))
+	if err != nil {
+		return false, nil, err
+	}
+	if m.ETag != "" {
+		req.Header.Set("If-None-Match", m.ETag)
+	}
+	if !m.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", m.LastModified.UTC().Format(http.TimeFormat))
 	}
 	resp, err := l.client.Do(req)
 	if err != nil {
-		return false, nil, err
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 304 {
-		return true, meta, nil
+		if meta == nil {
+			// Not a conditional request, and there is no copy to reuse.
+			return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("unexpected %s", resp.Status)}
+		}
+		// Re-encode the metadata, which upgrades a bare ETag
+		// stored by older versions of this loader.
+		return true, m.Marshal(), nil
 	}
 	if resp.StatusCode != 200 {
-		if resp.StatusCode == 404 {
-			return false, nil, &os.PathError{Path: path, Op: "read", Err: os.ErrNotExist}
-		}
-		return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%s", resp.Status)}
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: statusError(resp)}
 	}
 
 	// TODO(rsc): Maybe work harder with range requests to restart interrupted transfers.
-	_, err = io.Copy(target, resp.Body)
+	n, err := io.Copy(target, resp.Body)
 	if err != nil {
-		return false, nil, err
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+	}
+
+	m = &diskcache.LoadMeta{
+		ETag:            resp.Header.Get("Etag"),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		Size:            n,
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.LastModified = t
+	}
+	m.MustRevalidate = hasDirective(resp.Header.Get("Cache-Control"), "must-revalidate")
+	return false, m.Marshal(), nil
+}
+
+// LoadRange implements diskcache.RangeLoader.
+// It fetches the range with an HTTP Range request and, if meta is non-nil,
+// an If-Match header naming the ETag of the version loaded earlier.
+func (l *loader) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (size int64, newMeta []byte, err error) {
+	path = pathpkg.Join("/", l.root, path)[1:]
+	if !strings.Contains(path, "/") {
+		return 0, nil, fmt.Errorf("path too short")
+	}
+	req, err := http.NewRequest("GET", l.base+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	// A Range request for zero bytes is invalid; fetch one and discard it.
+	want := n
+	if n == 0 {
+		n = 1
+	}
+	if n < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	}
+	if meta != nil {
+		m := diskcache.ParseLoadMeta(meta)
+		if m.ETag == "" {
+			// Cannot tell whether the object has changed.
+			return 0, nil, diskcache.ErrChanged
+		}
+		req.Header.Set("If-Match", m.ETag)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
 	}
+	defer resp.Body.Close()
 
-	meta = []byte(resp.Header.Get("Etag"))
-	return false, meta, nil
+	body := io.Reader(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// Content-Range: bytes first-last/size or bytes */size.
+		cr := resp.Header.Get("Content-Range")
+		i := strings.LastIndex(cr, "/")
+		if i < 0 {
+			return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("invalid Content-Range %q", cr)}
+		}
+		size, err = strconv.ParseInt(cr[i+1:], 10, 64)
+		if err != nil {
+			return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("invalid Content-Range %q", cr)}
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			body = strings.NewReader("") // off is at or past the end
+		}
+	case http.StatusOK:
+		// The server ignored the Range header and sent the entire object.
+		size = resp.ContentLength
+		if size < 0 {
+			return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("response has no Content-Length")}
+		}
+		if _, err := io.CopyN(io.Discard, body, off); err != nil && err != io.EOF {
+			return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+		}
+	case http.StatusPreconditionFailed:
+		return 0, nil, diskcache.ErrChanged
+	default:
+		return 0, nil, &os.PathError{Path: path, Op: "read", Err: statusError(resp)}
+	}
+	if want >= 0 {
+		body = io.LimitReader(body, want)
+	}
+	if _, err := io.Copy(target, body); err != nil {
+		return 0, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+	}
+
+	m := &diskcache.LoadMeta{
+		ETag:        resp.Header.Get("Etag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        size,
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.LastModified = t
+	}
+	m.MustRevalidate = hasDirective(resp.Header.Get("Cache-Control"), "must-revalidate")
+	return size, m.Marshal(), nil
+}
+
+// statusError returns the error for the unsuccessful response resp,
+// classified for the cache (see diskcache.ErrNotFound).
+func statusError(resp *http.Response) error {
+	if resp.StatusCode == 404 {
+		// Keep os.IsNotExist working; the cache treats ErrNotFound as 404.
+		return diskcache.ErrNotFound
+	}
+	return &diskcache.StatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// hasDirective reports whether the Cache-Control header value cc
+// contains the directive name.
+func hasDirective(cc, name string) bool {
+	for _, f := range strings.Split(cc, ",") {
+		f = strings.TrimSpace(f)
+		if i := strings.Index(f, "="); i >= 0 {
+			f = f[:i]
+		}
+		if strings.EqualFold(f, name) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,304 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func tempFile(t *testing.T) (f *os.File, cleanup func()) {
+	f, err := ioutil.TempFile("", "gcs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func TestLoadBadURL(t *testing.T) {
+	f, cleanup := tempFile(t)
+	defer cleanup()
+
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Load sent request for %s", req.URL)
+		return nil, errors.New("unexpected request")
+	})}
+	l := NewLoaderWithClient(client, "/")
+	_, _, err := l.Load("bucket/bad%zzescape", f, []byte(`"etag"`))
+	var escErr url.EscapeError
+	if !errors.As(err, &escErr) || string(escErr) != "%zz" {
+		t.Fatalf("Load with invalid URL: err = %v, want URL escape error for %%zz", err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestAnonymousLoader(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		if r.URL.Path != "/bucket/dir/file" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("public data"))
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+
+	l := NewAnonymousLoader("bucket/dir")
+	l.(*loader).base = srv.URL + "/"
+	if _, _, err := l.Load("file", f, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil || string(data) != "public data" {
+		t.Fatalf("loaded %q, %v, want %q, nil", data, err, "public data")
+	}
+	if len(auth) != 1 || auth[0] != "" {
+		t.Fatalf("Authorization headers = %q, want one empty header", auth)
+	}
+}
+
+func TestLoadEmptyETag(t *testing.T) {
+	lastModified := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("request has If-None-Match: %q", r.Header.Get("If-None-Match"))
+		}
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(304)
+			return
+		}
+		// A proxy that sends an empty ETag.
+		w.Header()["Etag"] = []string{""}
+		w.Header().Set("Last-Modified", lastModified)
+		downloads++
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	l := NewAnonymousLoader("bucket")
+	l.(*loader).base = srv.URL + "/"
+
+	valid, meta, err := l.Load("file", f, nil)
+	if valid || err != nil || meta == nil {
+		t.Fatalf("first Load = %v, %q, %v, want false, metadata, nil", valid, meta, err)
+	}
+	for i := 0; i < 2; i++ {
+		valid, meta, err = l.Load("file", f, meta)
+		if !valid || err != nil {
+			t.Fatalf("revalidating Load = %v, %q, %v, want true, metadata, nil", valid, meta, err)
+		}
+	}
+	if downloads != 1 {
+		t.Fatalf("downloaded %d times, want 1", downloads)
+	}
+}
+
+func TestList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket" || r.URL.Query().Get("delimiter") != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		switch prefix, marker := r.URL.Query().Get("prefix"), r.URL.Query().Get("marker"); {
+		case prefix == "dir/" && marker == "":
+			w.Write([]byte(`<ListBucketResult><IsTruncated>true</IsTruncated><NextMarker>dir/b</NextMarker>` +
+				`<Contents><Key>dir/a</Key><Size>10</Size></Contents>` +
+				`<Contents><Key>dir/b</Key><Size>20</Size></Contents></ListBucketResult>`))
+		case prefix == "dir/" && marker == "dir/b":
+			w.Write([]byte(`<ListBucketResult><IsTruncated>false</IsTruncated>` +
+				`<CommonPrefixes><Prefix>dir/sub/</Prefix></CommonPrefixes></ListBucketResult>`))
+		default:
+			w.Write([]byte(`<ListBucketResult></ListBucketResult>`))
+		}
+	}))
+	defer srv.Close()
+
+	l := NewAnonymousLoader("bucket")
+	l.(*loader).base = srv.URL + "/"
+	list, err := l.(diskcache.Lister).List("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diskcache.ListEntry{{Name: "a", Size: 10}, {Name: "b", Size: 20}, {Name: "sub", IsDir: true}}
+	if fmt.Sprint(list) != fmt.Sprint(want) {
+		t.Errorf("List(/dir) = %v, want %v", list, want)
+	}
+	if _, err := l.(diskcache.Lister).List("/nodir"); !os.IsNotExist(err) {
+		t.Errorf("List(/nodir) = %v, want not-exist error", err)
+	}
+}
+
+func TestLoadErrorClass(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/bucket/"))
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	l := NewAnonymousLoader("bucket")
+	l.(*loader).base = srv.URL + "/"
+
+	for _, tt := range []struct {
+		code int
+		want error
+	}{
+		{404, diskcache.ErrNotFound},
+		{401, diskcache.ErrPermission},
+		{403, diskcache.ErrPermission},
+		{500, diskcache.ErrTransient},
+		{503, diskcache.ErrTransient},
+		{429, diskcache.ErrTransient},
+	} {
+		_, _, err := l.Load(strconv.Itoa(tt.code), f, nil)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Load with status %d: %v, want error wrapping %v", tt.code, err, tt.want)
+		}
+	}
+	_, _, err := l.Load("400", f, nil)
+	if err == nil || errors.Is(err, diskcache.ErrNotFound) || errors.Is(err, diskcache.ErrPermission) || errors.Is(err, diskcache.ErrTransient) {
+		t.Errorf("Load with status 400: %v, want unclassified error", err)
+	}
+	if _, _, err := l.Load("404", f, nil); !os.IsNotExist(err) {
+		t.Errorf("Load with status 404: %v, want os.IsNotExist", err)
+	}
+
+	srv.Close()
+	if _, _, err := l.Load("200", f, nil); !errors.Is(err, diskcache.ErrTransient) {
+		t.Errorf("Load from closed server: %v, want error wrapping %v", err, diskcache.ErrTransient)
+	}
+}
+
+func TestLoadRange(t *testing.T) {
+	content := "0123456789abcdefghij"
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", etag)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	l := NewAnonymousLoader("bucket").(*loader)
+	l.base = srv.URL + "/"
+	var buf bytes.Buffer
+	size, meta, err := l.LoadRange("file", &buf, 5, 3, nil)
+	if size != 20 || err != nil || buf.String() != "567" {
+		t.Fatalf("LoadRange(5, 3) = %d, %v, wrote %q, want 20, nil, %q", size, err, buf.String(), "567")
+	}
+	buf.Reset()
+	if _, _, err := l.LoadRange("file", &buf, 15, -1, meta); err != nil || buf.String() != "fghij" {
+		t.Fatalf("LoadRange(15, -1) = %v, wrote %q, want nil, %q", err, buf.String(), "fghij")
+	}
+	buf.Reset()
+	if size, _, err := l.LoadRange("file", &buf, 30, 5, meta); size != 20 || err != nil || buf.Len() != 0 {
+		t.Fatalf("LoadRange(30, 5) = %d, %v, wrote %q, want 20, nil, nothing", size, err, buf.String())
+	}
+
+	etag = `"v2"`
+	if _, _, err := l.LoadRange("file", &buf, 0, 5, meta); err != diskcache.ErrChanged {
+		t.Fatalf("LoadRange of changed file = %v, want ErrChanged", err)
+	}
+}
+
+func TestJSONLoader(t *testing.T) {
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/storage/v1/b/bucket/o/dir%2Fweb%2Findex.html" || r.URL.Query().Get("alt") != "media" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("ifGenerationNotMatch") == "42" {
+			w.WriteHeader(304)
+			return
+		}
+		downloads++
+		w.Header().Set("X-Goog-Generation", "42")
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<h1>hi</h1>"))
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+
+	l := NewJSONLoaderWithClient(http.DefaultClient, "bucket/dir")
+	l.(*jsonLoader).base = srv.URL + "/storage/v1/"
+	valid, meta, err := l.Load("/web/index.html", f, nil)
+	if valid || err != nil {
+		t.Fatalf("Load = %v, %v, want false, nil", valid, err)
+	}
+	m := diskcache.ParseLoadMeta(meta)
+	if m.ETag != `"42"` || m.ContentType != "text/html" || m.Size != 11 {
+		t.Fatalf("Load metadata = %+v, want generation 42, text/html, 11 bytes", m)
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "<h1>hi</h1>" {
+		t.Fatalf("loaded %q, want %q", data, "<h1>hi</h1>")
+	}
+	if valid, _, err := l.Load("/web/index.html", f, meta); !valid || err != nil || downloads != 1 {
+		t.Fatalf("revalidating Load = %v, %v after %d downloads, want true, nil after 1", valid, err, downloads)
+	}
+	if _, _, err := l.Load("/missing", f, nil); !errors.Is(err, diskcache.ErrNotFound) {
+		t.Fatalf("Load(/missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestJSONList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" || r.URL.Query().Get("delimiter") != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		switch prefix, token := r.URL.Query().Get("prefix"), r.URL.Query().Get("pageToken"); {
+		case prefix == "dir/" && token == "":
+			w.Write([]byte(`{"kind": "storage#objects", "nextPageToken": "page2",
+				"items": [{"name": "dir/a", "size": "10"}, {"name": "dir/b", "size": "20"}]}`))
+		case prefix == "dir/" && token == "page2":
+			w.Write([]byte(`{"kind": "storage#objects", "prefixes": ["dir/sub/"]}`))
+		default:
+			w.Write([]byte(`{"kind": "storage#objects"}`))
+		}
+	}))
+	defer srv.Close()
+
+	l := NewJSONLoaderWithClient(http.DefaultClient, "bucket")
+	l.(*jsonLoader).base = srv.URL + "/storage/v1/"
+	list, err := l.(diskcache.Lister).List("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diskcache.ListEntry{{Name: "a", Size: 10}, {Name: "b", Size: 20}, {Name: "sub", IsDir: true}}
+	if fmt.Sprint(list) != fmt.Sprint(want) {
+		t.Errorf("List(/dir) = %v, want %v", list, want)
+	}
+	if _, err := l.(diskcache.Lister).List("/nodir"); !os.IsNotExist(err) {
+		t.Errorf("List(/nodir) = %v, want not-exist error", err)
+	}
+}
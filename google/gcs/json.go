@@ -0,0 +1,187 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"rsc.io/cloud/diskcache"
+)
+
+// jsonURL is the base URL for the JSON API.
+const jsonURL = "https://storage.googleapis.com/storage/v1/"
+
+// NewJSONLoader is like NewLoader but returns a loader using the
+// GCS JSON API instead of the XML API. See NewJSONLoaderWithClient.
+func NewJSONLoader(root string) (diskcache.Loader, error) {
+	client, err := google.DefaultClient(oauth2.NoContext, scopeReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLoaderWithClient(client, root), nil
+}
+
+// NewJSONLoaderWithClient is like NewLoaderWithClient but returns
+// a loader using the GCS JSON API instead of the XML API.
+// The JSON API names objects by escaped object name, so that
+// gs://swtch/web/index.html is read from
+//
+//	https://storage.googleapis.com/storage/v1/b/swtch/o/web%2Findex.html?alt=media
+//
+// The loader uses the object's generation number as its validator,
+// recording it as the ETag in the loader metadata (see diskcache.LoadMeta),
+// and revalidates with the ifGenerationNotMatch parameter.
+// Like the XML loader, it implements diskcache.Lister.
+func NewJSONLoaderWithClient(client *http.Client, root string) diskcache.Loader {
+	return &jsonLoader{
+		client: client,
+		root:   root,
+		base:   jsonURL,
+	}
+}
+
+type jsonLoader struct {
+	client *http.Client
+	root   string
+	base   string // base URL for JSON API
+}
+
+// split returns the bucket and object name for the cache path.
+func (l *jsonLoader) split(path string) (bucket, object string, err error) {
+	path = pathpkg.Join("/", l.root, path)[1:]
+	bucket, object, ok := strings.Cut(path, "/")
+	if !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("path too short")
+	}
+	return bucket, object, nil
+}
+
+// objectURL returns the JSON API URL for the object in bucket.
+func (l *jsonLoader) objectURL(bucket, object string) string {
+	return l.base + "b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object)
+}
+
+func (l *jsonLoader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	return l.LoadStream(path, target, meta)
+}
+
+// LoadStream implements diskcache.StreamLoader.
+func (l *jsonLoader) LoadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	bucket, object, err := l.split(path)
+	if err != nil {
+		return false, nil, err
+	}
+	m := diskcache.ParseLoadMeta(meta)
+	q := url.Values{"alt": {"media"}}
+	if gen := strings.Trim(m.ETag, `"`); gen != "" {
+		q.Set("ifGenerationNotMatch", gen)
+	}
+	resp, err := l.client.Get(l.objectURL(bucket, object) + "?" + q.Encode())
+	if err != nil {
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 304 {
+		if meta == nil {
+			// Not a conditional request, and there is no copy to reuse.
+			return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("unexpected %s", resp.Status)}
+		}
+		return true, m.Marshal(), nil
+	}
+	if resp.StatusCode != 200 {
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: statusError(resp)}
+	}
+
+	n, err := io.Copy(target, resp.Body)
+	if err != nil {
+		return false, nil, &os.PathError{Path: path, Op: "read", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+	}
+	m = &diskcache.LoadMeta{
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		Size:            n,
+	}
+	if gen := resp.Header.Get("X-Goog-Generation"); gen != "" {
+		m.ETag = strconv.Quote(gen)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.LastModified = t
+	}
+	m.MustRevalidate = hasDirective(resp.Header.Get("Cache-Control"), "must-revalidate")
+	return false, m.Marshal(), nil
+}
+
+// jsonList is the JSON API response to an object listing.
+type jsonList struct {
+	Items []struct {
+		Name string
+		Size string // decimal, as JSON API encodes 64-bit integers
+	}
+	Prefixes      []string
+	NextPageToken string
+}
+
+// List implements diskcache.Lister, as for the XML loader.
+func (l *jsonLoader) List(dir string) ([]diskcache.ListEntry, error) {
+	dir = pathpkg.Join("/", l.root, dir)[1:]
+	bucket, prefix := dir, ""
+	if i := strings.Index(dir, "/"); i >= 0 {
+		bucket, prefix = dir[:i], dir[i+1:]+"/"
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("path too short")
+	}
+
+	var list []diskcache.ListEntry
+	token := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		resp, err := l.client.Get(l.base + "b/" + url.PathEscape(bucket) + "/o?" + q.Encode())
+		if err != nil {
+			return nil, &os.PathError{Path: dir, Op: "list", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, &os.PathError{Path: dir, Op: "list", Err: statusError(resp)}
+		}
+		var r jsonList
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &os.PathError{Path: dir, Op: "list", Err: err}
+		}
+		for _, item := range r.Items {
+			if name := strings.TrimPrefix(item.Name, prefix); name != "" {
+				size, _ := strconv.ParseInt(item.Size, 10, 64)
+				list = append(list, diskcache.ListEntry{Name: name, Size: size})
+			}
+		}
+		for _, p := range r.Prefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+			list = append(list, diskcache.ListEntry{Name: name, IsDir: true})
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		token = r.NextPageToken
+	}
+	if len(list) == 0 && prefix != "" {
+		return nil, &os.PathError{Path: dir, Op: "list", Err: os.ErrNotExist}
+	}
+	return list, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strings"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// listResult is the XML API response to a bucket listing.
+type listResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key  string
+		Size int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// List implements diskcache.Lister, listing the objects and
+// subdirectories under a directory. Like the rest of GCS, it treats
+// slashes in object names as separating directories.
+func (l *loader) List(dir string) ([]diskcache.ListEntry, error) {
+	dir = pathpkg.Join("/", l.root, dir)[1:]
+	bucket, prefix := dir, ""
+	if i := strings.Index(dir, "/"); i >= 0 {
+		bucket, prefix = dir[:i], dir[i+1:]+"/"
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("path too short")
+	}
+
+	var list []diskcache.ListEntry
+	marker := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "delimiter": {"/"}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := l.client.Get(l.base + bucket + "?" + q.Encode())
+		if err != nil {
+			return nil, &os.PathError{Path: dir, Op: "list", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+		}
+		var r listResult
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, &os.PathError{Path: dir, Op: "list", Err: statusError(resp)}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &os.PathError{Path: dir, Op: "list", Err: err}
+		}
+		for _, c := range r.Contents {
+			if name := strings.TrimPrefix(c.Key, prefix); name != "" {
+				list = append(list, diskcache.ListEntry{Name: name, Size: c.Size})
+			}
+		}
+		for _, p := range r.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			list = append(list, diskcache.ListEntry{Name: name, IsDir: true})
+		}
+		if !r.IsTruncated || r.NextMarker == "" {
+			break
+		}
+		marker = r.NextMarker
+	}
+	if len(list) == 0 && prefix != "" {
+		return nil, &os.PathError{Path: dir, Op: "list", Err: os.ErrNotExist}
+	}
+	return list, nil
+}
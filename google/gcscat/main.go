@@ -2,6 +2,33 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Gcscat reads and manages Google Cloud Storage objects through a local cache.
+//
+// Usage:
+//
+//	gcscat [-anon] [-cache dir] [-expire interval] [-progress] command [arguments]
+//
+// The -progress flag prints periodic progress lines to standard error
+// while objects are downloaded. Objects served from the cache print nothing.
+//
+// The commands are:
+//
+//	cat [-v] [-head] [-range first-last] bucket/path...
+//		print the objects, loading them into the cache as needed
+//	ls bucket/dir...
+//		list the objects and subdirectories in the directories
+//	rm bucket/path...
+//		delete the cached copies of the objects (not the objects themselves)
+//	expire bucket/path...
+//		mark the cached copies of the objects as expired
+//
+// The cat -range flag prints only the given byte range of each object,
+// as in an HTTP Range header: -range 0-1023 prints the first 1024 bytes,
+// and -range 1000- prints everything from offset 1000 on.
+// Only the requested bytes are downloaded, if they are not already cached.
+//
+// For compatibility with earlier versions, if the first argument
+// is not a command, gcscat runs the cat command.
 package main
 
 import (
@@ -10,6 +37,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"rsc.io/cloud/diskcache"
 	"rsc.io/cloud/google/gcs"
@@ -18,51 +48,263 @@ import (
 var (
 	cache      *diskcache.Cache
 	exitStatus int
+
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
 )
 
 var (
 	flagExpire   = flag.Duration("expire", 0, "expiration `interval`")
 	flagCacheDir = flag.String("cache", "/tmp/gcscache", "store cache in `dir`")
+	flagAnon     = flag.Bool("anon", false, "load public objects without credentials")
+	flagProgress = flag.Bool("progress", false, "print download progress to standard error")
 )
 
+// A command is a gcscat subcommand.
+type command struct {
+	name  string
+	args  string // argument synopsis
+	short string // short description
+	run   func(args []string)
+}
+
+var commands []*command
+
+func init() {
+	// Initialized here to avoid an initialization loop through usage.
+	commands = []*command{
+		{"cat", "[-v] [-head] [-range first-last] bucket/path...", "print objects", runCat},
+		{"ls", "bucket/dir...", "list directories", runLs},
+		{"rm", "bucket/path...", "delete cached copies", runRm},
+		{"expire", "bucket/path...", "expire cached copies", runExpire},
+	}
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: gcscat bucket/path ...\n")
+	fmt.Fprintf(os.Stderr, "usage: gcscat [-anon] [-cache dir] [-expire interval] [-progress] command [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%s %s\n\t\t%s\n", cmd.name, cmd.args, cmd.short)
+	}
 	os.Exit(2)
 }
 
+func lookup(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("gcscat: ")
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() == 0 {
+	args := flag.Args()
+	if len(args) == 0 {
 		usage()
 	}
+	cmd := lookup(args[0])
+	if cmd == nil {
+		cmd = lookup("cat")
+	} else {
+		args = args[1:]
+	}
 
-	loader, err := gcs.NewLoader("/")
+	var loader diskcache.Loader
+	if *flagAnon {
+		loader = gcs.NewAnonymousLoader("/")
+	} else {
+		var err error
+		loader, err = gcs.NewLoader("/")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sl, ok := loader.(diskcache.StreamLoader); ok && *flagProgress {
+		loader = newProgressLoader(sl)
+	}
+	var err error
 	cache, err = diskcache.New(*flagCacheDir, loader)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if *flagExpire != 0 {
 		cache.SetExpiration(*flagExpire)
 	}
-	if err != nil {
-		log.Fatal(err)
+
+	cmd.run(args)
+	os.Exit(exitStatus)
+}
+
+// parse parses the flags in args for the command cmd,
+// returning the remaining arguments. It requires at least one argument.
+func parse(cmd *command, fs *flag.FlagSet, args []string) []string {
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gcscat %s %s\n", cmd.name, cmd.args)
+		exitStatus = 2
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil
 	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return nil
+	}
+	return fs.Args()
+}
 
-	for _, arg := range flag.Args() {
-		cat(arg)
+func runCat(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	verbose := fs.Bool("v", false, "print cached metadata to standard error")
+	head := fs.Bool("head", false, "print cached metadata instead of content")
+	rangeFlag := fs.String("range", "", "print only bytes `first-last` (or first-) of each object")
+	args = parse(lookup("cat"), fs, args)
+	if args == nil {
+		return
+	}
+	if *rangeFlag != "" {
+		off, n, err := parseRange(*rangeFlag)
+		if err != nil || *verbose || *head {
+			if err != nil {
+				fmt.Fprintf(stderr, "gcscat: %v\n", err)
+			} else {
+				fmt.Fprintf(stderr, "gcscat: -range cannot be used with -v or -head\n")
+			}
+			fs.Usage()
+			return
+		}
+		for _, arg := range args {
+			catRange(arg, off, n)
+		}
+		return
+	}
+	for _, arg := range args {
+		cat(arg, *verbose, *head)
 	}
-	os.Exit(exitStatus)
 }
 
-func cat(arg string) {
+// parseRange parses a byte range first-last or first-,
+// returning the offset and length, or -1 for an open-ended range.
+func parseRange(s string) (off, n int64, err error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	off, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	if last == "" {
+		return off, -1, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < off {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	return off, end - off + 1, nil
+}
+
+func catRange(arg string, off, n int64) {
+	r, err := cache.OpenRange(arg, off, n)
+	if err != nil {
+		log.Print(err)
+		exitStatus = 1
+		return
+	}
+	defer r.Close()
+	if _, err := io.Copy(stdout, r); err != nil {
+		exitStatus = 1
+	}
+}
+
+func cat(arg string, verbose, head bool) {
 	f, err := cache.Open(arg)
 	if err != nil {
 		log.Print(err)
 		exitStatus = 1
 		return
 	}
-	if _, err := io.Copy(os.Stdout, f); err != nil {
+	defer f.Close()
+	if head {
+		printMeta(stdout, arg)
+		return
+	}
+	if verbose {
+		printMeta(stderr, arg)
+	}
+	if _, err := io.Copy(stdout, f); err != nil {
 		exitStatus = 1
 	}
-	f.Close()
+}
+
+// printMeta prints the cached metadata for arg to w.
+func printMeta(w io.Writer, arg string) {
+	e, err := cache.Stat(arg)
+	if err != nil {
+		log.Print(err)
+		exitStatus = 1
+		return
+	}
+	m := diskcache.ParseLoadMeta(e.Meta)
+	fmt.Fprintf(w, "%s\n", arg)
+	fmt.Fprintf(w, "\tETag: %s\n", m.ETag)
+	fmt.Fprintf(w, "\tSize: %d\n", e.Size)
+	if m.ContentType != "" {
+		fmt.Fprintf(w, "\tContent-Type: %s\n", m.ContentType)
+	}
+	if !m.LastModified.IsZero() {
+		fmt.Fprintf(w, "\tLast-Modified: %s\n", m.LastModified.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "\tRefreshed: %s\n", e.RefreshTime.UTC().Format(time.RFC3339))
+}
+
+func runLs(args []string) {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dirs := parse(lookup("ls"), fs, args)
+	for _, dir := range dirs {
+		list, err := cache.List(dir)
+		if err != nil {
+			log.Print(err)
+			exitStatus = 1
+			continue
+		}
+		if len(dirs) > 1 {
+			fmt.Fprintf(stdout, "%s:\n", dir)
+		}
+		for _, e := range list {
+			if e.IsDir {
+				fmt.Fprintf(stdout, "%s/\n", e.Name)
+			} else {
+				fmt.Fprintf(stdout, "%s\t%d\n", e.Name, e.Size)
+			}
+		}
+	}
+}
+
+func runRm(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, arg := range parse(lookup("rm"), fs, args) {
+		if err := cache.Delete(arg); err != nil {
+			log.Print(err)
+			exitStatus = 1
+		}
+	}
+}
+
+func runExpire(args []string) {
+	fs := flag.NewFlagSet("expire", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, arg := range parse(lookup("expire"), fs, args) {
+		if err := cache.Expire(arg); err != nil {
+			log.Print(err)
+			exitStatus = 1
+		}
+	}
 }
@@ -0,0 +1,246 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// setup points the command at a cache backed by loader
+// and captures its output.
+func setup(t *testing.T, loader diskcache.Loader) (out, errOut *bytes.Buffer, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gcscat-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err = diskcache.New(dir, loader)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	out, errOut = new(bytes.Buffer), new(bytes.Buffer)
+	stdout, stderr = out, errOut
+	exitStatus = 0
+	return out, errOut, func() {
+		stdout, stderr = os.Stdout, os.Stderr
+		os.RemoveAll(dir)
+	}
+}
+
+func loadObject(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	n, _ := fmt.Fprintf(target, "content of %s\n", path)
+	m := &diskcache.LoadMeta{ETag: `"abc"`, ContentType: "text/plain", Size: int64(n)}
+	return false, m.Marshal(), nil
+}
+
+func TestHead(t *testing.T) {
+	out, _, cleanup := setup(t, diskcache.LoaderFunc(loadObject))
+	defer cleanup()
+
+	runCat([]string{"-head", "bucket/file"})
+	if exitStatus != 0 {
+		t.Fatalf("exit status %d", exitStatus)
+	}
+	for _, want := range []string{"bucket/file\n", "\tETag: \"abc\"\n", "\tSize: 24\n", "\tContent-Type: text/plain\n", "\tRefreshed: "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "content of") {
+		t.Errorf("-head printed content:\n%s", out)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	out, errOut, cleanup := setup(t, diskcache.LoaderFunc(loadObject))
+	defer cleanup()
+
+	runCat([]string{"-v", "bucket/file"})
+	if want := "content of /bucket/file\n"; out.String() != want {
+		t.Errorf("stdout = %q, want %q", out, want)
+	}
+	if !strings.Contains(errOut.String(), "\tETag: \"abc\"\n") {
+		t.Errorf("stderr missing metadata:\n%s", errOut)
+	}
+}
+
+func TestLs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bucket/dir/a.txt":     {Data: []byte("a")},
+		"bucket/dir/sub/b.txt": {Data: []byte("bb")},
+	}
+	out, _, cleanup := setup(t, diskcache.NewFSLoader(fsys))
+	defer cleanup()
+
+	runLs([]string{"bucket/dir"})
+	if want := "a.txt\t1\nsub/\n"; out.String() != want || exitStatus != 0 {
+		t.Errorf("ls output = %q, exit %d, want %q, exit 0", out, exitStatus, want)
+	}
+}
+
+func TestRmExpire(t *testing.T) {
+	loads := 0
+	_, _, cleanup := setup(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		return loadObject(path, target, meta)
+	}))
+	defer cleanup()
+
+	runCat([]string{"bucket/file"})
+	runExpire([]string{"bucket/file"})
+	if _, ok, _ := cache.ExpiresAt("bucket/file"); !ok {
+		t.Fatalf("expire removed cached copy")
+	}
+	if e, _ := cache.Stat("bucket/file"); e == nil || e.Expires.Unix() != 0 {
+		t.Fatalf("expire did not expire cached copy: %+v", e)
+	}
+	runRm([]string{"bucket/file"})
+	if _, err := cache.Stat("bucket/file"); !os.IsNotExist(err) {
+		t.Fatalf("after rm, Stat = %v, want not-exist error", err)
+	}
+	runCat([]string{"bucket/file"})
+	if loads != 2 || exitStatus != 0 {
+		t.Fatalf("loads = %d, exit %d, want 2, exit 0", loads, exitStatus)
+	}
+}
+
+func TestUsageError(t *testing.T) {
+	_, errOut, cleanup := setup(t, diskcache.LoaderFunc(loadObject))
+	defer cleanup()
+
+	runRm(nil)
+	if exitStatus != 2 || !strings.Contains(errOut.String(), "usage: gcscat rm") {
+		t.Errorf("rm with no arguments: exit %d, stderr %q", exitStatus, errOut)
+	}
+}
+
+// A streamObject is a StreamLoader that writes its content in pieces.
+type streamObject struct{}
+
+func (streamObject) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	return streamObject{}.LoadStream(path, target, meta)
+}
+
+func (streamObject) LoadStream(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(target, "part %d of %s\n", i, path)
+	}
+	return false, nil, nil
+}
+
+func TestProgress(t *testing.T) {
+	_, errOut, cleanup := setup(t, progressLoader{streamObject{}})
+	defer cleanup()
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 0
+
+	runCat([]string{"bucket/file"})
+	if !strings.Contains(errOut.String(), "loading") || !strings.Contains(errOut.String(), ": loaded 69 bytes in ") {
+		t.Errorf("miss printed no progress:\n%s", errOut)
+	}
+	errOut.Reset()
+	runCat([]string{"bucket/file"})
+	if errOut.Len() != 0 {
+		t.Errorf("hit printed progress:\n%s", errOut)
+	}
+}
+
+// A listObject is a StreamLoader that lists the files in fsys.
+type listObject struct {
+	streamObject
+	fsys fstest.MapFS
+}
+
+func (o listObject) List(dir string) ([]diskcache.ListEntry, error) {
+	return diskcache.NewFSLoader(o.fsys).(diskcache.Lister).List(dir)
+}
+
+func TestProgressLs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bucket/dir/a.txt":     {Data: []byte("a")},
+		"bucket/dir/sub/b.txt": {Data: []byte("bb")},
+	}
+	out, _, cleanup := setup(t, progressLoader{listObject{fsys: fsys}})
+	defer cleanup()
+
+	runLs([]string{"bucket/dir"})
+	if want := "a.txt\t1\nsub/\n"; out.String() != want || exitStatus != 0 {
+		t.Errorf("ls with progress: output = %q, exit %d, want %q, exit 0", out, exitStatus, want)
+	}
+}
+
+// A rangeObject is a RangeLoader recording the bytes it loads.
+type rangeObject struct {
+	content string
+	loaded  int64
+}
+
+func (o *rangeObject) Load(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	return o.LoadStream(path, target, meta)
+}
+
+func (o *rangeObject) LoadStream(path string, target io.Writer, meta []byte) (bool, []byte, error) {
+	o.loaded += int64(len(o.content))
+	io.WriteString(target, o.content)
+	return false, nil, nil
+}
+
+func (o *rangeObject) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (int64, []byte, error) {
+	size := int64(len(o.content))
+	end := off + n
+	if n < 0 || end > size {
+		end = size
+	}
+	if off > end {
+		off = end
+	}
+	o.loaded += end - off
+	io.WriteString(target, o.content[off:end])
+	return size, []byte("v1"), nil
+}
+
+func TestRange(t *testing.T) {
+	for _, progress := range []bool{false, true} {
+		obj := &rangeObject{content: strings.Repeat("0123456789", 200)}
+		var loader diskcache.Loader = obj
+		if progress {
+			loader = newProgressLoader(obj)
+		}
+		out, errOut, cleanup := setup(t, loader)
+		defer cleanup()
+
+		runCat([]string{"-range", "10-19", "bucket/big"})
+		if out.String() != "0123456789" || obj.loaded != 10 || exitStatus != 0 {
+			t.Fatalf("progress=%v: cat -range 10-19: printed %q, loaded %d bytes, exit %d, want %q, 10, 0", progress, out, obj.loaded, exitStatus, "0123456789")
+		}
+		if got := strings.Contains(errOut.String(), ": loaded 10 bytes in "); got != progress {
+			t.Fatalf("progress=%v: cat -range 10-19 printed progress %v:\n%s", progress, got, errOut)
+		}
+		out.Reset()
+		runCat([]string{"-range", "1995-", "bucket/big"})
+		if out.String() != "56789" || obj.loaded != 15 {
+			t.Fatalf("progress=%v: cat -range 1995-: printed %q, loaded %d bytes total, want %q, 15", progress, out, obj.loaded, "56789")
+		}
+
+		for _, bad := range []string{"10", "x-", "20-10", "-5"} {
+			exitStatus = 0
+			errOut.Reset()
+			runCat([]string{"-range", bad, "bucket/big"})
+			if exitStatus != 2 || !strings.Contains(errOut.String(), "invalid range") {
+				t.Errorf("progress=%v: cat -range %s: exit %d, stderr %q, want usage error", progress, bad, exitStatus, errOut)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// progressInterval is the minimum time between progress lines.
+var progressInterval = 1 * time.Second
+
+// A progressLoader wraps a StreamLoader, printing the progress
+// of each download to stderr. The cache invokes the loader only
+// for misses and revalidations, so hits print nothing,
+// and neither does a revalidation that finds the cached copy current.
+// It implements Lister, returning ErrNoList if the wrapped loader does not.
+type progressLoader struct {
+	diskcache.StreamLoader
+}
+
+// newProgressLoader returns a progressLoader wrapping l,
+// which also implements RangeLoader if l does.
+func newProgressLoader(l diskcache.StreamLoader) diskcache.Loader {
+	if _, ok := l.(diskcache.RangeLoader); ok {
+		return progressRangeLoader{progressLoader{l}}
+	}
+	return progressLoader{l}
+}
+
+// A progressRangeLoader is a progressLoader wrapping a RangeLoader.
+// It prints the progress of range loads as well.
+type progressRangeLoader struct {
+	progressLoader
+}
+
+func (l progressRangeLoader) LoadRange(path string, target io.Writer, off, n int64, meta []byte) (size int64, newMeta []byte, err error) {
+	pw := &progressWriter{w: target, path: path, start: time.Now()}
+	pw.last = pw.start
+	size, newMeta, err = l.StreamLoader.(diskcache.RangeLoader).LoadRange(path, pw, off, n, meta)
+	if pw.n > 0 {
+		pw.report(true)
+	}
+	return size, newMeta, err
+}
+
+func (l progressLoader) List(dir string) ([]diskcache.ListEntry, error) {
+	ll, ok := l.StreamLoader.(diskcache.Lister)
+	if !ok {
+		return nil, diskcache.ErrNoList
+	}
+	return ll.List(dir)
+}
+
+func (l progressLoader) LoadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	pw := &progressWriter{w: target, path: path, start: time.Now()}
+	pw.last = pw.start
+	cacheValid, newMeta, err = l.StreamLoader.LoadStream(path, pw, meta)
+	if pw.n > 0 {
+		pw.report(true)
+	}
+	return cacheValid, newMeta, err
+}
+
+// A progressWriter counts the bytes written to w,
+// printing a progress line to stderr at most once per progressInterval.
+type progressWriter struct {
+	w     io.Writer
+	path  string
+	n     int64
+	start time.Time
+	last  time.Time
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.n += int64(n)
+	if time.Since(pw.last) >= progressInterval {
+		pw.report(false)
+	}
+	return n, err
+}
+
+// report prints a progress line. If done is true, the download has finished.
+func (pw *progressWriter) report(done bool) {
+	now := time.Now()
+	pw.last = now
+	elapsed := now.Sub(pw.start)
+	rate := float64(pw.n) / 1e3
+	if elapsed > 0 {
+		rate /= elapsed.Seconds()
+	}
+	state := "loading"
+	if done {
+		state = "loaded"
+	}
+	fmt.Fprintf(stderr, "gcscat: %s: %s %d bytes in %.1fs (%.1f kB/s)\n", pw.path, state, pw.n, elapsed.Seconds(), rate)
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostMux returns an http.Handler that serves files from one of several
+// file systems, typically created by Dir, chosen by the request's Host
+// header. It serves each file system as http.FileServer does.
+//
+// The keys in sites are host names, without ports, such as "example.com".
+// A key of the form "*.example.com" matches any subdomain of example.com,
+// such as "www.example.com" or "a.b.example.com", but not example.com itself;
+// when several such keys match, the longest wins.
+// The key "*" matches any host not matched otherwise.
+// Host names are matched without regard to case.
+// A request for a host matching no key gets a 404 Not Found response.
+//
+// For example:
+//
+//	http.Handle("/", cloud.HostMux(map[string]http.FileSystem{
+//		"swtch.com":          cloud.Dir(cache, "/swtch/web"),
+//		"*.swtch.com":        cloud.Dir(cache, "/swtch/web"),
+//		"research.swtch.com": cloud.Dir(cache, "/swtch/research"),
+//	}))
+func HostMux(sites map[string]http.FileSystem) http.Handler {
+	m := &hostMux{handlers: make(map[string]http.Handler)}
+	for host, fs := range sites {
+		m.handlers[strings.ToLower(host)] = http.FileServer(fs)
+	}
+	return m
+}
+
+type hostMux struct {
+	handlers map[string]http.Handler // keyed by lower-case pattern
+}
+
+func (m *hostMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := m.handler(r.Host)
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// handler returns the handler for the given Host header value, or nil.
+func (m *hostMux) handler(host string) http.Handler {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if h := m.handlers[host]; h != nil {
+		return h
+	}
+	// Try wildcards from the longest suffix to the shortest.
+	for i := strings.Index(host, "."); i >= 0; {
+		if h := m.handlers["*"+host[i:]]; h != nil {
+			return h
+		}
+		j := strings.Index(host[i+1:], ".")
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return m.handlers["*"]
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func TestHostMux(t *testing.T) {
+	site := func(name string) diskcache.LoaderFunc {
+		return func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+			fmt.Fprintf(target, "%s: %s\n", name, path)
+			return false, nil, nil
+		}
+	}
+	c1, cleanup1 := newCache(t, site("one"))
+	defer cleanup1()
+	c2, cleanup2 := newCache(t, site("two"))
+	defer cleanup2()
+
+	h := HostMux(map[string]http.FileSystem{
+		"one.example":     Dir(c1, "/web"),
+		"*.one.example":   Dir(c1, "/sub"),
+		"*.a.one.example": Dir(c1, "/deep"),
+		"two.example":     Dir(c2, "/web"),
+		"*":               Dir(c2, "/default"),
+	})
+	for _, tt := range []struct {
+		host, want string
+	}{
+		{"one.example", "one: /web/file\n"},
+		{"ONE.example:8080", "one: /web/file\n"},
+		{"www.one.example", "one: /sub/file\n"},
+		{"x.a.one.example", "one: /deep/file\n"},
+		{"two.example", "two: /web/file\n"},
+		{"three.example", "two: /default/file\n"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/file", nil)
+		r.Host = tt.host
+		h.ServeHTTP(w, r)
+		if w.Code != 200 || w.Body.String() != tt.want {
+			t.Errorf("GET /file on %s: %d %q, want 200 %q", tt.host, w.Code, w.Body, tt.want)
+		}
+	}
+
+	h = HostMux(map[string]http.FileSystem{"one.example": Dir(c1, "/web")})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/file", nil)
+	r.Host = "two.example"
+	h.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Errorf("GET /file on unknown host: %d, want 404", w.Code)
+	}
+}
@@ -6,16 +6,21 @@
 //
 // This entire repo is but the draft of a draft. It exists to support the swtch.com web server.
 // It may mature into something more general, or it may not.
-//
 package cloud
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"os"
+	pathpkg "path"
 	"strings"
 	"time"
 
@@ -28,35 +33,225 @@ import (
 // serving files from a cached subtree:
 //
 //	http.Handle("/static/", http.StripPrefix("/static", http.FileServer(cloud.Dir(cache, "/myfiles"))))
-//
 func Dir(cache *diskcache.Cache, dir string) http.FileSystem {
-	return &fileSystem{cache, dir}
+	return &fileSystem{c: cache, root: dir}
 }
 
 type fileSystem struct {
-	c    *diskcache.Cache
-	root string
+	c         *diskcache.Cache
+	root      string
+	listing   bool                   // list directories without index.html
+	noCache   func(path string) bool // see DirOptions.NoCache
+	cacheGzip bool                   // see DirOptions.CacheCompressed
+	index     []string               // see DirOptions.IndexNames; nil means index.html
+
+	// Response being served, if known. If raw reports true for a content
+	// coding, such as gzip, the request accepts that coding and has no
+	// Range header, so Open returns files stored with that coding as is,
+	// setting the response's Content-Encoding.
+	w   http.ResponseWriter
+	raw func(coding string) bool
+}
+
+// sendsRaw reports whether Open returns files stored with the
+// given content coding as is (see fileSystem.raw).
+func (fs *fileSystem) sendsRaw(coding string) bool {
+	return fs.raw != nil && fs.raw(coding)
 }
 
 func (fs *fileSystem) Open(path string) (http.File, error) {
-	if strings.Contains(path, "/cgi-bin/") || strings.Contains(path, "/.") {
-		return nil, &os.PathError{Path: path, Op: "open", Err: os.ErrNotExist}
-	}
-	f, err := fs.c.Open(fs.root + "/" + path)
+	f, err := fs.openFile(path)
 	if err != nil {
 		// File doesn't exist, but might be a directory.
-		// If index.html exists, return an empty directory.
-		// That's enough for the http server to try to open index.html.
-		if f, err1 := fs.c.Open(fs.root + "/" + path + "/index.html"); err1 == nil {
-			f.Close()
+		// If an index document exists, return an empty directory.
+		// That's enough for the http server to redirect /dir to /dir/,
+		// and for FileServer to serve the index (see serveIndex).
+		if _, ok := fs.findIndex(path); ok {
 			return &emptyDir{}, nil
 		}
+		if fs.listing {
+			// Might be a directory to list.
+			if list, err1 := fs.c.List(fs.root + "/" + path); err1 == nil && len(list) > 0 {
+				if fs.w != nil {
+					fs.w.Header().Set("Etag", listETag(list))
+				}
+				return &listDir{list: list}, nil
+			}
+		}
 		log.Printf("cloud.Dir: open %s: %v", path, err)
 		return nil, err
 	}
 	return f, nil
 }
 
+// indexNames returns the names of the index documents to look for
+// in a directory, in order of preference.
+func (fs *fileSystem) indexNames() []string {
+	if fs.index == nil {
+		return []string{"index.html"}
+	}
+	return fs.index
+}
+
+// findIndex returns the path of the first index document found
+// in the directory with the given path, reporting whether there is one.
+func (fs *fileSystem) findIndex(dir string) (string, bool) {
+	for _, name := range fs.indexNames() {
+		if p := dir + "/" + name; fs.exists(p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// exists reports whether the file with the given path exists.
+// It uses the cache's cheaper Stat path (see diskcache.Cache.OpenMeta)
+// when the loader supports it, instead of loading the file.
+func (fs *fileSystem) exists(path string) bool {
+	if hidden(path) {
+		return false
+	}
+	_, err := fs.c.OpenMeta(fs.root + "/" + path)
+	if !errors.Is(err, diskcache.ErrNoStat) {
+		return err == nil
+	}
+	f, err := fs.openFile(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// hidden reports whether the file with the given path must not be served.
+func hidden(path string) bool {
+	return strings.Contains(path, "/cgi-bin/") || strings.Contains(path, "/.")
+}
+
+// openFile opens the file with the given path, which must not be a directory.
+func (fs *fileSystem) openFile(path string) (http.File, error) {
+	if hidden(path) {
+		return nil, &os.PathError{Path: path, Op: "open", Err: os.ErrNotExist}
+	}
+	name := fs.root + "/" + path
+	if fs.noCache != nil && fs.noCache(diskcache.CleanPath(path)) {
+		f, meta, err := fs.c.Fetch(name)
+		if err != nil {
+			return nil, err
+		}
+		return fs.decodeMeta(name, f, meta), nil
+	}
+	f, err := fs.c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs.cacheGzip && fs.sendsRaw("gzip") {
+		if e, err := fs.c.Stat(name); err == nil && gzipVariant(name, e.Meta) {
+			if g, err := fs.c.OpenDerived(name, "gzip", deriveGzip(name)); err == nil {
+				f.Close()
+				f = g
+				name += "#gzip"
+			}
+		}
+	}
+	return fs.decode(name, f), nil
+}
+
+// gzipVariant reports whether to serve a cached gzip-compressed copy
+// of the file with the given name and loader metadata.
+func gzipVariant(name string, meta []byte) bool {
+	m := diskcache.ParseLoadMeta(meta)
+	if m.ContentEncoding != "" {
+		return false
+	}
+	return compressible(contentType(name, m))
+}
+
+// contentType returns the content type of the file with the given name
+// and loader metadata, or "" if unknown.
+func contentType(name string, m *diskcache.LoadMeta) string {
+	if m.ContentType != "" {
+		return m.ContentType
+	}
+	return mime.TypeByExtension(pathpkg.Ext(name))
+}
+
+// deriveGzip returns a function for diskcache.Cache.OpenDerived
+// that gzip-compresses the file with the given name.
+func deriveGzip(name string) func(io.Writer, *os.File, []byte) ([]byte, error) {
+	return func(dst io.Writer, src *os.File, meta []byte) ([]byte, error) {
+		zw := gzip.NewWriter(dst)
+		if _, err := io.Copy(zw, src); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		m := diskcache.ParseLoadMeta(meta)
+		m.ContentType = contentType(name, m)
+		m.ContentEncoding = "gzip"
+		m.ETag = "" // validates the file, not the compressed copy
+		m.Size = 0
+		return m.Marshal(), nil
+	}
+}
+
+// decode returns the file to serve for the cached file f with the given name.
+// If f is stored with a content coding, such as gzip, that can be decoded
+// (see RegisterDecoder), decode returns a file presenting the decoded
+// content, unless the encoded bytes can be sent as is.
+// See the comment about compression and byte ranges in compress.go.
+// If the response being served is known, decode also sets the headers
+// recorded in f's loader metadata (see diskcache.LoadMeta.Header).
+func (fs *fileSystem) decode(name string, f *os.File) http.File {
+	e, err := fs.c.Stat(name)
+	if err != nil {
+		return f
+	}
+	return fs.decodeMeta(name, f, e.Meta)
+}
+
+// decodeMeta is like decode but takes the loader metadata for f.
+func (fs *fileSystem) decodeMeta(name string, f *os.File, meta []byte) http.File {
+	m := diskcache.ParseLoadMeta(meta)
+	if fs.w != nil {
+		// Replay recorded headers, without overriding
+		// any set by the file server itself.
+		h := fs.w.Header()
+		for k, v := range m.Header {
+			if h.Get(k) == "" {
+				h.Set(k, v)
+			}
+		}
+	}
+	enc := m.ContentEncoding
+	if enc == "" {
+		return f
+	}
+	dec := lookupDecoder(enc)
+	if fs.w != nil && (dec != nil || fs.sendsRaw(enc)) {
+		h := fs.w.Header()
+		h.Add("Vary", "Accept-Encoding")
+		if m.ContentType != "" && h.Get("Content-Type") == "" {
+			h.Set("Content-Type", m.ContentType)
+		}
+		if fs.sendsRaw(enc) {
+			if h.Get("Content-Type") == "" {
+				if ctype := mime.TypeByExtension(pathpkg.Ext(name)); ctype != "" {
+					h.Set("Content-Type", ctype)
+				}
+			}
+			h.Set("Content-Encoding", enc)
+			return f
+		}
+	}
+	if dec == nil {
+		// No way to decode the copy; serve the stored bytes.
+		return f
+	}
+	return newDecodedFile(f, dec)
+}
+
 type emptyDir struct{}
 
 func (*emptyDir) Close() error                                 { return nil }
@@ -65,6 +260,54 @@ func (*emptyDir) Readdir(count int) ([]os.FileInfo, error)     { return nil, io.
 func (*emptyDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
 func (*emptyDir) Stat() (os.FileInfo, error)                   { return &dirInfo{}, nil }
 
+// A listDir is a directory whose entries come from a loader listing.
+type listDir struct {
+	emptyDir
+	list []diskcache.ListEntry
+}
+
+func (d *listDir) Readdir(count int) ([]os.FileInfo, error) {
+	if len(d.list) == 0 && count > 0 {
+		return nil, io.EOF
+	}
+	n := len(d.list)
+	if count > 0 && count < n {
+		n = count
+	}
+	infos := make([]os.FileInfo, n)
+	for i := range infos {
+		infos[i] = &listInfo{d.list[i]}
+	}
+	d.list = d.list[n:]
+	return infos, nil
+}
+
+// listETag returns an ETag for a listing of the directory with entries list,
+// which must be sorted, so that a client can revalidate the listing.
+func listETag(list []diskcache.ListEntry) string {
+	h := sha256.New()
+	for _, e := range list {
+		fmt.Fprintf(h, "%q %v %d\n", e.Name, e.IsDir, e.Size)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+type listInfo struct {
+	e diskcache.ListEntry
+}
+
+func (fi *listInfo) Name() string       { return fi.e.Name }
+func (fi *listInfo) Size() int64        { return fi.e.Size }
+func (fi *listInfo) ModTime() time.Time { return time.Time{} }
+func (fi *listInfo) IsDir() bool        { return fi.e.IsDir }
+func (fi *listInfo) Sys() interface{}   { return nil }
+func (fi *listInfo) Mode() os.FileMode {
+	if fi.e.IsDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
 type dirInfo struct{}
 
 func (*dirInfo) Name() string       { return "/" }
@@ -88,34 +331,31 @@ func LoadX509KeyPair(cache *diskcache.Cache, certFile, keyFile string) (tls.Cert
 }
 
 // ServeHTTPS is net/http's ListenAndServeTLS, but it reads the key pair from cache instead of local disk.
+// It applies the default timeouts described by ServerOptions.
 func ServeHTTPS(addr string, cache *diskcache.Cache, certFile, keyFile string, handler http.Handler) error {
-	srv := &http.Server{Addr: addr, Handler: handler}
-	addr = srv.Addr
+	return ServeHTTPSOptions(addr, cache, certFile, keyFile, handler, nil)
+}
+
+// ServeHTTPSOptions is like ServeHTTPS but applies the timeouts in opts,
+// which may be nil to use the defaults.
+func ServeHTTPSOptions(addr string, cache *diskcache.Cache, certFile, keyFile string, handler http.Handler, opts *ServerOptions) error {
 	if addr == "" {
 		addr = ":https"
 	}
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
-	}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
-	}
-
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = LoadX509KeyPair(cache, certFile, keyFile)
+	cert, err := LoadX509KeyPair(cache, certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	config := &tls.Config{
+		NextProtos:   []string{"http/1.1"},
+		Certificates: []tls.Certificate{cert},
+	}
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	return srv.Serve(tlsListener)
+	return serveTLS(tcpKeepAliveListener{ln.(*net.TCPListener)}, config, handler, opts)
 }
 
 // ServeHTTP invokes net/http's ListenAndServe;
@@ -0,0 +1,374 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func newCache(t *testing.T, loader diskcache.Loader) (c *diskcache.Cache, cleanup func()) {
+	dir, err := ioutil.TempDir("", "cloud-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	c, err = diskcache.New(dir+"/cache", loader)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return c, cleanup
+}
+
+func loadHello(path string, target *os.File, meta []byte) (bool, []byte, error) {
+	fmt.Fprintf(target, "hello, %s\n", path)
+	return false, nil, nil
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestFileServerCacheControl(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if strings.Contains(path, "missing") {
+			return false, nil, diskcache.ErrNotFound
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	const immutable = "public, max-age=31536000, immutable"
+	fingerprinted := regexp.MustCompile(`\.[0-9a-f]{6,}\.(js|css)$`)
+	h := FileServer(c, "/static", &DirOptions{
+		CacheControl: func(path string) (string, bool) {
+			if fingerprinted.MatchString(path) {
+				return immutable, true
+			}
+			return "", false
+		},
+	})
+
+	w := get(h, "/app.abc123.js")
+	if w.Code != 200 {
+		t.Fatalf("GET /app.abc123.js: %d %s", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != immutable {
+		t.Errorf("GET /app.abc123.js: Cache-Control = %q, want %q", cc, immutable)
+	}
+	if body, want := w.Body.String(), "hello, /static/app.abc123.js\n"; body != want {
+		t.Errorf("GET /app.abc123.js: body = %q, want %q", body, want)
+	}
+
+	w = get(h, "/app.js")
+	if w.Code != 200 {
+		t.Fatalf("GET /app.js: %d %s", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != DefaultCacheControl {
+		t.Errorf("GET /app.js: Cache-Control = %q, want %q", cc, DefaultCacheControl)
+	}
+
+	// Errors are not to be cached as long as the files would be.
+	w = get(h, "/missing.abc123.js")
+	if w.Code != 404 {
+		t.Fatalf("GET /missing.abc123.js: %d %s, want 404", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("GET /missing.abc123.js: Cache-Control = %q, want none", cc)
+	}
+}
+
+func TestFileServerDirListing(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/dir/a.txt":     {Data: []byte("a")},
+		"static/dir/<x>.txt":   {Data: []byte("x")},
+		"static/dir/sub/b.txt": {Data: []byte("b")},
+	}
+	c, cleanup := newCache(t, diskcache.NewFSLoader(fsys))
+	defer cleanup()
+
+	w := get(FileServer(c, "/static", &DirOptions{DirListing: true}), "/dir/")
+	if w.Code != 200 {
+		t.Fatalf("GET /dir/: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{
+		`<a href="a.txt">a.txt</a>`,
+		`<a href="sub/">sub/</a>`,
+		`<a href="%3Cx%3E.txt">&lt;x&gt;.txt</a>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("GET /dir/: body missing %s:\n%s", want, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "<x>") {
+		t.Errorf("GET /dir/: body contains unescaped name:\n%s", w.Body)
+	}
+
+	w = get(FileServer(c, "/static", nil), "/dir/")
+	if w.Code != 404 {
+		t.Errorf("GET /dir/ without DirListing: %d, want 404", w.Code)
+	}
+}
+
+func TestFileServerDirListingETag(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/dir/a.txt": {Data: []byte("a")},
+		"static/dir/b.txt": {Data: []byte("b")},
+	}
+	c, cleanup := newCache(t, diskcache.NewFSLoader(fsys))
+	defer cleanup()
+	h := FileServer(c, "/static", &DirOptions{DirListing: true})
+
+	w := get(h, "/dir/")
+	etag := w.Header().Get("Etag")
+	if w.Code != 200 || etag == "" {
+		t.Fatalf("GET /dir/: %d with ETag %q, want 200 with ETag", w.Code, etag)
+	}
+	conditional := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/dir/", nil)
+		r.Header.Set("If-None-Match", etag)
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := conditional(); w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatalf("conditional GET /dir/: %d %q, want 304", w.Code, w.Body)
+	}
+
+	// A changed listing has a new ETag.
+	fsys["static/dir/c.txt"] = &fstest.MapFile{Data: []byte("c")}
+	w = conditional()
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "c.txt") {
+		t.Fatalf("conditional GET /dir/ after change: %d %s, want 200 listing c.txt", w.Code, w.Body)
+	}
+	if e := w.Header().Get("Etag"); e == "" || e == etag {
+		t.Fatalf("ETag after change = %q, want new ETag (old %q)", e, etag)
+	}
+}
+
+func TestFileServerTrailingSlash(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/dir/index.html": {Data: []byte("<h1>index</h1>\n")},
+	}
+	c, cleanup := newCache(t, diskcache.NewFSLoader(fsys))
+	defer cleanup()
+	h := FileServer(c, "/static", nil)
+
+	w := get(h, "/dir")
+	if w.Code != 301 || w.Header().Get("Location") != "dir/" {
+		t.Errorf("GET /dir: %d Location=%q, want 301 dir/", w.Code, w.Header().Get("Location"))
+	}
+	w = get(h, "/dir/")
+	if w.Code != 200 || w.Body.String() != "<h1>index</h1>\n" {
+		t.Errorf("GET /dir/: %d %q, want 200 index content", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("GET /dir/: Content-Type = %q, want text/html", ct)
+	}
+	w = get(h, "/dir/index.html")
+	if w.Code != 301 || w.Header().Get("Location") != "./" {
+		t.Errorf("GET /dir/index.html: %d Location=%q, want 301 ./", w.Code, w.Header().Get("Location"))
+	}
+	w = get(h, "/dir/?q=1")
+	if w.Code != 200 || w.Body.String() != "<h1>index</h1>\n" {
+		t.Errorf("GET /dir/?q=1: %d %q, want 200 index content", w.Code, w.Body)
+	}
+}
+
+func TestFileServerIndexNames(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/dir/default.html":  {Data: []byte("<h1>default</h1>\n")},
+		"static/both/index.html":   {Data: []byte("<h1>index</h1>\n")},
+		"static/both/default.html": {Data: []byte("<h1>default</h1>\n")},
+	}
+	c, cleanup := newCache(t, diskcache.NewFSLoader(fsys))
+	defer cleanup()
+	h := FileServer(c, "/static", &DirOptions{IndexNames: []string{"index.html", "default.html"}})
+
+	w := get(h, "/dir/")
+	if w.Code != 200 || w.Body.String() != "<h1>default</h1>\n" {
+		t.Errorf("GET /dir/: %d %q, want 200 default.html content", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("GET /dir/: Content-Type = %q, want text/html", ct)
+	}
+	w = get(h, "/dir")
+	if w.Code != 301 || w.Header().Get("Location") != "dir/" {
+		t.Errorf("GET /dir: %d Location=%q, want 301 dir/", w.Code, w.Header().Get("Location"))
+	}
+
+	// The first name in the list wins, and the probe
+	// does not load the documents it passes over.
+	w = get(h, "/both/")
+	if w.Code != 200 || w.Body.String() != "<h1>index</h1>\n" {
+		t.Errorf("GET /both/: %d %q, want 200 index.html content", w.Code, w.Body)
+	}
+	if _, err := c.Stat("/static/both/default.html"); !os.IsNotExist(err) {
+		t.Errorf("probe loaded /both/default.html: Stat = %v", err)
+	}
+
+	// Without IndexNames, only index.html counts.
+	h = FileServer(c, "/static", nil)
+	if w := get(h, "/dir/"); w.Code != 404 {
+		t.Errorf("GET /dir/ without IndexNames: %d, want 404", w.Code)
+	}
+}
+
+func TestFileServerNoCache(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(loadHello))
+	defer cleanup()
+
+	h := FileServer(c, "/static", &DirOptions{
+		NoCache: func(path string) bool { return strings.HasPrefix(path, "/user/") },
+	})
+	for i := 0; i < 2; i++ {
+		w := get(h, "/user/profile")
+		if body, want := w.Body.String(), "hello, /static/user/profile\n"; w.Code != 200 || body != want {
+			t.Fatalf("GET /user/profile: %d %q, want 200 %q", w.Code, body, want)
+		}
+	}
+	if _, err := c.Stat("/static/user/profile"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/static/user/profile) = %v, want not-exist error", err)
+	}
+	if st := c.Stats(); st.Loads != 2 {
+		t.Errorf("loads = %d, want 2", st.Loads)
+	}
+
+	get(h, "/public")
+	if _, err := c.Stat("/static/public"); err != nil {
+		t.Errorf("Stat(/static/public) = %v, want cached copy", err)
+	}
+}
+
+func TestFileServerContentTypes(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.Write([]byte("\x00asm\x01\x00\x00\x00"))
+		return false, (&diskcache.LoadMeta{ContentType: "application/octet-stream"}).Marshal(), nil
+	}))
+	defer cleanup()
+
+	h := FileServer(c, "/static", &DirOptions{
+		ContentTypes: map[string]string{".DAT": "application/x-data"},
+	})
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/app.wasm", "application/wasm"},
+		{"/APP.WASM", "application/wasm"},
+		{"/file.dat", "application/x-data"},
+	} {
+		w := get(h, tt.path)
+		if ct := w.Header().Get("Content-Type"); w.Code != 200 || ct != tt.want {
+			t.Errorf("GET %s: %d, Content-Type %q, want 200, %q", tt.path, w.Code, ct, tt.want)
+		}
+	}
+}
+
+func TestFileServerReplayHeaders(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		fmt.Fprintf(target, "report\n")
+		m := new(diskcache.LoadMeta)
+		m.CaptureHeaders(http.Header{
+			"Content-Disposition": {`attachment; filename="report.txt"`},
+			"Cache-Control":       {"no-store"},
+			"Date":                {"Mon, 01 Jun 2015 12:00:00 GMT"},
+		}, []string{"content-disposition", "cache-control"})
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+
+	h := FileServer(c, "/static", &DirOptions{
+		CacheControl: func(string) (string, bool) { return "", false },
+	})
+	for i := 0; i < 2; i++ {
+		w := get(h, "/report")
+		if cd := w.Header().Get("Content-Disposition"); w.Code != 200 || cd != `attachment; filename="report.txt"` {
+			t.Errorf("GET /report: %d, Content-Disposition %q, want replayed header", w.Code, cd)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != DefaultCacheControl {
+			t.Errorf("GET /report: Cache-Control %q, want file server's %q", cc, DefaultCacheControl)
+		}
+		if d := w.Header().Get("Date"); d != "" {
+			t.Errorf("GET /report: Date %q, want none", d)
+		}
+	}
+}
+
+// pushRecorder is a ResponseRecorder that implements http.Pusher,
+// recording the pushed targets.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func TestFileServerPush(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		if strings.HasPrefix(path, "/static/missing.html") {
+			return false, nil, diskcache.ErrNotFound
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	h := FileServer(c, "/static", &DirOptions{
+		Push: func(path string) []string {
+			if strings.HasSuffix(path, ".html") {
+				return []string{"/style.css", "/app.js"}
+			}
+			return nil
+		},
+	})
+	w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/page.html", nil))
+	if w.Code != 200 || w.Body.String() != "hello, /static/page.html\n" {
+		t.Fatalf("GET /page.html: %d %q", w.Code, w.Body)
+	}
+	if got := strings.Join(w.pushed, " "); got != "/style.css /app.js" {
+		t.Fatalf("pushed %q, want %q", got, "/style.css /app.js")
+	}
+
+	w = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/style.css", nil))
+	if len(w.pushed) != 0 {
+		t.Fatalf("GET /style.css pushed %q, want nothing", w.pushed)
+	}
+
+	// Nothing is pushed with an error or a 304 Not Modified response.
+	w = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/missing.html", nil))
+	if w.Code != 404 || len(w.pushed) != 0 {
+		t.Fatalf("GET /missing.html: %d, pushed %q, want 404, nothing", w.Code, w.pushed)
+	}
+	w = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest("GET", "/page.html", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	h.ServeHTTP(w, req)
+	if w.Code != 304 || len(w.pushed) != 0 {
+		t.Fatalf("conditional GET /page.html: %d, pushed %q, want 304, nothing", w.Code, w.pushed)
+	}
+
+	// Without push support, the page is served as usual.
+	if w := get(h, "/page.html"); w.Code != 200 {
+		t.Fatalf("GET /page.html without push: %d %s", w.Code, w.Body)
+	}
+}
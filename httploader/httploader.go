@@ -0,0 +1,410 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httploader implements diskcache.Loader by fetching files
+// from an HTTP origin server.
+package httploader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// DefaultMaxRedirects is the number of redirects a loader follows
+// when Options.MaxRedirects is zero.
+const DefaultMaxRedirects = 10
+
+// Options holds optional settings for a loader created by New.
+type Options struct {
+	// Client is the HTTP client to use.
+	// If nil, the loader uses a client like http.DefaultClient.
+	// The loader replaces the client's CheckRedirect function
+	// in a copy of the client; the original is not modified.
+	// If Certificates or RootCAs is set, the client's Transport must be
+	// nil or an *http.Transport, which the loader likewise copies;
+	// otherwise New returns an error.
+	Client *http.Client
+
+	// MaxRedirects is the maximum number of redirects to follow
+	// when loading a single file. If zero, the loader follows at most
+	// DefaultMaxRedirects redirects. If negative, it follows none.
+	MaxRedirects int
+
+	// RedirectHosts lists the hosts, as in URL.Host, to which the loader
+	// follows redirects. If RedirectHosts is empty, the loader follows
+	// redirects only to the host of the origin URL.
+	// The entry "*" allows redirects to any host.
+	RedirectHosts []string
+
+	// Headers lists the response headers to record in the loader metadata,
+	// for replay when the file is served (see diskcache.LoadMeta.Header).
+	// If nil, the loader records DefaultHeaders.
+	// List only headers describing the file itself, not volatile ones like Date.
+	Headers []string
+
+	// Certificates, if non-empty, are the client certificates to present
+	// to origin servers that require TLS client authentication (mutual TLS).
+	// A certificate stored in a cache can be loaded with cloud.LoadX509KeyPair.
+	Certificates []tls.Certificate
+
+	// RootCAs, if non-nil, is the set of certificate authorities
+	// the loader trusts to verify origin servers, as in tls.Config.
+	// If nil, the loader uses the host's root CA set.
+	RootCAs *x509.CertPool
+}
+
+// DefaultHeaders is the list of response headers a loader records
+// when Options.Headers is nil.
+var DefaultHeaders = []string{
+	"Content-Disposition",
+	"Content-Language",
+}
+
+// Errors reported for redirects the loader refuses to follow.
+// The errors returned by Load wrap them, so callers can use errors.Is.
+var (
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrRedirectLoop     = errors.New("redirect loop")
+	ErrRedirectHost     = errors.New("redirect to disallowed host")
+)
+
+// New returns a loader that loads the file with path p
+// from the URL base+p, where base is typically the URL of a directory
+// on the origin server, such as "https://example.com/static".
+// The options may be nil.
+//
+// The loader revalidates cached copies with conditional requests
+// and records the response's ETag, Last-Modified, Content-Type,
+// Content-Encoding (the body is stored as sent, still encoded),
+// and the Cache-Control directives must-revalidate, max-age, no-cache,
+// and no-store in the loader metadata (see diskcache.LoadMeta).
+// It implements diskcache.ResumeLoader, resuming interrupted downloads
+// with range requests where the origin server supports them.
+// It classifies failures as diskcache.ErrNotFound, diskcache.ErrPermission,
+// or diskcache.ErrTransient where it can, reporting unsuccessful
+// response statuses other than 404 as *diskcache.StatusError,
+// so that the cache can remember them (see diskcache.Cache.SetNegativeCaching).
+//
+// New returns an error only if the options cannot be applied.
+func New(base string, opts *Options) (diskcache.Loader, error) {
+	l, err := newLoader(base, opts)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// newLoader implements New.
+func newLoader(base string, opts *Options) (*loader, error) {
+	l := &loader{base: strings.TrimSuffix(base, "/")}
+	if opts != nil {
+		l.opts = *opts
+	}
+	client := http.Client{}
+	if l.opts.Client != nil {
+		client = *l.opts.Client
+	}
+	client.CheckRedirect = l.checkRedirect
+	if len(l.opts.Certificates) > 0 || l.opts.RootCAs != nil {
+		rt, err := l.tlsTransport(client.Transport)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = rt
+	}
+	l.client = &client
+	if l.opts.Headers == nil {
+		l.opts.Headers = DefaultHeaders
+	}
+	return l, nil
+}
+
+// tlsTransport returns a copy of the transport rt configured with
+// the client certificates and root CAs in the loader's options.
+// It returns an error if rt is not nil or an *http.Transport,
+// since there is then no way to configure TLS.
+func (l *loader) tlsTransport(rt http.RoundTripper) (http.RoundTripper, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("httploader: cannot configure TLS for transport of type %T", rt)
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = new(tls.Config)
+	}
+	if len(l.opts.Certificates) > 0 {
+		t.TLSClientConfig.Certificates = l.opts.Certificates
+	}
+	if l.opts.RootCAs != nil {
+		t.TLSClientConfig.RootCAs = l.opts.RootCAs
+	}
+	return t, nil
+}
+
+type loader struct {
+	base   string
+	opts   Options
+	client *http.Client
+	signer *signer // for NewSignedURLLoader
+}
+
+// url returns the URL from which to load path.
+func (l *loader) url(path string) (string, error) {
+	if l.signer != nil {
+		return l.signer.url(path)
+	}
+	return l.base + path, nil
+}
+
+// checkRedirect implements http.Client.CheckRedirect,
+// enforcing the loader's redirect options.
+func (l *loader) checkRedirect(req *http.Request, via []*http.Request) error {
+	max := l.opts.MaxRedirects
+	if max == 0 {
+		max = DefaultMaxRedirects
+	}
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return fmt.Errorf("%w: %s", ErrRedirectLoop, chain(req, via))
+		}
+	}
+	if len(via) > max {
+		return fmt.Errorf("%w (limit %d): %s", ErrTooManyRedirects, max, chain(req, via))
+	}
+	if !l.allowHost(req.URL.Host, via[0].URL.Host) {
+		return fmt.Errorf("%w %s: %s", ErrRedirectHost, req.URL.Host, chain(req, via))
+	}
+	return nil
+}
+
+// chain returns a description of the redirects leading to req.
+func chain(req *http.Request, via []*http.Request) string {
+	var urls []string
+	for _, r := range via {
+		urls = append(urls, r.URL.String())
+	}
+	urls = append(urls, req.URL.String())
+	return strings.Join(urls, " -> ")
+}
+
+// allowHost reports whether the loader follows a redirect to host
+// for a request originally sent to origin.
+func (l *loader) allowHost(host, origin string) bool {
+	if len(l.opts.RedirectHosts) == 0 {
+		return host == origin
+	}
+	for _, h := range l.opts.RedirectHosts {
+		if h == "*" || h == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *loader) Load(path string, target *os.File, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	return l.LoadStream(path, target, meta)
+}
+
+// LoadStream implements diskcache.StreamLoader.
+func (l *loader) LoadStream(path string, target io.Writer, meta []byte) (cacheValid bool, newMeta []byte, err error) {
+	return l.load(path, target, meta, 0, nil, nil)
+}
+
+// LoadResume implements diskcache.ResumeLoader.
+// It resumes a download with a Range request and an If-Range header
+// naming the strong ETag or else the Last-Modified time of the partial copy,
+// so that the server sends the entire file if it has changed.
+func (l *loader) LoadResume(path string, target io.Writer, meta []byte, off int64, partial []byte, begin func(newMeta []byte, resumed bool) error) (cacheValid bool, newMeta []byte, err error) {
+	return l.load(path, target, meta, off, partial, begin)
+}
+
+// load implements LoadStream and LoadResume.
+// The begin function, if non-nil, is called as described for LoadResume.
+func (l *loader) load(path string, target io.Writer, meta []byte, off int64, partial []byte, begin func([]byte, bool) error) (cacheValid bool, newMeta []byte, err error) {
+	m := diskcache.ParseLoadMeta(meta)
+	ifRange := ""
+	if off > 0 {
+		ifRange = rangeValidator(diskcache.ParseLoadMeta(partial))
+	}
+	resp, err := l.get(path, m, off, ifRange)
+	if err != nil {
+		return false, nil, err
+	}
+	if l.signer != nil && (resp.StatusCode == 401 || resp.StatusCode == 403) {
+		// The signed URL may have been revoked. Sign again.
+		resp.Body.Close()
+		l.signer.forget(path)
+		if resp, err = l.get(path, m, off, ifRange); err != nil {
+			return false, nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 304 {
+		if meta == nil {
+			// Not a conditional request, and there is no copy to reuse.
+			return false, nil, &os.PathError{Path: path, Op: "load", Err: fmt.Errorf("unexpected %s", resp.Status)}
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != "" {
+			// A 304 response updates the cached response's headers.
+			m.MustRevalidate = hasDirective(cc, "must-revalidate")
+			setLifetime(m, cc)
+		}
+		if l.signer != nil {
+			l.signer.limit(path, m)
+		}
+		return true, m.Marshal(), nil
+	}
+	resumed := false
+	switch {
+	case resp.StatusCode == 206 && ifRange != "":
+		// The partial copy is current; the body is the rest of the file.
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", off)) {
+			return false, nil, &os.PathError{Path: path, Op: "load", Err: fmt.Errorf("invalid Content-Range %q", resp.Header.Get("Content-Range"))}
+		}
+		resumed = true
+	case resp.StatusCode == 416 && ifRange != "" && resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", off):
+		// The partial copy is current and complete.
+		resp.Body = http.NoBody
+		resumed = true
+	case resp.StatusCode != 200:
+		return false, nil, &os.PathError{Path: path, Op: "load", Err: statusError(resp)}
+	}
+
+	m = &diskcache.LoadMeta{
+		ETag:            resp.Header.Get("Etag"),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.LastModified = t
+	}
+	cc := resp.Header.Get("Cache-Control")
+	m.MustRevalidate = hasDirective(cc, "must-revalidate")
+	setLifetime(m, cc)
+	m.CaptureHeaders(resp.Header, l.opts.Headers)
+	if l.signer != nil {
+		l.signer.limit(path, m)
+	}
+	if begin != nil {
+		if err := begin(m.Marshal(), resumed); err != nil {
+			return false, nil, err
+		}
+	}
+
+	n, err := io.Copy(target, resp.Body)
+	if err != nil {
+		return false, nil, &os.PathError{Path: path, Op: "load", Err: fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)}
+	}
+	if resumed {
+		n += off
+	}
+	m.Size = n
+	return false, m.Marshal(), nil
+}
+
+// rangeValidator returns the validator for an If-Range header
+// identifying the version of a file described by m:
+// its ETag, if strong, or else its Last-Modified time.
+// It returns "" if m has neither, since a weak ETag cannot be used.
+func rangeValidator(m *diskcache.LoadMeta) string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	if !m.LastModified.IsZero() {
+		return m.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// get sends a GET request for path, conditional on the validators in m.
+// If ifRange is not empty, get asks for the bytes from off to the end
+// of the file, if the file still matches the If-Range validator ifRange.
+func (l *loader) get(path string, m *diskcache.LoadMeta, off int64, ifRange string) (*http.Response, error) {
+	url, err := l.url(path)
+	if err != nil {
+		return nil, &os.PathError{Path: path, Op: "load", Err: err}
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.ETag != "" {
+		req.Header.Set("If-None-Match", m.ETag)
+	}
+	if !m.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", m.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if ifRange != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		if !errors.Is(err, ErrTooManyRedirects) && !errors.Is(err, ErrRedirectLoop) && !errors.Is(err, ErrRedirectHost) {
+			err = fmt.Errorf("%w (%w)", err, diskcache.ErrTransient)
+		}
+		return nil, &os.PathError{Path: path, Op: "load", Err: err}
+	}
+	return resp, nil
+}
+
+// statusError returns the error for the unsuccessful response resp,
+// classified for the cache (see diskcache.ErrNotFound).
+func statusError(resp *http.Response) error {
+	if resp.StatusCode == 404 {
+		// Keep os.IsNotExist working; the cache treats ErrNotFound as 404.
+		return diskcache.ErrNotFound
+	}
+	return &diskcache.StatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// setLifetime records in m the lifetime advertised by the
+// Cache-Control header value cc (see diskcache.LoadMeta.MaxAge).
+func setLifetime(m *diskcache.LoadMeta, cc string) {
+	m.NoStore = hasDirective(cc, "no-store")
+	m.MaxAge = 0
+	if v, ok := directive(cc, "max-age"); ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			m.MaxAge = time.Duration(n) * time.Second
+			if n == 0 {
+				m.MaxAge = -1
+			}
+		}
+	}
+	if hasDirective(cc, "no-cache") {
+		m.MaxAge = -1
+	}
+}
+
+// hasDirective reports whether the Cache-Control header value cc
+// contains the directive name.
+func hasDirective(cc, name string) bool {
+	_, ok := directive(cc, name)
+	return ok
+}
+
+// directive returns the value of the directive name
+// in the Cache-Control header value cc, if present.
+func directive(cc, name string) (value string, ok bool) {
+	for _, f := range strings.Split(cc, ",") {
+		f, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		if strings.EqualFold(strings.TrimSpace(f), name) {
+			return strings.Trim(strings.TrimSpace(v), `"`), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,268 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httploader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func tempFile(t *testing.T) (f *os.File, cleanup func()) {
+	f, err := ioutil.TempFile("", "httploader-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func newTestLoader(t *testing.T, base string, opts *Options) diskcache.Loader {
+	t.Helper()
+	l, err := New(base, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLoad(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/static/moved":
+			http.Redirect(w, r, "/static/file", http.StatusFound)
+		case "/static/file":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(304)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Disposition", "inline")
+			w.Header().Set("X-Volatile", "1")
+			w.Write([]byte("data"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	l := newTestLoader(t, srv.URL+"/static/", nil)
+	valid, meta, err := l.Load("/moved", f, nil)
+	if valid || err != nil || diskcache.ParseLoadMeta(meta).ETag != `"v1"` {
+		t.Fatalf("Load = %v, %q, %v, want false, ETag \"v1\", nil", valid, meta, err)
+	}
+	if h := diskcache.ParseLoadMeta(meta).Header; len(h) != 1 || h["Content-Disposition"] != "inline" {
+		t.Fatalf("recorded headers %v, want only Content-Disposition", h)
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "data" {
+		t.Fatalf("loaded %q, want %q", data, "data")
+	}
+	if valid, _, err := l.Load("/file", f, meta); !valid || err != nil {
+		t.Fatalf("revalidating Load = %v, %v, want true, nil", valid, err)
+	}
+	if _, _, err := l.Load("/missing", f, nil); !errors.Is(err, diskcache.ErrNotFound) {
+		t.Fatalf("Load missing file: %v, want not found", err)
+	}
+}
+
+func TestLoadResume(t *testing.T) {
+	content, etag := "hello, world\n", `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+	rl := newTestLoader(t, srv.URL, nil).(diskcache.ResumeLoader)
+
+	load := func(off int64, partial []byte) (string, []byte, bool) {
+		var buf strings.Builder
+		var began, resumed bool
+		_, meta, err := rl.LoadResume("/file", &buf, nil, off, partial, func(m []byte, r bool) error {
+			if diskcache.ParseLoadMeta(m).ETag != etag {
+				t.Errorf("begin with ETag %q, want %q", diskcache.ParseLoadMeta(m).ETag, etag)
+			}
+			began, resumed = true, r
+			return nil
+		})
+		if err != nil || !began {
+			t.Fatalf("LoadResume(%d): %v, began=%v", off, err, began)
+		}
+		return buf.String(), meta, resumed
+	}
+
+	data, meta, resumed := load(0, nil)
+	if data != content || resumed || diskcache.ParseLoadMeta(meta).Size != int64(len(content)) {
+		t.Fatalf("LoadResume(0) = %q, resumed=%v, meta %q, want entire file", data, resumed, meta)
+	}
+	if data, meta, resumed := load(7, meta); data != content[7:] || !resumed || diskcache.ParseLoadMeta(meta).Size != int64(len(content)) {
+		t.Fatalf("LoadResume(7) = %q, resumed=%v, meta %q, want %q resumed", data, resumed, meta, content[7:])
+	}
+	if data, _, resumed := load(int64(len(content)), meta); data != "" || !resumed {
+		t.Fatalf("LoadResume(end) = %q, resumed=%v, want nothing resumed", data, resumed)
+	}
+
+	// A changed file is sent in full.
+	content, etag = "goodbye, world\n", `"v2"`
+	if data, _, resumed := load(7, meta); data != content || resumed {
+		t.Fatalf("LoadResume of changed file = %q, resumed=%v, want %q not resumed", data, resumed, content)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		default:
+			// /n/x redirects to /n/xx, forever.
+			http.Redirect(w, r, r.URL.Path+"x", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	l := newTestLoader(t, srv.URL, &Options{MaxRedirects: 3})
+	_, _, err := l.Load("/a", f, nil)
+	if !errors.Is(err, ErrRedirectLoop) || errors.Is(err, diskcache.ErrTransient) {
+		t.Fatalf("Load in redirect cycle: %v, want redirect loop error", err)
+	}
+	if want := srv.URL + "/a -> " + srv.URL + "/b -> " + srv.URL + "/a"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Load error %q does not describe cycle %q", err, want)
+	}
+
+	_, _, err = l.Load("/n/x", f, nil)
+	if !errors.Is(err, ErrTooManyRedirects) || !strings.Contains(err.Error(), "/n/xxxx") || strings.Contains(err.Error(), "/n/xxxxxx") {
+		t.Fatalf("Load with endless redirects: %v, want error after 3 redirects", err)
+	}
+}
+
+func TestRedirectHost(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("elsewhere"))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	if _, _, err := newTestLoader(t, srv.URL, nil).Load("/file", f, nil); !errors.Is(err, ErrRedirectHost) {
+		t.Fatalf("Load redirected to other host: %v, want disallowed host error", err)
+	}
+	host := strings.TrimPrefix(other.URL, "http://")
+	if _, _, err := newTestLoader(t, srv.URL, &Options{RedirectHosts: []string{host}}).Load("/file", f, nil); err != nil {
+		t.Fatalf("Load redirected to allowed host: %v", err)
+	}
+}
+
+// clientCert returns a self-signed client certificate.
+func clientCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "loader"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert := clientCert(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret for " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	srv.TLS.ClientCAs.AddCert(leaf)
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	f, cleanup := tempFile(t)
+	defer cleanup()
+	if _, _, err := newTestLoader(t, srv.URL, &Options{RootCAs: roots}).Load("/file", f, nil); err == nil {
+		t.Fatalf("Load without client certificate succeeded")
+	}
+	l := newTestLoader(t, srv.URL, &Options{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if _, _, err := l.Load("/file", f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "secret for loader" {
+		t.Fatalf("loaded %q, want %q", data, "secret for loader")
+	}
+
+	// TLS options cannot be applied to other transports.
+	client := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		t.Fatal("transport used")
+		return nil, nil
+	})}
+	if _, err := New(srv.URL, &Options{Client: client, RootCAs: roots}); err == nil {
+		t.Fatalf("New with TLS options and custom transport succeeded")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestSetLifetime(t *testing.T) {
+	for _, tt := range []struct {
+		cc      string
+		maxAge  time.Duration
+		noStore bool
+	}{
+		{"", 0, false},
+		{"public, max-age=300", 300 * time.Second, false},
+		{"max-age=0", -1, false},
+		{"no-cache", -1, false},
+		{"max-age=60, no-store", 60 * time.Second, true},
+		{"max-age=bogus", 0, false},
+	} {
+		m := new(diskcache.LoadMeta)
+		setLifetime(m, tt.cc)
+		if m.MaxAge != tt.maxAge || m.NoStore != tt.noStore {
+			t.Errorf("setLifetime(%q): MaxAge=%v NoStore=%v, want %v %v", tt.cc, m.MaxAge, m.NoStore, tt.maxAge, tt.noStore)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httploader
+
+import (
+	"sync"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// signMargin is how long before a signed URL's expiry the loader
+// signs again, so that a URL does not expire during a request.
+const signMargin = 10 * time.Second
+
+// NewSignedURLLoader returns a loader that fetches each file from
+// a time-limited signed URL, for clients that have no credentials
+// for the origin but can obtain signed URLs, such as those of
+// Google Cloud Storage or Amazon S3.
+// The loader calls sign to obtain the URL for a path and its expiry time,
+// and reuses the URL until shortly before it expires.
+// The cache revalidates a file no later than the expiry of the URL
+// used to load it, so that revoking access at the signer takes effect
+// once the outstanding URLs expire.
+// If the origin rejects a URL with 401 Unauthorized or 403 Forbidden,
+// the loader signs again and retries once, in case the URL was revoked
+// or the clocks disagree.
+// Otherwise the loader behaves like one returned by New with nil options.
+func NewSignedURLLoader(sign func(path string) (url string, expires time.Time, err error)) diskcache.Loader {
+	l, _ := newLoader("", nil) // cannot fail without options
+	l.signer = &signer{sign: sign, urls: make(map[string]signedURL)}
+	return l
+}
+
+// A signer obtains and remembers signed URLs.
+type signer struct {
+	sign func(path string) (string, time.Time, error)
+
+	mu   sync.Mutex
+	urls map[string]signedURL // by path
+}
+
+type signedURL struct {
+	url     string
+	expires time.Time
+}
+
+// url returns a signed URL for path that is not about to expire.
+func (s *signer) url(path string) (string, error) {
+	s.mu.Lock()
+	u, ok := s.urls[path]
+	s.mu.Unlock()
+	if ok && time.Until(u.expires) > signMargin {
+		return u.url, nil
+	}
+	url, expires, err := s.sign(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	// Drop expired URLs, so that the map does not grow without bound.
+	now := time.Now()
+	for p, u := range s.urls {
+		if now.After(u.expires) {
+			delete(s.urls, p)
+		}
+	}
+	s.urls[path] = signedURL{url, expires}
+	s.mu.Unlock()
+	return url, nil
+}
+
+// forget discards the signed URL for path.
+func (s *signer) forget(path string) {
+	s.mu.Lock()
+	delete(s.urls, path)
+	s.mu.Unlock()
+}
+
+// limit shortens the lifetime in m to end when the signed URL
+// for path expires.
+func (s *signer) limit(path string, m *diskcache.LoadMeta) {
+	s.mu.Lock()
+	u, ok := s.urls[path]
+	s.mu.Unlock()
+	if !ok || m.MaxAge < 0 {
+		return
+	}
+	d := time.Until(u.expires)
+	if d <= 0 {
+		m.MaxAge = -1
+		return
+	}
+	if m.MaxAge == 0 || m.MaxAge > d {
+		m.MaxAge = d
+	}
+}
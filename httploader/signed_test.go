@@ -0,0 +1,88 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httploader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func TestSignedURLLoader(t *testing.T) {
+	sig := func(path string, expires int64) string {
+		return fmt.Sprintf("%x", fmt.Sprintf("%s:%d", path, expires))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		if err != nil || q.Get("sig") != sig(r.URL.Path, expires) || time.Now().Unix() > expires {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	var (
+		signs    int
+		lifetime = time.Hour
+		bad      bool
+	)
+	l := NewSignedURLLoader(func(path string) (string, time.Time, error) {
+		signs++
+		expires := time.Now().Add(lifetime)
+		s := sig(path, expires.Unix())
+		if bad {
+			s = "bad"
+			bad = false
+		}
+		return fmt.Sprintf("%s%s?expires=%d&sig=%s", srv.URL, path, expires.Unix(), s), expires, nil
+	})
+
+	load := func(path string) []byte {
+		t.Helper()
+		f, cleanup := tempFile(t)
+		defer cleanup()
+		valid, meta, err := l.Load(path, f, nil)
+		if valid || err != nil {
+			t.Fatalf("Load(%q) = %v, %v, want false, nil", path, valid, err)
+		}
+		if data, _ := ioutil.ReadFile(f.Name()); string(data) != "data" {
+			t.Fatalf("Load(%q) loaded %q, want %q", path, data, "data")
+		}
+		return meta
+	}
+
+	// A URL is reused until it is about to expire.
+	meta := load("/file")
+	load("/file")
+	if signs != 1 {
+		t.Fatalf("signed %d times for two loads, want 1", signs)
+	}
+	if m := diskcache.ParseLoadMeta(meta); m.MaxAge <= 0 || m.MaxAge > time.Hour {
+		t.Fatalf("MaxAge = %v, want at most the URL lifetime", m.MaxAge)
+	}
+
+	lifetime = signMargin / 2
+	load("/short")
+	load("/short")
+	if signs != 3 {
+		t.Fatalf("signed %d times, want 3 after two loads of a short-lived URL", signs)
+	}
+
+	// A rejected URL is signed again.
+	lifetime = time.Hour
+	bad = true
+	load("/other")
+	if signs != 5 {
+		t.Fatalf("signed %d times, want 5 after a rejected URL", signs)
+	}
+}
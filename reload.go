@@ -0,0 +1,50 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// OnReload arranges for cache.ExpireAll to be called each time the process
+// receives one of the given signals, or SIGHUP if none are given.
+// This lets an operator force a long-running server to revalidate
+// all its cached files, as in kill -HUP.
+//
+// OnReload returns a function that stops the signal handling.
+// After stop returns, the signals are no longer delivered to the cache
+// and the goroutine handling them has exited.
+func OnReload(cache *diskcache.Cache, sig ...os.Signal) (stop func()) {
+	if len(sig) == 0 {
+		sig = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	done := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ch:
+				if err := cache.ExpireAll(); err != nil {
+					log.Printf("cloud.OnReload: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+		<-exited
+	}
+}
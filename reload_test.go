@@ -0,0 +1,54 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"rsc.io/cloud/diskcache"
+)
+
+func TestOnReload(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(loadHello))
+	defer cleanup()
+
+	if _, err := c.ReadFile("file"); err != nil {
+		t.Fatal(err)
+	}
+	stop := OnReload(c, syscall.SIGUSR1)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(1 * time.Millisecond) {
+		exp, _, err := c.ExpiresAt("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp.Equal(time.Unix(0, 0)) {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for signal to expire cache")
+		}
+	}
+}
+
+func ExampleOnReload() {
+	loader := diskcache.NewFSLoader(os.DirFS("/var/www"))
+	cache, err := diskcache.New("/tmp/webcache", loader)
+	if err != nil {
+		panic(err)
+	}
+	cache.SetExpiration(1 * time.Hour)
+
+	// Revalidate everything on kill -HUP.
+	stop := OnReload(cache)
+	defer stop()
+}
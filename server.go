@@ -0,0 +1,152 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerOptions holds the timeouts for a server started by ServeHTTPSOptions.
+// A zero field selects the default listed in its comment;
+// a negative field disables that timeout.
+type ServerOptions struct {
+	// HandshakeTimeout bounds the time a client may take
+	// to complete the TLS handshake (default 10 seconds).
+	// A connection that has not completed the handshake
+	// in that time is dropped.
+	HandshakeTimeout time.Duration
+
+	// ReadHeaderTimeout bounds the time to read request headers
+	// (default 10 seconds). See http.Server.
+	ReadHeaderTimeout time.Duration
+
+	// ReadTimeout bounds the time to read an entire request,
+	// including the body (default 1 minute). See http.Server.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds the time to write a response
+	// (default none, so that large files can be served to slow clients).
+	// See http.Server.
+	WriteTimeout time.Duration
+
+	// IdleTimeout bounds the time an idle keep-alive connection
+	// is kept open (default 2 minutes). See http.Server.
+	IdleTimeout time.Duration
+}
+
+// Default server timeouts.
+const (
+	defaultHandshakeTimeout  = 10 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 1 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// timeout returns d, or def if d is zero, or 0 (no timeout) if d is negative.
+func timeout(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// serveTLS serves HTTPS connections accepted from ln using config and handler.
+func serveTLS(ln net.Listener, config *tls.Config, handler http.Handler, opts *ServerOptions) error {
+	var o ServerOptions
+	if opts != nil {
+		o = *opts
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		TLSConfig:         config,
+		ReadHeaderTimeout: timeout(o.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       timeout(o.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      timeout(o.WriteTimeout, 0),
+		IdleTimeout:       timeout(o.IdleTimeout, defaultIdleTimeout),
+	}
+	return srv.Serve(newHandshakeListener(ln, config, timeout(o.HandshakeTimeout, defaultHandshakeTimeout)))
+}
+
+// A handshakeListener is a TLS listener that completes the handshake
+// on each connection before returning it from Accept,
+// dropping connections that do not complete the handshake in time.
+// The handshakes run concurrently, so that a slow client cannot
+// hold up connections from other clients.
+type handshakeListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+	conns   chan net.Conn
+	errc    chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newHandshakeListener(ln net.Listener, config *tls.Config, timeout time.Duration) *handshakeListener {
+	l := &handshakeListener{
+		Listener: ln,
+		config:   config,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errc:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakeListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.errc <- err
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *handshakeListener) handshake(c net.Conn) {
+	tc := tls.Server(c, l.config)
+	if l.timeout > 0 {
+		tc.SetDeadline(time.Now().Add(l.timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+	select {
+	case l.conns <- tc:
+	case <-l.done:
+		tc.Close()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errc:
+		l.errc <- err // for future calls
+		return nil, err
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeTLSHandshakeTimeout(t *testing.T) {
+	// Borrow the test certificate from an httptest server.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: ts.TLS.Certificates}
+	ts.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	const handshakeTimeout = 100 * time.Millisecond
+	go serveTLS(ln, config, handler, &ServerOptions{HandshakeTimeout: handshakeTimeout})
+
+	// A client that never starts the handshake is dropped.
+	start := time.Now()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A stalled client does not hold up others.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("GET = %q, %v, want %q, nil", data, err, "hello")
+	}
+
+	c.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read from stalled connection succeeded")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("stalled connection not dropped")
+	}
+	if d := time.Since(start); d < handshakeTimeout {
+		t.Fatalf("stalled connection dropped after %v, before handshake timeout %v", d, handshakeTimeout)
+	}
+}
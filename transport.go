@@ -0,0 +1,351 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rsc.io/cloud/diskcache"
+)
+
+// NewTransport returns an http.RoundTripper that serves GET and HEAD
+// requests from cache, sending all other requests to base unchanged.
+// If base is nil, http.DefaultTransport is used.
+//
+// The transport reads the response for a URL from the cached file
+// named by the URL's host, path, and query, as in /example.com/x/y?z,
+// so the cache's loader must know how to fetch such paths.
+// For example, the loader returned by httploader.New("https:/", nil)
+// fetches them over HTTPS.
+//
+// Requests with a Cache-Control: no-cache or no-store header
+// or a Pragma: no-cache header bypass the cache and go to base,
+// as do requests with an Authorization header, since the cache
+// is shared by all requests and the loader does not send credentials.
+// A request for a single byte range is served from the cache using
+// Cache.OpenRange, which loads only the requested bytes if the
+// cache's loader supports it. Other Range requests go to base.
+//
+// If the cached response records a Vary header, as a loader does when
+// configured to capture it (see diskcache.LoadMeta.CaptureHeaders),
+// the transport caches a separate variant of the response for each
+// combination of values of the named request headers, fetching each
+// variant from base with the request's headers. Range requests for
+// such responses, and all requests for responses with Vary: *,
+// go to base. The transport learns that a response varies only from
+// a complete cached copy, however: a Range request for a file with no
+// complete copy in the cache is served using OpenRange, whose loader
+// does not see the request's headers, so for a response that varies
+// it may return bytes of a variant other than the one requested.
+// Callers fetching byte ranges of varying responses should first
+// fetch the complete response, or send such requests to base directly.
+func NewTransport(cache *diskcache.Cache, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{cache, base}
+}
+
+type transport struct {
+	cache *diskcache.Cache
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" || bypassCache(req.Header) {
+		return t.base.RoundTrip(req)
+	}
+	if req.Header.Get("Authorization") != "" {
+		// The response may depend on the credentials.
+		return t.base.RoundTrip(req)
+	}
+	name := "/" + req.URL.Host + req.URL.Path
+	if req.URL.RawQuery != "" {
+		name += "?" + req.URL.RawQuery
+	}
+	vary := t.vary(name)
+	if rng := req.Header.Get("Range"); rng != "" {
+		// If no complete copy is cached, vary is "" even for
+		// a response that varies; see the NewTransport doc comment.
+		off, n, ok := parseRange(rng)
+		if !ok || vary != "" {
+			return t.base.RoundTrip(req)
+		}
+		return t.serveRange(req, name, off, n)
+	}
+	if vary == "*" {
+		return t.base.RoundTrip(req)
+	}
+
+	if vary == "" {
+		f, err := t.cache.Open(name)
+		if err != nil {
+			return t.errorResponse(req, err)
+		}
+		// The first load may reveal that the response varies.
+		if vary = t.vary(name); vary == "" {
+			return t.serveFile(req, name, f)
+		}
+		f.Close()
+		if vary == "*" {
+			return t.base.RoundTrip(req)
+		}
+	}
+	key := variantKey(name, vary, req.Header)
+	f, err := t.cache.OpenLoader(key, t.variantLoader(req))
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+	return t.serveFile(req, key, f)
+}
+
+// serveFile serves the cached file f, the copy of the file name.
+func (t *transport) serveFile(req *http.Request, name string, f *os.File) (*http.Response, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	resp := t.response(req, name, 200)
+	resp.ContentLength = fi.Size()
+	resp.Header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	if req.Method == "HEAD" {
+		f.Close()
+		resp.Body = http.NoBody
+	} else {
+		resp.Body = f
+	}
+	return resp, nil
+}
+
+// serveRange serves n bytes of the file name starting at off,
+// or all bytes from off to the end of the file if n is negative.
+func (t *transport) serveRange(req *http.Request, name string, off, n int64) (*http.Response, error) {
+	r, err := t.cache.OpenRange(name, off, n)
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+	size := int64(-1)
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		size = s.Size()
+	}
+	total := "*"
+	if s, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := s.Stat(); err == nil {
+			total = strconv.FormatInt(fi.Size(), 10)
+		}
+	}
+	if size == 0 && n != 0 {
+		r.Close()
+		resp := t.response(req, name, http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("Content-Range", "bytes */"+total)
+		resp.Body = http.NoBody
+		return resp, nil
+	}
+	resp := t.response(req, name, http.StatusPartialContent)
+	if size >= 0 {
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", off, off+size-1, total))
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		resp.ContentLength = size
+	} else {
+		resp.ContentLength = -1
+	}
+	if req.Method == "HEAD" {
+		r.Close()
+		resp.Body = http.NoBody
+	} else {
+		resp.Body = r
+	}
+	return resp, nil
+}
+
+// response returns a response to req with the given status code
+// and the headers recorded in the cache's metadata for name.
+func (t *transport) response(req *http.Request, name string, code int) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	if code >= 300 {
+		return resp
+	}
+	e, err := t.cache.Stat(name)
+	if err != nil {
+		return resp
+	}
+	m := diskcache.ParseLoadMeta(e.Meta)
+	for k, v := range m.Header {
+		resp.Header.Set(k, v)
+	}
+	if m.ETag != "" {
+		resp.Header.Set("Etag", m.ETag)
+	}
+	if !m.LastModified.IsZero() {
+		resp.Header.Set("Last-Modified", m.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if m.ContentType != "" {
+		resp.Header.Set("Content-Type", m.ContentType)
+	}
+	if m.ContentEncoding != "" {
+		resp.Header.Set("Content-Encoding", m.ContentEncoding)
+	}
+	return resp
+}
+
+// vary returns the Vary header recorded in the metadata for the cached
+// copy of name, or "" if there is none.
+func (t *transport) vary(name string) string {
+	e, err := t.cache.Stat(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(diskcache.ParseLoadMeta(e.Meta).Header["Vary"])
+}
+
+// variantKey returns the cache key for the variant of name
+// selected by the values in h of the headers listed in vary.
+func variantKey(name, vary string, h http.Header) string {
+	var names []string
+	for _, f := range strings.Split(vary, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			names = append(names, textproto.CanonicalMIMEHeaderKey(f))
+		}
+	}
+	sort.Strings(names)
+	key := name + "#vary"
+	for _, f := range names {
+		key += "&" + f + "=" + url.QueryEscape(strings.Join(h.Values(f), ", "))
+	}
+	return key
+}
+
+// variantLoader returns a loader that fetches the variant of the
+// response to req from base, sending req's headers so that the origin
+// selects the variant. The loader records the response's Vary header,
+// along with its validators, which it uses to revalidate the copy.
+func (t *transport) variantLoader(req *http.Request) diskcache.Loader {
+	return diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		r := req.Clone(req.Context())
+		r.Method = "GET"
+		r.Body = nil
+		r.ContentLength = 0
+		// The caller's conditions and ranges apply to its own response,
+		// not to the copy being cached.
+		for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+			r.Header.Del(h)
+		}
+		m := diskcache.ParseLoadMeta(meta)
+		if m.ETag != "" {
+			r.Header.Set("If-None-Match", m.ETag)
+		}
+		if !m.LastModified.IsZero() {
+			r.Header.Set("If-Modified-Since", m.LastModified.UTC().Format(http.TimeFormat))
+		}
+		resp, err := t.base.RoundTrip(r)
+		if err != nil {
+			return false, nil, err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == 304 && meta != nil:
+			return true, meta, nil
+		case resp.StatusCode == 404:
+			return false, nil, diskcache.ErrNotFound
+		case resp.StatusCode != 200:
+			return false, nil, &diskcache.StatusError{Code: resp.StatusCode, Status: resp.Status}
+		}
+		n, err := io.Copy(target, resp.Body)
+		if err != nil {
+			return false, nil, err
+		}
+		m = &diskcache.LoadMeta{
+			ETag:            resp.Header.Get("Etag"),
+			ContentType:     resp.Header.Get("Content-Type"),
+			ContentEncoding: resp.Header.Get("Content-Encoding"),
+			Size:            n,
+		}
+		if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			m.LastModified = lm
+		}
+		m.CaptureHeaders(resp.Header, []string{"Vary", "Content-Language"})
+		return false, m.Marshal(), nil
+	})
+}
+
+// errorResponse returns the response to req for the cache error err.
+// Files the loader reports as not found become 404 responses,
+// and a StatusError becomes a response with its status code;
+// other errors, such as transport failures, are returned as is.
+func (t *transport) errorResponse(req *http.Request, err error) (*http.Response, error) {
+	code := http.StatusNotFound
+	var se *diskcache.StatusError
+	switch {
+	case errors.As(err, &se):
+		code = se.Code
+	case !errors.Is(err, diskcache.ErrNotFound):
+		return nil, err
+	}
+	resp := t.response(req, "", code)
+	if se != nil && se.Status != "" {
+		resp.Status = se.Status
+	}
+	resp.Body = http.NoBody
+	return resp, nil
+}
+
+// bypassCache reports whether the request headers h
+// ask not to be served from a cache.
+func bypassCache(h http.Header) bool {
+	for _, cc := range h["Cache-Control"] {
+		for _, f := range strings.Split(cc, ",") {
+			f = strings.ToLower(strings.TrimSpace(f))
+			if f == "no-cache" || f == "no-store" {
+				return true
+			}
+		}
+	}
+	return strings.EqualFold(h.Get("Pragma"), "no-cache")
+}
+
+// parseRange parses a Range header value of the form bytes=off-end or
+// bytes=off-, returning the offset and length of the range.
+// The length is -1 for an open-ended range.
+// It reports false for other forms, such as multiple or suffix ranges.
+func parseRange(s string) (off, n int64, ok bool) {
+	s, ok = strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok || start == "" {
+		return 0, 0, false
+	}
+	off, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, false
+	}
+	if end == "" {
+		return off, -1, true
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || last < off {
+		return 0, 0, false
+	}
+	return off, last - off + 1, true
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"rsc.io/cloud/diskcache"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransport(t *testing.T) {
+	loads := 0
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		loads++
+		switch path {
+		case "/example.com/unavailable":
+			return false, nil, &diskcache.StatusError{Code: 503, Status: "503 Service Unavailable"}
+		case "/example.com/unreachable":
+			return false, nil, errors.New("connection refused")
+		}
+		return loadHello(path, target, meta)
+	}))
+	defer cleanup()
+
+	var sent []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.Method+" "+req.URL.String())
+		return &http.Response{StatusCode: 200, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+	client := &http.Client{Transport: NewTransport(c, base)}
+
+	do := func(method, url string, header ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	body := func(resp *http.Response) string {
+		t.Helper()
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	const want = "hello, /example.com/file\n"
+	for i := 0; i < 2; i++ {
+		if resp := do("GET", "http://example.com/file"); resp.StatusCode != 200 || body(resp) != want {
+			t.Fatalf("GET: %d, want 200 %q", resp.StatusCode, want)
+		}
+	}
+	if loads != 1 || len(sent) != 0 {
+		t.Fatalf("after two GETs: %d loads, sent %q, want 1 load and nothing sent", loads, sent)
+	}
+
+	resp := do("GET", "http://example.com/file", "Range", "bytes=7-10")
+	if got := body(resp); resp.StatusCode != 206 || got != "/exa" || resp.Header.Get("Content-Range") != "bytes 7-10/25" {
+		t.Fatalf("range GET: %d %q %q, want 206 %q %q", resp.StatusCode, resp.Header.Get("Content-Range"), got, "bytes 7-10/25", "/exa")
+	}
+
+	// POST, no-cache, and authorized requests go to the base transport.
+	body(do("POST", "http://example.com/file"))
+	body(do("GET", "http://example.com/file", "Cache-Control", "no-cache"))
+	body(do("GET", "http://example.com/file", "Authorization", "Bearer secret"))
+	wantSent := []string{"POST http://example.com/file", "GET http://example.com/file", "GET http://example.com/file"}
+	if strings.Join(sent, "\n") != strings.Join(wantSent, "\n") || loads != 1 {
+		t.Fatalf("sent %q with %d loads, want %q with 1 load", sent, loads, wantSent)
+	}
+
+	// A loader status error becomes a response with that status;
+	// other loader errors are returned as errors.
+	if resp := do("GET", "http://example.com/unavailable"); resp.StatusCode != 503 {
+		t.Fatalf("GET unavailable: %d, want 503", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/unreachable", nil)
+	if resp, err := client.Do(req); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		t.Fatalf("GET unreachable: err = %v, want connection refused", err)
+	}
+}
+
+func TestTransportVary(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.WriteString("hello\n")
+		m := &diskcache.LoadMeta{Header: map[string]string{"Vary": "Accept-Language"}}
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+
+	greetings := map[string]string{"en": "hello\n", "fr": "bonjour\n"}
+	var sent []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		lang := req.Header.Get("Accept-Language")
+		sent = append(sent, lang)
+		h := http.Header{"Vary": {"Accept-Language"}, "Content-Language": {lang}}
+		return &http.Response{StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader(greetings[lang])), Request: req}, nil
+	})
+	client := &http.Client{Transport: NewTransport(c, base)}
+
+	get := func(lang string) string {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com/greeting", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Language", lang)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Content-Language"); got != lang {
+			t.Errorf("GET %s: Content-Language %q, want %q", lang, got, lang)
+		}
+		return string(data)
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"fr", "en"} {
+			if got := get(lang); got != greetings[lang] {
+				t.Fatalf("GET %s = %q, want %q", lang, got, greetings[lang])
+			}
+		}
+	}
+	if strings.Join(sent, ",") != "fr,en" {
+		t.Fatalf("sent requests for %q, want one each for fr and en", sent)
+	}
+
+	h := http.Header{}
+	h.Set("Accept-Language", "fr")
+	fr := variantKey("/example.com/greeting", "accept-language", h)
+	h.Set("Accept-Language", "en")
+	en := variantKey("/example.com/greeting", "Accept-Language", h)
+	if fr == en {
+		t.Fatalf("variants share key %q", fr)
+	}
+	for _, key := range []string{fr, en} {
+		if _, err := c.Stat(key); err != nil {
+			t.Errorf("variant %s not cached: %v", key, err)
+		}
+	}
+}
+
+func TestTransportVaryConditional(t *testing.T) {
+	c, cleanup := newCache(t, diskcache.LoaderFunc(func(path string, target *os.File, meta []byte) (bool, []byte, error) {
+		target.WriteString("hello\n")
+		m := &diskcache.LoadMeta{Header: map[string]string{"Vary": "Accept-Language"}}
+		return false, m.Marshal(), nil
+	}))
+	defer cleanup()
+
+	var sent []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{StatusCode: 304, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+		}
+		h := http.Header{"Vary": {"Accept-Language"}, "Etag": {`"v1"`}}
+		return &http.Response{StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader("bonjour\n")), Request: req}, nil
+	})
+	client := &http.Client{Transport: NewTransport(c, base)}
+
+	// The caller's validator must not turn the first fill into a 304.
+	req, err := http.NewRequest("GET", "http://example.com/greeting", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 || string(data) != "bonjour\n" {
+		t.Fatalf("conditional GET: %d %q, %v, want 200 %q", resp.StatusCode, data, err, "bonjour\n")
+	}
+	if len(sent) != 1 || sent[0] != "" {
+		t.Fatalf("sent If-None-Match %q, want one request without it", sent)
+	}
+	h := http.Header{}
+	h.Set("Accept-Language", "fr")
+	if _, err := c.Stat(variantKey("/example.com/greeting", "Accept-Language", h)); err != nil {
+		t.Fatalf("variant not cached: %v", err)
+	}
+}
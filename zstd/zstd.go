@@ -0,0 +1,36 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zstd makes the Zstandard content coding ("zstd") available
+// for decoding cached copies stored with it, such as objects an origin
+// serves with Content-Encoding: zstd, whose encoding the loaders record
+// (see diskcache.LoadMeta.ContentEncoding). A file server created by
+// cloud.FileServer then sends such a copy as is to clients that accept
+// zstd and decodes it for all others.
+//
+// The package is used only for its side effect of registering the coding:
+//
+//	import _ "rsc.io/cloud/zstd"
+//
+// It is separate from package cloud so that programs not using Zstandard
+// do not depend on the Zstandard implementation.
+package zstd
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"rsc.io/cloud"
+)
+
+func init() {
+	cloud.RegisterDecoder("zstd", func(r io.Reader) (io.ReadCloser, error) {
+		// Decoding one response needs no concurrency.
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"rsc.io/cloud"
+	"rsc.io/cloud/diskcache"
+	"rsc.io/cloud/httploader"
+)
+
+const text = "hello, zstd, hello, zstd, hello\n"
+
+func TestFileServer(t *testing.T) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := enc.EncodeAll([]byte(text), nil)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write(encoded)
+	}))
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "zstd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := httploader.New(origin.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := diskcache.New(dir+"/cache", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := cloud.FileServer(c, "/", nil)
+	get := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/file.txt", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// The loader records the encoding of the stored bytes.
+	w := get("")
+	if w.Code != 200 || w.Body.String() != text {
+		t.Fatalf("GET without zstd: %d %q, want 200 %q", w.Code, w.Body, text)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("GET without zstd: Content-Encoding = %q, want none", ce)
+	}
+	e, err := c.Stat("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce := diskcache.ParseLoadMeta(e.Meta).ContentEncoding; ce != "zstd" {
+		t.Fatalf("recorded ContentEncoding = %q, want zstd", ce)
+	}
+
+	// A client accepting zstd gets the stored bytes.
+	w = get("gzip, zstd")
+	if ce := w.Header().Get("Content-Encoding"); ce != "zstd" || w.Body.String() != string(encoded) {
+		t.Fatalf("GET with zstd: Content-Encoding = %q, body %q, want zstd and the encoded bytes", ce, w.Body)
+	}
+}